@@ -0,0 +1,40 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"go.store/internal/engine"
+)
+
+var backupCmd = &cobra.Command{
+	Use:   "backup <dbname> <dest>",
+	Args:  cobra.ExactArgs(2),
+	Short: "Write a verified copy of a database to a new file",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dbname, dest := args[0], args[1]
+
+		db, err := engine.Open(dbname, cfg)
+		if err != nil {
+			return err
+		}
+
+		stats, err := db.BackupFile(dest)
+		if err != nil {
+			db.Close()
+			return err
+		}
+
+		if err := db.Close(); err != nil {
+			return err
+		}
+
+		fmt.Printf("Database %s backed up to %s at LSN %d: %d pages, %d KiB (crc32 %08x)\n",
+			dbname, dest, stats.LSN, stats.Pages, stats.Bytes/1024, stats.Checksum)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(backupCmd)
+}
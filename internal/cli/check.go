@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"go.store/internal/storage"
+)
+
+var checkJSON bool
+
+var checkCmd = &cobra.Command{
+	Use:   "check <dbname>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Check the integrity of a database",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dbname := args[0]
+
+		dbPath := filepath.Join(cfg.DataDir, dbname, dbname+".db")
+		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+			return fmt.Errorf("%s does not exist", dbname)
+		}
+
+		log, closeLog, err := openDBLogger(cfg, dbname)
+		if err != nil {
+			return err
+		}
+		defer closeLog()
+
+		report, err := storage.Verify(dbPath, log)
+		if err != nil {
+			return err
+		}
+
+		if checkJSON {
+			out, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(out))
+		} else {
+			printReport(dbname, report)
+		}
+
+		if !report.OK() {
+			return fmt.Errorf("%s has %d problem(s)", dbname, len(report.Problems))
+		}
+		return nil
+	},
+}
+
+func printReport(dbname string, r *storage.VerifyReport) {
+	fmt.Printf("Database %s\n", dbname)
+	fmt.Printf("  pages:    %d of %d bytes (%d leaf, %d internal, %d overflow, %d free)\n",
+		r.Pages, r.PageSize, r.LeafPages, r.InternalPages, r.OverflowPages, r.FreePages)
+	fmt.Printf("  keys:     %d\n", r.Keys)
+	fmt.Printf("  depth:    %d\n", r.Depth)
+
+	if r.OK() {
+		fmt.Println("No problems found")
+		return
+	}
+
+	fmt.Printf("%d problem(s) found:\n", len(r.Problems))
+	for _, p := range r.Problems {
+		fmt.Printf("  page %d [%s] %s\n", p.Page, p.Kind, p.Message)
+	}
+}
+
+func init() {
+	checkCmd.Flags().BoolVar(&checkJSON, "json", false, "Print the report as JSON")
+	rootCmd.AddCommand(checkCmd)
+}
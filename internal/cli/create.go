@@ -9,6 +9,11 @@ import (
 	"go.store/internal/storage"
 )
 
+var (
+	createPageSize          int
+	createPrefixCompression bool
+)
+
 var createCmd = &cobra.Command{
 	Use:   "create <dbname>",
 	Args:  cobra.ExactArgs(1),
@@ -24,7 +29,10 @@ var createCmd = &cobra.Command{
 		dbPath := filepath.Join(dbDir, dbname+".db")
 
 		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-			f, cErr := storage.CreateDatabase(dbPath)
+			f, cErr := storage.CreateDatabaseWithOptions(dbPath, storage.CreateOptions{
+				PageSize:          createPageSize,
+				PrefixCompression: createPrefixCompression,
+			})
 			if cErr != nil {
 				return cErr
 			}
@@ -39,5 +47,7 @@ var createCmd = &cobra.Command{
 }
 
 func init() {
+	createCmd.Flags().IntVar(&createPageSize, "page-size", storage.DefaultPageSize, "Page size in bytes, a power of two from 4096 to 65536")
+	createCmd.Flags().BoolVar(&createPrefixCompression, "prefix-compression", false, "Store the prefix shared by the keys of each leaf once")
 	rootCmd.AddCommand(createCmd)
 }
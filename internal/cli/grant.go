@@ -22,7 +22,7 @@ var grantCmd = &cobra.Command{
 
 		u := fs.GetUser(username)
 		if u == nil {
-			return fmt.Errorf("Could not find user %s")
+			return fmt.Errorf("Could not find user %s", username)
 		}
 
 		if !slices.Contains(u.AccessDB, dbname) {
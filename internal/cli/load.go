@@ -0,0 +1,106 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"go.store/internal/storage"
+)
+
+var loadFillFactor float64
+
+// Values can be large, lines are allowed to grow up to this many bytes
+const maxLoadLine = 64 << 20
+
+var loadCmd = &cobra.Command{
+	Use:   "load <dbname> <file>",
+	Args:  cobra.ExactArgs(2),
+	Short: "Fill an empty database from a sorted file of tab separated keys and values",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dbname, src := args[0], args[1]
+
+		dbPath := filepath.Join(cfg.DataDir, dbname, dbname+".db")
+		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+			return fmt.Errorf("%s does not exist", dbname)
+		}
+
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		log, closeLog, err := openDBLogger(cfg, dbname)
+		if err != nil {
+			return err
+		}
+		defer closeLog()
+
+		it := newLineIterator(in)
+		stats, err := storage.BulkLoad(dbPath, it, storage.BulkLoadOptions{FillFactor: loadFillFactor}, log)
+		if err != nil && it.line > 0 {
+			return fmt.Errorf("%s line %d: %w", src, it.line, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Loaded %d keys into %s (%d leaf, %d internal and %d overflow pages, depth %d)\n",
+			stats.Keys, dbname, stats.LeafPages, stats.InternalPages, stats.OverflowPages, stats.Depth)
+		return nil
+	},
+}
+
+// Reads one tab separated key and value per line
+type lineIterator struct {
+	scanner  *bufio.Scanner
+	line     int
+	key, val []byte
+	err      error
+}
+
+func newLineIterator(f *os.File) *lineIterator {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxLoadLine)
+	return &lineIterator{scanner: scanner}
+}
+
+func (it *lineIterator) Next() bool {
+	if it.err != nil || !it.scanner.Scan() {
+		return false
+	}
+	it.line++
+
+	key, val, ok := bytes.Cut(it.scanner.Bytes(), []byte{'\t'})
+	if !ok {
+		it.err = fmt.Errorf("expected a key and value separated by a tab")
+		return false
+	}
+
+	it.key, it.val = key, val
+	return true
+}
+
+func (it *lineIterator) Key() []byte {
+	return it.key
+}
+
+func (it *lineIterator) Value() []byte {
+	return it.val
+}
+
+func (it *lineIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.scanner.Err()
+}
+
+func init() {
+	loadCmd.Flags().Float64Var(&loadFillFactor, "fill-factor", storage.DefaultFillFactor, "Fraction of each page to fill, from 0.5 to 1")
+	rootCmd.AddCommand(loadCmd)
+}
@@ -0,0 +1,80 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.store/internal/storage"
+)
+
+var (
+	restoreUntil   string
+	restoreArchive string
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <src> <dbname>",
+	Args:  cobra.ExactArgs(2),
+	Short: "Create a database from a backup once it has been verified",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		src, dbname := args[0], args[1]
+
+		dbDir := filepath.Join(cfg.DataDir, dbname)
+		dbPath := filepath.Join(dbDir, dbname+".db")
+		if _, err := os.Stat(dbPath); err == nil {
+			return fmt.Errorf("%s already exists, delete it first to restore over it", dbname)
+		}
+
+		var opts storage.RestoreOptions
+		if restoreUntil != "" {
+			until, err := storage.ParseRecoveryTarget(restoreUntil)
+			if err != nil {
+				return err
+			}
+
+			opts.Until = until
+			opts.Archive = restoreArchive
+			if opts.Archive == "" {
+				opts.Archive = cfg.WALArchiveFor(dbname)
+			}
+			if opts.Archive == "" {
+				return fmt.Errorf("No archive to replay, set wal_archive in config.yaml or pass --archive")
+			}
+		}
+
+		if err := os.MkdirAll(dbDir, 0o755); err != nil {
+			return err
+		}
+
+		log, closeLog, err := openDBLogger(cfg, dbname)
+		if err != nil {
+			return err
+		}
+		defer closeLog()
+
+		stats, err := storage.Restore(src, dbPath, opts, log)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Database %s restored from %s: %d pages, %d keys\n", dbname, src, stats.Report.Pages, stats.Report.Keys)
+		if opts.Archive != "" {
+			r := stats.Recovery
+			fmt.Printf("Replayed %d frames from %d archived logs, LSN %d -> %d", r.Frames, r.Segments, r.From, r.To)
+			if !r.Time.IsZero() {
+				fmt.Printf(" (committed %s)", r.Time.Format(time.RFC3339))
+			}
+			fmt.Println()
+		}
+		return nil
+	},
+}
+
+func init() {
+	restoreCmd.Flags().StringVar(&restoreUntil, "until", "", "Replay the WAL archive up to an LSN, a time (RFC 3339) or latest")
+	restoreCmd.Flags().StringVar(&restoreArchive, "archive", "", "WAL archive to replay, defaults to the one set in config.yaml")
+	rootCmd.AddCommand(restoreCmd)
+}
@@ -3,9 +3,11 @@ package cli
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/spf13/cobra"
 	"go.store/internal/config"
+	"go.store/internal/logger"
 )
 
 var (
@@ -27,6 +29,7 @@ var rootCmd = &cobra.Command{
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
 
@@ -39,3 +42,13 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&configFlag, "config", "", "Path to config.yaml")
 
 }
+
+// Logger for commands that work on a database file without opening it through
+// the engine, it appends to the same log the engine writes. The func returned closes it
+func openDBLogger(cfg *config.Config, dbname string) (*logger.Logger, func(), error) {
+	f, err := os.OpenFile(filepath.Join(cfg.LogDir, dbname+".log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	return logger.New(f, logger.INFO), func() { f.Close() }, nil
+}
@@ -0,0 +1,51 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"go.store/internal/storage"
+)
+
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade <dbname>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Rewrite a database file in the current on-disk format",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dbname := args[0]
+
+		dbPath := filepath.Join(cfg.DataDir, dbname, dbname+".db")
+		if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+			return fmt.Errorf("%s does not exist", dbname)
+		}
+
+		log, closeLog, err := openDBLogger(cfg, dbname)
+		if err != nil {
+			return err
+		}
+		defer closeLog()
+
+		stats, err := storage.Upgrade(dbPath, log)
+		if err != nil {
+			return err
+		}
+
+		if len(stats.Steps) == 0 {
+			fmt.Printf("Database %s is already at format version %d\n", dbname, stats.To)
+			return nil
+		}
+
+		fmt.Printf("Database %s upgraded from format version %d to %d\n", dbname, stats.From, stats.To)
+		for _, step := range stats.Steps {
+			fmt.Printf("  - %s\n", step)
+		}
+		fmt.Printf("The original file was kept as %s\n", stats.Backup)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(upgradeCmd)
+}
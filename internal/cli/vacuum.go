@@ -0,0 +1,41 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"go.store/internal/engine"
+)
+
+var vacuumCmd = &cobra.Command{
+	Use:   "vacuum <dbname>",
+	Args:  cobra.ExactArgs(1),
+	Short: "Shrink a database file by releasing its free pages",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dbname := args[0]
+
+		db, err := engine.Open(dbname, cfg)
+		if err != nil {
+			return err
+		}
+
+		stats, err := db.Vacuum()
+		if err != nil {
+			db.Close()
+			return err
+		}
+
+		if err := db.Close(); err != nil {
+			return err
+		}
+
+		fmt.Printf("Database %s vacuumed: %d -> %d pages (%d KiB freed, %d pages moved)\n",
+			dbname, stats.PagesBefore, stats.PagesAfter,
+			int(stats.PagesBefore-stats.PagesAfter)*stats.PageSize/1024, stats.Moved)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(vacuumCmd)
+}
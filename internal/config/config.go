@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"go.yaml.in/yaml/v3"
 )
@@ -20,6 +21,30 @@ type Config struct {
 	CertDir   string `yaml:"cert_dir"`
 	TLSCert   string `yaml:"tls_cert"`
 	TLSKey    string `yaml:"tls_key"`
+
+	// Page cache size per open database, cache_pages takes precedence when set
+	CacheSizeMB int `yaml:"cache_size_mb"`
+	CachePages  int `yaml:"cache_pages"`
+
+	// When writes are fsynced before they are acknowledged: always, group or none.
+	// Group commit batches the fsyncs of writers arriving within commit_window
+	Durability   string        `yaml:"durability"`
+	CommitWindow time.Duration `yaml:"commit_window"`
+
+	// Copy each WAL to <wal_archive>/<dbname> before a checkpoint discards it, off when empty
+	WALArchive string `yaml:"wal_archive,omitempty"`
+	// BACKUP only writes files inside this directory
+	BackupDir string `yaml:"backup_dir"`
+
+	// Per database overrides keyed by database name
+	Databases map[string]DatabaseConfig `yaml:"databases,omitempty"`
+}
+
+type DatabaseConfig struct {
+	Durability   string        `yaml:"durability,omitempty"`
+	CommitWindow time.Duration `yaml:"commit_window,omitempty"`
+	// Archive directory of this database, used as is
+	WALArchive string `yaml:"wal_archive,omitempty"`
 }
 
 func LoadConfig(homeOverride, configOverride string) (*Config, error) {
@@ -41,16 +66,22 @@ func LoadConfig(homeOverride, configOverride string) (*Config, error) {
 	}
 
 	cfg := &Config{
-		Addr:     "127.0.0.1:57083",
-		Home:     home,
-		DataDir:  filepath.Join(home, "data"),
-		LogDir:   filepath.Join(home, "log"),
-		UserFile: filepath.Join(home, "users.json"),
+		Addr:      "127.0.0.1:57083",
+		Home:      home,
+		DataDir:   filepath.Join(home, "data"),
+		LogDir:    filepath.Join(home, "log"),
+		UserFile:  filepath.Join(home, "users.json"),
+		BackupDir: filepath.Join(home, "backup"),
 
 		EnableTLS: false,
 		CertDir:   filepath.Join(home, "cert"),
 		TLSCert:   filepath.Join(home, "cert", "server.crt"),
 		TLSKey:    filepath.Join(home, "cert", "server.key"),
+
+		CacheSizeMB: 64,
+
+		Durability:   "always",
+		CommitWindow: 2 * time.Millisecond,
 	}
 
 	cfgPath := configOverride
@@ -73,14 +104,15 @@ func LoadConfig(homeOverride, configOverride string) (*Config, error) {
 
 	_ = os.MkdirAll(cfg.DataDir, 0o755)
 	_ = os.MkdirAll(cfg.LogDir, 0o755)
+	_ = os.MkdirAll(cfg.BackupDir, 0o755)
 	_ = os.MkdirAll(cfg.CertDir, 0o755)
 
 	if cfg.EnableTLS {
 		if _, err := os.Stat(cfg.TLSCert); err != nil {
-			return nil, fmt.Errorf("Could not find TLS certificate: %w")
+			return nil, fmt.Errorf("Could not find TLS certificate: %w", err)
 		}
 		if _, err := os.Stat(cfg.TLSKey); err != nil {
-			return nil, fmt.Errorf("Could not find TLS key: %w")
+			return nil, fmt.Errorf("Could not find TLS key: %w", err)
 		}
 	}
 	return cfg, nil
@@ -98,3 +130,30 @@ func WriteConfig(path string, cfg *Config) error {
 
 	return nil
 }
+
+// Durability mode and commit window for a database, falling back to the global settings
+func (cfg *Config) DurabilityFor(dbname string) (string, time.Duration) {
+	mode, window := cfg.Durability, cfg.CommitWindow
+
+	if db, ok := cfg.Databases[dbname]; ok {
+		if db.Durability != "" {
+			mode = db.Durability
+		}
+		if db.CommitWindow > 0 {
+			window = db.CommitWindow
+		}
+	}
+
+	return mode, window
+}
+
+// Where a database archives its WAL, empty when archiving is off
+func (cfg *Config) WALArchiveFor(dbname string) string {
+	if db, ok := cfg.Databases[dbname]; ok && db.WALArchive != "" {
+		return db.WALArchive
+	}
+	if cfg.WALArchive == "" {
+		return ""
+	}
+	return filepath.Join(cfg.WALArchive, dbname)
+}
@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+
+	"go.store/internal/storage"
+)
+
+// WriteBatch collects writes and applies them together under one tree lock and
+// one WAL commit. Unlike a Tx nothing is checked until Write, and an op that
+// fails because of its key doesn't stop the others
+type WriteBatch struct {
+	engine *Engine
+	ops    []batchOp
+}
+
+type batchOp struct {
+	storage.Op
+	// Position the op was added at, results are returned in this order
+	idx int
+}
+
+func (e *Engine) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{engine: e}
+}
+
+func (b *WriteBatch) Set(key string, val []byte) {
+	b.put(key, val, storage.PutUpsert)
+}
+
+func (b *WriteBatch) SetNX(key string, val []byte) {
+	b.put(key, val, storage.PutIfAbsent)
+}
+
+func (b *WriteBatch) SetXX(key string, val []byte) {
+	b.put(key, val, storage.PutIfPresent)
+}
+
+func (b *WriteBatch) put(key string, val []byte, mode storage.PutMode) {
+	v := append([]byte(nil), val...)
+	b.add(storage.Op{Kind: storage.OpPut, Key: []byte(key), Val: v, Mode: mode})
+}
+
+func (b *WriteBatch) Delete(key string) {
+	b.add(storage.Op{Kind: storage.OpDelete, Key: []byte(key)})
+}
+
+func (b *WriteBatch) add(op storage.Op) {
+	b.ops = append(b.ops, batchOp{Op: op, idx: len(b.ops)})
+}
+
+// Len is the number of writes waiting for Write
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset drops every write that has not been applied yet
+func (b *WriteBatch) Reset() {
+	b.ops = nil
+}
+
+// Write applies the batch in key order and empties it. The result for each
+// write is in the order it was added, nil when it was applied. A non-nil error
+// means nothing was applied
+func (b *WriteBatch) Write() (results []error, err error) {
+	if len(b.ops) == 0 {
+		return nil, nil
+	}
+
+	// Neighbouring keys land on the same pages, a stable sort keeps writes to
+	// the same key in the order they were made
+	ops := slices.Clone(b.ops)
+	slices.SortStableFunc(ops, func(x, y batchOp) int {
+		return bytes.Compare(x.Key, y.Key)
+	})
+
+	sorted := make([]storage.Op, len(ops))
+	for i, op := range ops {
+		sorted[i] = op.Op
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			b.engine.log.Errorf("fatal storage error during batch write: %v", r)
+			results, err = nil, fmt.Errorf("fatal internal error: %v", r)
+		}
+	}()
+
+	applied, err := b.engine.tree.ApplyEach(sorted)
+	if err != nil {
+		return nil, err
+	}
+	b.ops = nil
+
+	results = make([]error, len(ops))
+	for i, op := range ops {
+		results[op.idx] = applied[i]
+	}
+	return results, nil
+}
@@ -1,14 +1,27 @@
 package engine
 
+import (
+	"io"
+
+	"go.store/internal/storage"
+)
+
 type Database struct {
 	engine *Engine
-	sync   bool
 }
 
 func (db *Database) Set(key string, val []byte) error {
 	return db.engine.Set(key, val)
 }
 
+func (db *Database) SetNX(key string, val []byte) error {
+	return db.engine.SetNX(key, val)
+}
+
+func (db *Database) SetXX(key string, val []byte) error {
+	return db.engine.SetXX(key, val)
+}
+
 func (db *Database) Delete(key string) error {
 	return db.engine.Delete(key)
 }
@@ -17,6 +30,57 @@ func (db *Database) Get(key string) ([]byte, error) {
 	return db.engine.Get(key)
 }
 
+// Begin starts a transaction, nothing it writes is visible until Commit
+func (db *Database) Begin() *Tx {
+	return db.engine.Begin()
+}
+
+// NewWriteBatch starts an empty batch, its writes are applied together by Write
+func (db *Database) NewWriteBatch() *WriteBatch {
+	return db.engine.NewWriteBatch()
+}
+
+// Snapshot pins a consistent view of the database for a sequence of reads,
+// writes carry on without it and it must be released when done
+func (db *Database) Snapshot() *Snapshot {
+	return db.engine.Snapshot()
+}
+
+func (db *Database) Scan(start, end string, limit int) ([]KV, error) {
+	return db.engine.Scan(start, end, limit)
+}
+
+func (db *Database) ReverseScan(start, end string, limit int) ([]KV, error) {
+	return db.engine.ReverseScan(start, end, limit)
+}
+
+func (db *Database) Vacuum() (storage.VacuumStats, error) {
+	return db.engine.Vacuum()
+}
+
+// Backup writes a copy of the database as of the last committed write to w,
+// the copy is a complete database file
+func (db *Database) Backup(w io.Writer) (storage.BackupStats, error) {
+	return db.engine.Backup(w)
+}
+
+// BackupFile writes a backup to a new file at path and verifies it
+func (db *Database) BackupFile(path string) (storage.BackupStats, error) {
+	return db.engine.BackupFile(path)
+}
+
+func (db *Database) CacheStats() storage.CacheStats {
+	return db.engine.CacheStats()
+}
+
+func (db *Database) SnapshotStats() storage.SnapshotStats {
+	return db.engine.SnapshotStats()
+}
+
+func (db *Database) WALStats() storage.WALStats {
+	return db.engine.WALStats()
+}
+
 func (db *Database) Close() error {
 	return db.engine.Close()
 }
@@ -1,7 +1,10 @@
 package engine
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 
 	"go.store/internal/logger"
 	"go.store/internal/storage"
@@ -19,15 +22,29 @@ func NewEngine(tree *storage.BTree, log *logger.Logger) *Engine {
 	}
 }
 
-func (e *Engine) Set(key string, value []byte) (err error) {
+// Set inserts the key or replaces its current value
+func (e *Engine) Set(key string, value []byte) error {
+	return e.put(key, value, storage.PutUpsert)
+}
+
+// SetNX only writes the value if the key does not exist yet
+func (e *Engine) SetNX(key string, value []byte) error {
+	return e.put(key, value, storage.PutIfAbsent)
+}
+
+// SetXX only writes the value if the key already exists
+func (e *Engine) SetXX(key string, value []byte) error {
+	return e.put(key, value, storage.PutIfPresent)
+}
+
+func (e *Engine) put(key string, value []byte, mode storage.PutMode) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			e.log.Errorf("fatal storage error during set: %v", r)
 			err = fmt.Errorf("fatal internal error: %v", r)
 		}
 	}()
-	_, err = e.tree.Insert([]byte(key), value)
-	return err
+	return e.tree.Put([]byte(key), value, mode)
 }
 
 func (e *Engine) Get(key string) ([]byte, error) {
@@ -41,10 +58,145 @@ func (e *Engine) Get(key string) ([]byte, error) {
 	return val, nil
 }
 
+// KV is a single key / value pair returned by range reads
+type KV struct {
+	Key   string
+	Value []byte
+}
+
+// Scan returns up to limit pairs in key order with start <= key < end.
+// An empty end scans to the last key and a limit <= 0 means no limit
+func (e *Engine) Scan(start, end string, limit int) ([]KV, error) {
+	return scan(e.tree.Cursor(), start, end, limit)
+}
+
+// ReverseScan is Scan in descending key order, still bounded by start <= key < end
+func (e *Engine) ReverseScan(start, end string, limit int) ([]KV, error) {
+	return reverseScan(e.tree.Cursor(), start, end, limit)
+}
+
+// What scans need from a cursor over the tree or a snapshot
+type cursor interface {
+	Seek(key []byte) bool
+	Last() bool
+	Next() bool
+	Prev() bool
+	Key() []byte
+	Value() ([]byte, error)
+	Err() error
+}
+
+func scan(c cursor, start, end string, limit int) ([]KV, error) {
+	var out []KV
+
+	for ok := c.Seek([]byte(start)); ok; ok = c.Next() {
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+
+		if end != "" && bytes.Compare(c.Key(), []byte(end)) >= 0 {
+			break
+		}
+
+		// A writer can delete the key between landing on it and reading it
+		val, err := c.Value()
+		if errors.Is(err, storage.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, KV{Key: string(c.Key()), Value: val})
+	}
+
+	return out, c.Err()
+}
+
+func reverseScan(c cursor, start, end string, limit int) ([]KV, error) {
+	var out []KV
+
+	// Seek lands on the first key >= end so step back once to get inside the range
+	var ok bool
+	if end == "" || !c.Seek([]byte(end)) {
+		ok = c.Err() == nil && c.Last()
+	} else {
+		ok = c.Prev()
+	}
+
+	for ; ok; ok = c.Prev() {
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+
+		if bytes.Compare(c.Key(), []byte(start)) < 0 {
+			break
+		}
+
+		// A writer can delete the key between landing on it and reading it
+		val, err := c.Value()
+		if errors.Is(err, storage.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, KV{Key: string(c.Key()), Value: val})
+	}
+
+	return out, c.Err()
+}
+
 func (e *Engine) Delete(key string) error {
 	return e.tree.Delete([]byte(key))
 }
 
+// Vacuum moves live pages to the front of the file and truncates the free pages behind them
+func (e *Engine) Vacuum() (stats storage.VacuumStats, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.log.Errorf("fatal storage error during vacuum: %v", r)
+			err = fmt.Errorf("fatal internal error: %v", r)
+		}
+	}()
+	return e.tree.Vacuum()
+}
+
+// Backup writes a consistent copy of the database file to w while writes carry on
+func (e *Engine) Backup(w io.Writer) (stats storage.BackupStats, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.log.Errorf("fatal storage error during backup: %v", r)
+			err = fmt.Errorf("fatal internal error: %v", r)
+		}
+	}()
+	return e.tree.Backup(w)
+}
+
+// BackupFile writes a backup to a new file at path and verifies it
+func (e *Engine) BackupFile(path string) (stats storage.BackupStats, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e.log.Errorf("fatal storage error during backup: %v", r)
+			err = fmt.Errorf("fatal internal error: %v", r)
+		}
+	}()
+	return e.tree.BackupFile(path)
+}
+
+func (e *Engine) CacheStats() storage.CacheStats {
+	return e.tree.CacheStats()
+}
+
+func (e *Engine) SnapshotStats() storage.SnapshotStats {
+	return e.tree.SnapshotStats()
+}
+
+func (e *Engine) WALStats() storage.WALStats {
+	return e.tree.WALStats()
+}
+
 func (e *Engine) Close() error {
 	return e.tree.Close()
 }
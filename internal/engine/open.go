@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -22,7 +23,24 @@ func Open(dbname string, cfg *config.Config) (*Database, error) {
 
 	log := logger.New(logFile, logger.INFO)
 
-	pager, pErr := storage.Open(dbPath, log)
+	mode, window := cfg.DurabilityFor(dbname)
+	durability, dErr := storage.ParseDurability(mode)
+	if dErr != nil {
+		return nil, dErr
+	}
+
+	opts := storage.Options{
+		CachePages:   cfg.CachePages,
+		CacheBytes:   cfg.CacheSizeMB * 1024 * 1024,
+		Durability:   durability,
+		CommitWindow: window,
+		ArchiveDir:   cfg.WALArchiveFor(dbname),
+	}
+
+	pager, pErr := storage.OpenWithOptions(dbPath, log, opts)
+	if errors.Is(pErr, storage.ErrUpgradeRequired) {
+		return nil, fmt.Errorf("%w, run `gostore upgrade %s` to rewrite it", pErr, dbname)
+	}
 	if pErr != nil {
 		return nil, pErr
 	}
@@ -36,6 +54,5 @@ func Open(dbname string, cfg *config.Config) (*Database, error) {
 
 	return &Database{
 		engine: eng,
-		sync:   true,
 	}, nil
 }
@@ -0,0 +1,41 @@
+package engine
+
+import (
+	"fmt"
+
+	"go.store/internal/storage"
+)
+
+// Snapshot reads the database as it was when the snapshot was taken. Its reads
+// never wait on writers and see none of the writes that came after it
+type Snapshot struct {
+	snap *storage.Snapshot
+}
+
+func (e *Engine) Snapshot() *Snapshot {
+	return &Snapshot{snap: e.tree.Snapshot()}
+}
+
+func (s *Snapshot) Get(key string) ([]byte, error) {
+	val, ok, err := s.snap.Search([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Key not found")
+	}
+	return val, nil
+}
+
+func (s *Snapshot) Scan(start, end string, limit int) ([]KV, error) {
+	return scan(s.snap.Cursor(), start, end, limit)
+}
+
+func (s *Snapshot) ReverseScan(start, end string, limit int) ([]KV, error) {
+	return reverseScan(s.snap.Cursor(), start, end, limit)
+}
+
+// Release lets the versions the snapshot reads be dropped, it can't be read afterwards
+func (s *Snapshot) Release() {
+	s.snap.Release()
+}
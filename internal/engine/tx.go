@@ -0,0 +1,147 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+
+	"go.store/internal/storage"
+)
+
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// Tx buffers writes in memory until Commit applies them to the tree as a single
+// atomic unit. Reads see the transaction's own writes on top of committed data
+type Tx struct {
+	engine *Engine
+	ops    []storage.Op
+	// Latest buffered write for each key
+	writes map[string]txWrite
+	done   bool
+}
+
+type txWrite struct {
+	val     []byte
+	deleted bool
+}
+
+func (e *Engine) Begin() *Tx {
+	return &Tx{
+		engine: e,
+		writes: make(map[string]txWrite),
+	}
+}
+
+func (tx *Tx) Get(key string) ([]byte, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+
+	if w, ok := tx.writes[key]; ok {
+		if w.deleted {
+			return nil, fmt.Errorf("Key not found")
+		}
+		return w.val, nil
+	}
+
+	return tx.engine.Get(key)
+}
+
+func (tx *Tx) exists(key string) (bool, error) {
+	if w, ok := tx.writes[key]; ok {
+		return !w.deleted, nil
+	}
+
+	_, ok, err := tx.engine.tree.Search([]byte(key))
+	return ok, err
+}
+
+func (tx *Tx) Set(key string, val []byte) error {
+	return tx.put(key, val, storage.PutUpsert)
+}
+
+func (tx *Tx) SetNX(key string, val []byte) error {
+	return tx.put(key, val, storage.PutIfAbsent)
+}
+
+func (tx *Tx) SetXX(key string, val []byte) error {
+	return tx.put(key, val, storage.PutIfPresent)
+}
+
+// Conditions are checked now against the transaction's view and again when
+// the commit applies them, so a conflicting write in between fails the commit
+func (tx *Tx) put(key string, val []byte, mode storage.PutMode) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	ok, err := tx.exists(key)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case ok && mode == storage.PutIfAbsent:
+		return storage.ErrKeyExists
+	case !ok && mode == storage.PutIfPresent:
+		return storage.ErrKeyNotFound
+	}
+
+	// Earlier buffered writes to this key mean the commit sees a different state
+	// to the tree right now, so only upserts are safe to replay
+	if _, buffered := tx.writes[key]; buffered {
+		mode = storage.PutUpsert
+	}
+
+	v := append([]byte(nil), val...)
+	tx.ops = append(tx.ops, storage.Op{Kind: storage.OpPut, Key: []byte(key), Val: v, Mode: mode})
+	tx.writes[key] = txWrite{val: v}
+	return nil
+}
+
+func (tx *Tx) Delete(key string) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	ok, err := tx.exists(key)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return storage.ErrDeleteMissingKey
+	}
+
+	tx.ops = append(tx.ops, storage.Op{Kind: storage.OpDelete, Key: []byte(key)})
+	tx.writes[key] = txWrite{deleted: true}
+	return nil
+}
+
+func (tx *Tx) Commit() (err error) {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			tx.engine.log.Errorf("fatal storage error during commit: %v", r)
+			err = fmt.Errorf("fatal internal error: %v", r)
+		}
+	}()
+	return tx.engine.tree.Apply(tx.ops)
+}
+
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.ops = nil
+	tx.writes = nil
+	return nil
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"go.store/internal/engine"
+)
+
+func msetCommand(sess *Session, parts []string) Response {
+	if sess.database == nil {
+		return Err(NoDB)
+	}
+
+	if len(parts) < 3 || len(parts)%2 == 0 {
+		return Usage("MSET <key> <val> [<key> <val> ...]")
+	}
+
+	return multiCommand(sess, func(b *engine.WriteBatch) {
+		for i := 1; i < len(parts); i += 2 {
+			b.Set(parts[i], []byte(parts[i+1]))
+		}
+	})
+}
+
+func mdelCommand(sess *Session, parts []string) Response {
+	if sess.database == nil {
+		return Err(NoDB)
+	}
+
+	if len(parts) < 2 {
+		return Usage("MDEL <key> [<key> ...]")
+	}
+
+	return multiCommand(sess, func(b *engine.WriteBatch) {
+		for _, key := range parts[1:] {
+			b.Delete(key)
+		}
+	})
+}
+
+// Shared by MSET and MDEL, the writes join the open batch or are applied
+// together as a batch of their own
+func multiCommand(sess *Session, add func(*engine.WriteBatch)) Response {
+	if sess.user.IsGuest() {
+		return Err(NoPerm)
+	}
+
+	if sess.tx != nil {
+		return Err(TxActive)
+	}
+
+	if sess.batch != nil {
+		add(sess.batch)
+		return Respond(Queued)
+	}
+
+	b := sess.database.NewWriteBatch()
+	add(b)
+	return writeBatch(b)
+}
+
+// Writes after BATCH are queued until END applies them together
+func batchCommand(sess *Session, parts []string) Response {
+	if sess.database == nil {
+		return Err(NoDB)
+	}
+
+	if len(parts) != 1 {
+		return Usage("BATCH")
+	}
+
+	if sess.user.IsGuest() {
+		return Err(NoPerm)
+	}
+
+	if sess.tx != nil {
+		return Err(TxActive)
+	}
+
+	if sess.batch != nil {
+		return Err(BatchActive)
+	}
+
+	sess.batch = sess.database.NewWriteBatch()
+	return Respond(OK)
+}
+
+func endCommand(sess *Session, parts []string) Response {
+	if len(parts) != 1 {
+		return Usage("END")
+	}
+
+	if sess.batch == nil {
+		return Err(NoBatch)
+	}
+
+	b := sess.batch
+	sess.batch = nil
+
+	return writeBatch(b)
+}
+
+// One line per write in the order they were made, OK or why it was skipped,
+// then END and how many were applied
+func writeBatch(b *engine.WriteBatch) Response {
+	results, err := b.Write()
+	if err != nil {
+		return Err(Msg(err.Error()))
+	}
+
+	var out strings.Builder
+	applied := 0
+	for _, err := range results {
+		if err != nil {
+			fmt.Fprintf(&out, "ERR: %s\n", err)
+			continue
+		}
+		fmt.Fprintf(&out, "%s\n", OK)
+		applied++
+	}
+	fmt.Fprintf(&out, "%s %d", EndMarker, applied)
+
+	return Respond(Msg(out.String()))
+}
@@ -0,0 +1,65 @@
+package server
+
+import "testing"
+
+func TestMultiWrites(t *testing.T) {
+	s, sess := openTestSession(t, "test_multi")
+
+	expectReplies(t, s, sess, [][2]string{
+		{"MSET a 1 b 2 c 3", lines("OK", "OK", "OK", "END 3")},
+		{"GET b", "b: 2"},
+		{"MSET a", "ERR Usage: MSET <key> <val> [<key> <val> ...]"},
+
+		// A key that isn't there is reported in its own line and the rest still go
+		{"MDEL a missing c", lines("OK", "ERR: Key does not exist: key not found", "OK", "END 2")},
+		{"GET a", "ERR: Key not found"},
+		{"GET b", "b: 2"},
+		{"DEL missing", "ERR: Key does not exist: key not found"},
+		{"MDEL", "ERR Usage: MDEL <key> [<key> ...]"},
+	})
+}
+
+func TestBatch(t *testing.T) {
+	s, sess := openTestSession(t, "test_batch")
+
+	expectReplies(t, s, sess, [][2]string{
+		{"SET exists old", "OK"},
+		{"END", "ERR: No batch in progress"},
+
+		{"BATCH", "OK"},
+		{"BATCH", "ERR: Batch already in progress"},
+		{"BEGIN", "ERR: Batch already in progress"},
+		{"SET zebra 1", "QUEUED"},
+		{"SETNX exists 2", "QUEUED"},
+		{"MSET apple 3 exists 4", "QUEUED"},
+		{"SETXX missing 5", "QUEUED"},
+		{"MDEL zebra missing", "QUEUED"},
+		{"DEL missing", "QUEUED"},
+		// Nothing is written until END
+		{"GET zebra", "ERR: Key not found"},
+
+		// One line per write in the order they were queued
+		{"END", lines(
+			"OK",
+			"ERR: key already exists",
+			"OK",
+			"OK",
+			"ERR: key not found",
+			"OK",
+			"ERR: Key does not exist: key not found",
+			"ERR: Key does not exist: key not found",
+			"END 4",
+		)},
+		{"GET zebra", "ERR: Key not found"},
+		{"GET apple", "apple: 3"},
+		{"GET exists", "exists: 4"},
+		{"END", "ERR: No batch in progress"},
+
+		// Batches and transactions don't mix
+		{"BEGIN", "OK"},
+		{"BATCH", "ERR: Transaction already in progress"},
+		{"MSET a 1", "ERR: Transaction already in progress"},
+		{"DEL missing", "ERR: Key does not exist: key not found"},
+		{"ROLLBACK", "OK"},
+	})
+}
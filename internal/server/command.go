@@ -2,8 +2,7 @@ package server
 
 import (
 	"fmt"
-
-	"go.store/internal/engine"
+	"path/filepath"
 )
 
 type Msg string
@@ -22,6 +21,15 @@ const (
 	NoPerm     Msg = "Permission denied"
 	NoDB       Msg = "No DB currently open"
 	OpenFailed Msg = "Failed to open Database"
+	NoTx       Msg = "No transaction in progress"
+	TxActive   Msg = "Transaction already in progress"
+
+	Queued      Msg = "QUEUED"
+	NoBatch     Msg = "No batch in progress"
+	BatchActive Msg = "Batch already in progress"
+
+	NoBackupDir   Msg = "No backup_dir configured"
+	BadBackupPath Msg = "Backup path must be relative and stay inside backup_dir"
 )
 
 func Usage(expected string) Response {
@@ -70,8 +78,7 @@ func (s *Server) openDBCommand(sess *Session, parts []string) Response {
 
 	sess.CloseDB()
 
-	// Later we will have a dedicated data dir
-	db, err := engine.Open(dbname, s.cfg)
+	db, err := s.dbs.acquire(dbname, s.cfg)
 	if err != nil {
 		return Err(OpenFailed)
 	}
@@ -94,18 +101,47 @@ func setCommand(sess *Session, parts []string) Response {
 		return Err(NoDB)
 	}
 
+	return putCommand(sess, parts, "SET <key> <val>", sess.writer().Set)
+}
+
+func setNXCommand(sess *Session, parts []string) Response {
+	if sess.database == nil {
+		return Err(NoDB)
+	}
+
+	return putCommand(sess, parts, "SETNX <key> <val>", sess.writer().SetNX)
+}
+
+func setXXCommand(sess *Session, parts []string) Response {
+	if sess.database == nil {
+		return Err(NoDB)
+	}
+
+	return putCommand(sess, parts, "SETXX <key> <val>", sess.writer().SetXX)
+}
+
+// Shared by the SET variants which only differ in how they treat existing keys
+func putCommand(sess *Session, parts []string, usage string, put func(string, []byte) error) Response {
 	if len(parts) != 3 {
-		return Usage("SET <key> <val>")
+		return Usage(usage)
 	}
 
 	if sess.user.IsGuest() {
 		return Err(NoPerm)
 	}
 
-	if err := sess.database.Set(parts[1], []byte(parts[2])); err != nil {
+	if err := put(parts[1], []byte(parts[2])); err != nil {
 		return Err(Msg(err.Error()))
 	}
 
+	return written(sess)
+}
+
+// Writes inside a batch are only queued until END
+func written(sess *Session) Response {
+	if sess.batch != nil {
+		return Respond(Queued)
+	}
 	return Respond(OK)
 }
 
@@ -118,7 +154,7 @@ func getCommand(sess *Session, parts []string) Response {
 		return Usage("GET <key>")
 	}
 
-	val, err := sess.database.Get(parts[1])
+	val, err := sess.store().Get(parts[1])
 	if err != nil {
 		return Err(Msg(err.Error()))
 	}
@@ -135,9 +171,125 @@ func delCommand(sess *Session, parts []string) Response {
 		return Usage("DEL <key>")
 	}
 
-	if err := sess.database.Delete(parts[1]); err != nil {
+	if err := sess.writer().Delete(parts[1]); err != nil {
+		return Err(Msg(err.Error()))
+	}
+
+	return written(sess)
+}
+
+func beginCommand(sess *Session, parts []string) Response {
+	if sess.database == nil {
+		return Err(NoDB)
+	}
+
+	if len(parts) != 1 {
+		return Usage("BEGIN")
+	}
+
+	if sess.tx != nil {
+		return Err(TxActive)
+	}
+
+	if sess.batch != nil {
+		return Err(BatchActive)
+	}
+
+	sess.tx = sess.database.Begin()
+	return Respond(OK)
+}
+
+func commitCommand(sess *Session, parts []string) Response {
+	if len(parts) != 1 {
+		return Usage("COMMIT")
+	}
+
+	if sess.tx == nil {
+		return Err(NoTx)
+	}
+
+	tx := sess.tx
+	sess.tx = nil
+
+	if err := tx.Commit(); err != nil {
+		return Err(Msg(err.Error()))
+	}
+
+	return Respond(OK)
+}
+
+func rollbackCommand(sess *Session, parts []string) Response {
+	if len(parts) != 1 {
+		return Usage("ROLLBACK")
+	}
+
+	if sess.tx == nil {
+		return Err(NoTx)
+	}
+
+	tx := sess.tx
+	sess.tx = nil
+
+	if err := tx.Rollback(); err != nil {
 		return Err(Msg(err.Error()))
 	}
 
 	return Respond(OK)
 }
+
+// Shrinks the open database while the server keeps running, writes wait until it is done
+func vacuumCommand(sess *Session, parts []string) Response {
+	if sess.database == nil {
+		return Err(NoDB)
+	}
+
+	if len(parts) != 1 {
+		return Usage("VACUUM")
+	}
+
+	if sess.user.IsGuest() {
+		return Err(NoPerm)
+	}
+
+	if sess.tx != nil {
+		return Err(TxActive)
+	}
+
+	stats, err := sess.database.Vacuum()
+	if err != nil {
+		return Err(Msg(err.Error()))
+	}
+
+	return Respond(Msg(fmt.Sprintf("OK %d -> %d pages", stats.PagesBefore, stats.PagesAfter)))
+}
+
+// Writes a verified copy of the open database to a file on the server, reads
+// and writes carry on while it is taken. The path is taken inside backup_dir
+// so clients can't have the server create files anywhere else
+func (s *Server) backupCommand(sess *Session, parts []string) Response {
+	if sess.database == nil {
+		return Err(NoDB)
+	}
+
+	if len(parts) != 2 {
+		return Usage("BACKUP <path>")
+	}
+
+	if sess.user.IsGuest() {
+		return Err(NoPerm)
+	}
+
+	if s.cfg.BackupDir == "" {
+		return Err(NoBackupDir)
+	}
+	if !filepath.IsLocal(parts[1]) {
+		return Err(BadBackupPath)
+	}
+
+	stats, err := sess.database.BackupFile(filepath.Join(s.cfg.BackupDir, parts[1]))
+	if err != nil {
+		return Err(Msg(err.Error()))
+	}
+
+	return Respond(Msg(fmt.Sprintf("OK %d pages lsn %d crc32 %08x", stats.Pages, stats.LSN, stats.Checksum)))
+}
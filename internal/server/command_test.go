@@ -0,0 +1,46 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.store/internal/auth"
+)
+
+// BACKUP only ever writes inside backup_dir
+func TestBackupPath(t *testing.T) {
+	s, sess := openTestSession(t, "test_backup_path")
+	outside := filepath.Join(t.TempDir(), "outside.db")
+
+	for _, path := range []string{
+		"../outside.db",
+		"nested/../../outside.db",
+		"..",
+		outside,
+		"/etc/cron.d/gostore",
+	} {
+		if resp := s.exec(sess, "BACKUP "+path); resp.Msg != "ERR: "+BadBackupPath {
+			t.Fatalf("BACKUP %s: expected it to be refused, got %s", path, resp.Msg)
+		}
+	}
+	if _, err := os.Stat(outside); !os.IsNotExist(err) {
+		t.Fatalf("Expected nothing written outside backup_dir, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.cfg.BackupDir, "..", "outside.db")); !os.IsNotExist(err) {
+		t.Fatalf("Expected nothing written next to backup_dir, got %v", err)
+	}
+
+	if resp := s.exec(sess, "BACKUP today.db"); !strings.HasPrefix(string(resp.Msg), "OK ") {
+		t.Fatalf("BACKUP today.db: %s", resp.Msg)
+	}
+	if _, err := os.Stat(filepath.Join(s.cfg.BackupDir, "today.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	sess.user.Role = auth.RoleGuest
+	if resp := s.exec(sess, "BACKUP guest.db"); resp.Msg != "ERR: "+NoPerm {
+		t.Fatalf("Expected a guest to be refused, got %s", resp.Msg)
+	}
+}
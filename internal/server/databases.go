@@ -0,0 +1,61 @@
+package server
+
+import (
+	"sync"
+
+	"go.store/internal/config"
+	"go.store/internal/engine"
+)
+
+// Sessions that open the same database share one engine, so their reads and
+// writes meet in one page cache and WAL and run side by side under the tree's
+// page latches. The database is closed once the last session lets go of it
+
+type openDatabases struct {
+	mu  sync.Mutex
+	dbs map[string]*sharedDB
+}
+
+type sharedDB struct {
+	db   *engine.Database
+	refs int
+}
+
+func (o *openDatabases) acquire(dbname string, cfg *config.Config) (*engine.Database, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if shared, ok := o.dbs[dbname]; ok {
+		shared.refs++
+		return shared.db, nil
+	}
+
+	db, err := engine.Open(dbname, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.dbs == nil {
+		o.dbs = make(map[string]*sharedDB)
+	}
+	o.dbs[dbname] = &sharedDB{db: db, refs: 1}
+	return db, nil
+}
+
+func (o *openDatabases) release(dbname string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	shared, ok := o.dbs[dbname]
+	if !ok {
+		return nil
+	}
+
+	shared.refs--
+	if shared.refs > 0 {
+		return nil
+	}
+
+	delete(o.dbs, dbname)
+	return shared.db.Close()
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Run with -race. Sessions on the same database share one engine, each writes
+// its own keys while reading what the others wrote, and every write is seen
+// by every session as soon as it is acknowledged
+func TestSessionsShareDatabase(t *testing.T) {
+	const dbname = "test_shared"
+	s := newTestServer(t, dbname)
+
+	sessions := make([]*Session, 8)
+	for i := range sessions {
+		sessions[i] = openSession(t, s, dbname)
+		if sessions[i].database != sessions[0].database {
+			t.Fatalf("Session %d opened a database of its own", i)
+		}
+	}
+	if refs := s.dbs.dbs[dbname].refs; refs != len(sessions) {
+		t.Fatalf("Expected %d sessions holding the database, got %d", len(sessions), refs)
+	}
+
+	var wg sync.WaitGroup
+	for w, sess := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			other := sessions[(w+1)%len(sessions)]
+			for i := 0; i < 200; i++ {
+				k := fmt.Sprintf("s%d-%04d", w, i)
+				if resp := s.exec(sess, fmt.Sprintf("SET %s v%s", k, k)); resp.Msg != OK {
+					t.Errorf("SET %s: %s", k, resp.Msg)
+					return
+				}
+				if resp := s.exec(other, "GET "+k); string(resp.Msg) != fmt.Sprintf("%s: v%s", k, k) {
+					t.Errorf("GET %s from another session: %s", k, resp.Msg)
+					return
+				}
+				if i%20 == 0 {
+					want := lines("OK", "OK", "END 2")
+					if resp := s.exec(sess, fmt.Sprintf("MSET m%d-%04d a m%d-%04d b", w, i, w, i+1)); string(resp.Msg) != want {
+						t.Errorf("MSET: %s", resp.Msg)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Closing all but one leaves the database open for the last
+	for _, sess := range sessions[1:] {
+		sess.CloseDB()
+	}
+	if resp := s.exec(sessions[0], "GET s7-0199"); resp.Msg != "s7-0199: vs7-0199" {
+		t.Fatalf("GET after other sessions closed: %s", resp.Msg)
+	}
+
+	sessions[0].CloseDB()
+	if len(s.dbs.dbs) != 0 {
+		t.Fatalf("Expected the database to be closed with its last session, got %v", s.dbs.dbs)
+	}
+
+	// Everything reached the file
+	sess := openSession(t, s, dbname)
+	for w := range sessions {
+		keys, _ := scanReply(t, s.exec(sess, fmt.Sprintf("PREFIX s%d-", w)))
+		if len(keys) != 200 {
+			t.Fatalf("Expected 200 keys from session %d after reopening, got %d", w, len(keys))
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.store/internal/auth"
+	"go.store/internal/config"
+	"go.store/internal/storage"
+)
+
+// A session with a fresh database open, as a user that may write to it
+func openTestSession(t *testing.T, dbname string) (*Server, *Session) {
+	t.Helper()
+
+	s := newTestServer(t, dbname)
+	return s, openSession(t, s, dbname)
+}
+
+// A server whose home holds a fresh database called dbname
+func newTestServer(t *testing.T, dbname string) *Server {
+	t.Helper()
+
+	home := t.TempDir()
+	cfg := &config.Config{
+		Home:       home,
+		DataDir:    filepath.Join(home, "data"),
+		LogDir:     filepath.Join(home, "log"),
+		BackupDir:  filepath.Join(home, "backup"),
+		Durability: "none",
+	}
+
+	dbDir := filepath.Join(cfg.DataDir, dbname)
+	for _, dir := range []string{dbDir, cfg.LogDir, cfg.BackupDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := storage.CreateDatabase(filepath.Join(dbDir, dbname+".db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	return &Server{cfg: cfg}
+}
+
+// Start another session on s and open dbname in it
+func openSession(t *testing.T, s *Server, dbname string) *Session {
+	t.Helper()
+
+	sess := s.newSession()
+	sess.user = &auth.User{Username: "test", Role: auth.RoleUser, AccessDB: []string{dbname}}
+	if resp := s.exec(sess, "OPEN "+dbname); resp.Msg != OK {
+		t.Fatalf("OPEN %s: %s", dbname, resp.Msg)
+	}
+	t.Cleanup(sess.CloseDB)
+	return sess
+}
+
+// Run each line in turn and check it got the reply expected, replies of more
+// than one line are written with \n
+func expectReplies(t *testing.T, s *Server, sess *Session, steps [][2]string) {
+	t.Helper()
+
+	for _, step := range steps {
+		if got := s.exec(sess, step[0]); string(got.Msg) != step[1] {
+			t.Fatalf("%s: expected\n%s\ngot\n%s", step[0], step[1], got.Msg)
+		}
+	}
+}
+
+func lines(l ...string) string {
+	return strings.Join(l, "\n")
+}
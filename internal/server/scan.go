@@ -0,0 +1,207 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.store/internal/engine"
+)
+
+// SCAN, RANGE and PREFIX reply with one "key: value" line per pair followed by
+// "END <cursor>". Passing the cursor to SCAN continues where the reply stopped,
+// a cursor of 0 starts a full scan and is returned once there is nothing left
+
+const (
+	EndMarker   = "END"
+	StartCursor = "0"
+
+	defaultScanCount = 10
+	maxScanCount     = 1000
+)
+
+// Everything needed to resume a scan, encoded into the opaque cursor string
+type scanCursor struct {
+	next  string // forward: next key to return, reverse: exclusive upper key
+	bound string // forward: exclusive end, reverse: inclusive start
+	rev   bool
+}
+
+func (c scanCursor) encode() string {
+	buf := make([]byte, 1, 1+binary.MaxVarintLen64+len(c.next)+len(c.bound))
+	if c.rev {
+		buf[0] = 1
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(len(c.next)))
+	buf = append(buf, c.next...)
+	buf = append(buf, c.bound...)
+
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func decodeScanCursor(s string) (scanCursor, error) {
+	if s == StartCursor {
+		return scanCursor{}, nil
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) < 2 {
+		return scanCursor{}, fmt.Errorf("invalid cursor")
+	}
+
+	n, read := binary.Uvarint(buf[1:])
+	if read <= 0 || uint64(len(buf)-1-read) < n {
+		return scanCursor{}, fmt.Errorf("invalid cursor")
+	}
+
+	body := buf[1+read:]
+	return scanCursor{
+		next:  string(body[:n]),
+		bound: string(body[n:]),
+		rev:   buf[0] == 1,
+	}, nil
+}
+
+// Fetch up to count pairs from the cursor position and format the reply
+func runScan(db *engine.Database, c scanCursor, count int) Response {
+	// Ask for one extra pair so we know where the next page starts
+	var kvs []engine.KV
+	var err error
+	if c.rev {
+		kvs, err = db.ReverseScan(c.bound, c.next, count+1)
+	} else {
+		kvs, err = db.Scan(c.next, c.bound, count+1)
+	}
+	if err != nil {
+		return Err(Msg(err.Error()))
+	}
+
+	cursor := StartCursor
+	if len(kvs) > count {
+		if c.rev {
+			c.next = kvs[count-1].Key
+		} else {
+			c.next = kvs[count].Key
+		}
+		cursor = c.encode()
+		kvs = kvs[:count]
+	}
+
+	var b strings.Builder
+	for _, kv := range kvs {
+		fmt.Fprintf(&b, "%s: %s\n", kv.Key, kv.Value)
+	}
+	fmt.Fprintf(&b, "%s %s", EndMarker, cursor)
+
+	return Respond(Msg(b.String()))
+}
+
+// Parse an optional trailing "<name> n" option, returning def if it is absent
+func parseCount(parts []string, name string, def int) (int, []string, bool) {
+	for i := 0; i < len(parts)-1; i++ {
+		if !strings.EqualFold(parts[i], name) {
+			continue
+		}
+
+		n, err := strconv.Atoi(parts[i+1])
+		if err != nil || n <= 0 {
+			return 0, nil, false
+		}
+
+		rest := append(append([]string(nil), parts[:i]...), parts[i+2:]...)
+		return min(n, maxScanCount), rest, true
+	}
+
+	return def, parts, true
+}
+
+// Parse an optional flag such as REV, returning the remaining parts
+func parseFlag(parts []string, name string) (bool, []string) {
+	for i, p := range parts {
+		if strings.EqualFold(p, name) {
+			return true, append(append([]string(nil), parts[:i]...), parts[i+1:]...)
+		}
+	}
+	return false, parts
+}
+
+func scanCommand(sess *Session, parts []string) Response {
+	if sess.database == nil {
+		return Err(NoDB)
+	}
+
+	usage := "SCAN <cursor> [COUNT n]"
+
+	count, rest, ok := parseCount(parts, "COUNT", defaultScanCount)
+	if !ok || len(rest) != 2 {
+		return Usage(usage)
+	}
+
+	c, err := decodeScanCursor(rest[1])
+	if err != nil {
+		return Err(Msg(err.Error()))
+	}
+
+	return runScan(sess.database, c, count)
+}
+
+func rangeCommand(sess *Session, parts []string) Response {
+	if sess.database == nil {
+		return Err(NoDB)
+	}
+
+	usage := "RANGE <start> <end> [LIMIT n] [REV]"
+
+	count, rest, ok := parseCount(parts, "LIMIT", maxScanCount)
+	if !ok {
+		return Usage(usage)
+	}
+
+	rev, rest := parseFlag(rest, "REV")
+	if len(rest) != 3 {
+		return Usage(usage)
+	}
+
+	start, end := rest[1], rest[2]
+	if start >= end {
+		return Respond(Msg(EndMarker + " " + StartCursor))
+	}
+
+	c := scanCursor{next: start, bound: end}
+	if rev {
+		c = scanCursor{next: end, bound: start, rev: true}
+	}
+
+	return runScan(sess.database, c, count)
+}
+
+func prefixCommand(sess *Session, parts []string) Response {
+	if sess.database == nil {
+		return Err(NoDB)
+	}
+
+	usage := "PREFIX <prefix> [LIMIT n]"
+
+	count, rest, ok := parseCount(parts, "LIMIT", maxScanCount)
+	if !ok || len(rest) != 2 {
+		return Usage(usage)
+	}
+
+	prefix := rest[1]
+	return runScan(sess.database, scanCursor{next: prefix, bound: prefixEnd(prefix)}, count)
+}
+
+// The smallest key greater than every key starting with prefix, empty if unbounded
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
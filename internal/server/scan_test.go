@@ -0,0 +1,141 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestScanCursorRoundTrip(t *testing.T) {
+	cursors := []scanCursor{
+		{next: "a", bound: ""},
+		{next: "tenant:1:order:9", bound: "tenant:2", rev: true},
+		{next: "", bound: "z"},
+	}
+
+	for _, c := range cursors {
+		got, err := decodeScanCursor(c.encode())
+		if err != nil {
+			t.Fatalf("decode %+v: %v", c, err)
+		}
+		if got != c {
+			t.Fatalf("Expected %+v got %+v", c, got)
+		}
+	}
+
+	if _, err := decodeScanCursor("not a cursor!"); err == nil {
+		t.Fatalf("Expected invalid cursor to be rejected")
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[string]string{
+		"abc":      "abd",
+		"ab\xff":   "ac",
+		"\xff\xff": "",
+	}
+
+	for prefix, want := range cases {
+		if got := prefixEnd(prefix); got != want {
+			t.Fatalf("prefixEnd(%q): expected %q got %q", prefix, want, got)
+		}
+	}
+}
+
+// Split a reply into its keys and the cursor after END
+func scanReply(t *testing.T, resp Response) ([]string, string) {
+	t.Helper()
+
+	rows := strings.Split(string(resp.Msg), "\n")
+	last := rows[len(rows)-1]
+	cursor, ok := strings.CutPrefix(last, EndMarker+" ")
+	if !ok {
+		t.Fatalf("Expected the reply to finish with %s, got %q", EndMarker, resp.Msg)
+	}
+
+	var keys []string
+	for _, row := range rows[:len(rows)-1] {
+		key, val, ok := strings.Cut(row, ": ")
+		if !ok || val != "v"+key {
+			t.Fatalf("Unexpected line %q", row)
+		}
+		keys = append(keys, key)
+	}
+	return keys, cursor
+}
+
+func TestScanPages(t *testing.T) {
+	s, sess := openTestSession(t, "test_scan")
+
+	var want []string
+	for i := 0; i < 25; i++ {
+		k := fmt.Sprintf("k%02d", i)
+		if resp := s.exec(sess, fmt.Sprintf("SET %s v%s", k, k)); resp.Msg != OK {
+			t.Fatalf("SET %s: %s", k, resp.Msg)
+		}
+		want = append(want, k)
+	}
+	s.exec(sess, "SET other vother")
+
+	// Pages of the default size pick up exactly where the one before stopped
+	var got []string
+	cursor := StartCursor
+	for page := 0; ; page++ {
+		keys, next := scanReply(t, s.exec(sess, "SCAN "+cursor))
+		if len(keys) != defaultScanCount && next != StartCursor {
+			t.Fatalf("Page %d: expected %d keys before the end, got %d", page, defaultScanCount, len(keys))
+		}
+		got = append(got, keys...)
+		if next == StartCursor {
+			break
+		}
+		cursor = next
+	}
+	if strings.Join(got, " ") != strings.Join(append(want, "other"), " ") {
+		t.Fatalf("Expected every key once in order, got %v", got)
+	}
+
+	tests := []struct {
+		cmd  string
+		want []string
+		more bool
+	}{
+		{cmd: "SCAN 0 COUNT 26", want: append(want, "other")},
+		{cmd: "RANGE k05 k20 LIMIT 4", want: want[5:9], more: true},
+		{cmd: "RANGE k05 k20 LIMIT 4 REV", want: []string{"k19", "k18", "k17", "k16"}, more: true},
+		{cmd: "RANGE k20 k05", want: nil},
+		{cmd: "PREFIX k1", want: want[10:20]},
+		{cmd: "PREFIX k1 LIMIT 3", want: want[10:13], more: true},
+	}
+
+	for _, tt := range tests {
+		keys, next := scanReply(t, s.exec(sess, tt.cmd))
+		if strings.Join(keys, " ") != strings.Join(tt.want, " ") {
+			t.Fatalf("%s: expected %v, got %v", tt.cmd, tt.want, keys)
+		}
+		if (next != StartCursor) != tt.more {
+			t.Fatalf("%s: expected more to follow: %v, got cursor %q", tt.cmd, tt.more, next)
+		}
+	}
+
+	// The cursor from a limited reply carries its bounds along
+	keys, next := scanReply(t, s.exec(sess, "PREFIX k1 LIMIT 3"))
+	for next != StartCursor {
+		var page []string
+		page, next = scanReply(t, s.exec(sess, "SCAN "+next+" COUNT 3"))
+		keys = append(keys, page...)
+	}
+	if strings.Join(keys, " ") != strings.Join(want[10:20], " ") {
+		t.Fatalf("Expected the prefix across pages, got %v", keys)
+	}
+
+	keys, next = scanReply(t, s.exec(sess, "RANGE k05 k20 LIMIT 4 REV"))
+	for next != StartCursor {
+		var page []string
+		page, next = scanReply(t, s.exec(sess, "SCAN "+next+" COUNT 4"))
+		keys = append(keys, page...)
+	}
+	if len(keys) != 15 || keys[0] != "k19" || keys[14] != "k05" {
+		t.Fatalf("Expected k19 down to k05, got %v", keys)
+	}
+}
@@ -19,6 +19,7 @@ type Server struct {
 	auth     *auth.Authenticator
 	ln       net.Listener
 	shutdown chan struct{}
+	dbs      openDatabases
 }
 
 func New(cfg *config.Config) (*Server, error) {
@@ -99,7 +100,10 @@ func (s *Server) Listen() error {
 }
 
 func (s *Server) handleConn(conn net.Conn) {
-	sess := &Session{}
+	sess := s.newSession()
+	// A client that drops the connection still lets go of its database
+	defer sess.CloseDB()
+
 	reader := bufio.NewScanner(conn)
 
 	conn.Write([]byte(Prompt))
@@ -127,6 +131,10 @@ func (s *Server) handleConn(conn net.Conn) {
 	}
 }
 
+func (s *Server) newSession() *Session {
+	return &Session{dbs: &s.dbs}
+}
+
 func (s *Server) exec(sess *Session, line string) Response {
 	parts := strings.Fields(line)
 	if len(parts) == 0 {
@@ -140,10 +148,38 @@ func (s *Server) exec(sess *Session, line string) Response {
 		return s.openDBCommand(sess, parts)
 	case "SET":
 		return setCommand(sess, parts)
+	case "SETNX":
+		return setNXCommand(sess, parts)
+	case "SETXX":
+		return setXXCommand(sess, parts)
 	case "GET":
 		return getCommand(sess, parts)
 	case "DEL":
 		return delCommand(sess, parts)
+	case "MSET":
+		return msetCommand(sess, parts)
+	case "MDEL":
+		return mdelCommand(sess, parts)
+	case "SCAN":
+		return scanCommand(sess, parts)
+	case "RANGE":
+		return rangeCommand(sess, parts)
+	case "PREFIX":
+		return prefixCommand(sess, parts)
+	case "BEGIN":
+		return beginCommand(sess, parts)
+	case "COMMIT":
+		return commitCommand(sess, parts)
+	case "ROLLBACK":
+		return rollbackCommand(sess, parts)
+	case "BATCH":
+		return batchCommand(sess, parts)
+	case "END":
+		return endCommand(sess, parts)
+	case "VACUUM":
+		return vacuumCommand(sess, parts)
+	case "BACKUP":
+		return s.backupCommand(sess, parts)
 	case "CLOSE":
 		sess.CloseDB()
 		return Respond(OK)
@@ -6,9 +6,67 @@ import (
 )
 
 type Session struct {
+	dbs      *openDatabases
 	user     *auth.User
 	database *engine.Database
 	dbName   string
+	tx       *engine.Tx
+	batch    *engine.WriteBatch
+}
+
+// Writes shared by a database, a transaction and a batch
+type writer interface {
+	Set(key string, val []byte) error
+	SetNX(key string, val []byte) error
+	SetXX(key string, val []byte) error
+	Delete(key string) error
+}
+
+// Key / value operations shared by a database and a transaction
+type store interface {
+	writer
+	Get(key string) ([]byte, error)
+}
+
+// Commands run against the open transaction when there is one
+func (s *Session) store() store {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.database
+}
+
+// Writes are queued on the open batch when there is one
+func (s *Session) writer() writer {
+	if s.batch != nil {
+		return batchWriter{s.batch}
+	}
+	return s.store()
+}
+
+// A batch only reports errors once it is written, queueing a write never fails
+type batchWriter struct {
+	*engine.WriteBatch
+}
+
+func (w batchWriter) Set(key string, val []byte) error {
+	w.WriteBatch.Set(key, val)
+	return nil
+}
+
+func (w batchWriter) SetNX(key string, val []byte) error {
+	w.WriteBatch.SetNX(key, val)
+	return nil
+}
+
+func (w batchWriter) SetXX(key string, val []byte) error {
+	w.WriteBatch.SetXX(key, val)
+	return nil
+}
+
+func (w batchWriter) Delete(key string) error {
+	w.WriteBatch.Delete(key)
+	return nil
 }
 
 func (s *Session) IsAuth() bool {
@@ -16,8 +74,15 @@ func (s *Session) IsAuth() bool {
 }
 
 func (s *Session) CloseDB() {
+	s.batch = nil
+
+	if s.tx != nil {
+		_ = s.tx.Rollback()
+		s.tx = nil
+	}
+
 	if s.database != nil {
-		_ = s.database.Close()
+		_ = s.dbs.release(s.dbName)
 		s.database = nil
 		s.dbName = ""
 	}
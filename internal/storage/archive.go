@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.store/internal/logger"
+)
+
+// With archiving on every log is copied to the archive directory before a
+// checkpoint resets it, so the archive holds every frame since the database was
+// created or archiving was turned on. A log is archived as a segment named after
+// the database ID and the LSNs it covers, <id>-<start>-<end>.wal holds frames
+// start+1 up to end.
+//
+// A backup records the LSN of the last frame it holds in its meta page. Restore
+// copies the backup and replays the frames after it from the archive, stopping
+// at an LSN or before the first frame that committed after a point in time.
+// Each segment starts where the one before it ended so a missing segment is
+// found rather than skipped over
+
+type ArchivedSegment struct {
+	Path       string
+	Start, End uint64
+}
+
+func segmentName(id DatabaseID, start, end uint64) string {
+	return fmt.Sprintf("%x-%016x-%016x.wal", id[:], start, end)
+}
+
+// Copy the log to the archive, called with no records being appended
+func (wal *WAL) archive() error {
+	if wal.archiveDir == "" || wal.stale || wal.size <= walHeaderSize {
+		return nil
+	}
+
+	if err := os.MkdirAll(wal.archiveDir, 0o755); err != nil {
+		return fmt.Errorf("Archive: %s", err)
+	}
+
+	// A log replayed after a crash may have been archived already, it is copied again as it was
+	path := filepath.Join(wal.archiveDir, segmentName(wal.dbID, wal.startLSN, wal.lastLSN))
+	tmp := path + ".tmp"
+	if err := copyDBFile(wal.filePath, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Archive: %s", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("Archive: %s", err)
+	}
+	if err := syncDir(wal.archiveDir); err != nil {
+		return fmt.Errorf("Archive: %s", err)
+	}
+
+	wal.log.Infof("archive: LSNs %d to %d copied to %s", wal.startLSN+1, wal.lastLSN, path)
+	return nil
+}
+
+// ArchivedSegments lists the segments of database id in dir ordered by LSN
+func ArchivedSegments(dir string, id DatabaseID) ([]ArchivedSegment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Archive: %s", err)
+	}
+
+	prefix := fmt.Sprintf("%x-", id[:])
+	var segments []ArchivedSegment
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".wal") {
+			continue
+		}
+
+		lsns := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".wal"), "-")
+		if len(lsns) != 2 {
+			continue
+		}
+		start, sErr := strconv.ParseUint(lsns[0], 16, 64)
+		end, eErr := strconv.ParseUint(lsns[1], 16, 64)
+		if sErr != nil || eErr != nil {
+			continue
+		}
+
+		segments = append(segments, ArchivedSegment{Path: filepath.Join(dir, name), Start: start, End: end})
+	}
+
+	slices.SortFunc(segments, func(a, b ArchivedSegment) int {
+		return cmp.Or(cmp.Compare(a.Start, b.Start), cmp.Compare(a.End, b.End))
+	})
+	return segments, nil
+}
+
+// Where a restore stops replaying the archive, the zero value replays all of it
+type RecoveryTarget struct {
+	// The last frame to replay
+	LSN uint64
+	// Frames that committed after this are left out
+	Time time.Time
+}
+
+// ParseRecoveryTarget reads an LSN, an RFC 3339 time or latest
+func ParseRecoveryTarget(s string) (RecoveryTarget, error) {
+	if s == "latest" {
+		return RecoveryTarget{}, nil
+	}
+	if lsn, err := strconv.ParseUint(s, 10, 64); err == nil && lsn > 0 {
+		return RecoveryTarget{LSN: lsn}, nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return RecoveryTarget{Time: t}, nil
+		}
+	}
+	return RecoveryTarget{}, fmt.Errorf("Invalid recovery target %q, expected an LSN, a time like 2006-01-02T15:04:05Z07:00 or latest", s)
+}
+
+func (t RecoveryTarget) String() string {
+	switch {
+	case t.LSN != 0:
+		return fmt.Sprintf("LSN %d", t.LSN)
+	case !t.Time.IsZero():
+		return t.Time.Format(time.RFC3339Nano)
+	}
+	return "latest"
+}
+
+func (t RecoveryTarget) latest() bool {
+	return t.LSN == 0 && t.Time.IsZero()
+}
+
+// Whether frame comes after the point the restore stops at
+func (t RecoveryTarget) past(frame *walFrame) bool {
+	return (t.LSN != 0 && frame.lsn > t.LSN) || (!t.Time.IsZero() && frame.time.After(t.Time))
+}
+
+type RecoveryStats struct {
+	// LSN of the backup and of the last frame replayed on top of it
+	From, To uint64
+	Frames   int
+	Segments int
+	// When the last frame replayed committed
+	Time time.Time
+}
+
+// Replay the frames archived in dir after the backup open in pager, stopping at target
+func recoverArchive(pager *Pager, dir string, target RecoveryTarget, log *logger.Logger) (RecoveryStats, error) {
+	meta, err := pager.meta()
+	if err != nil {
+		return RecoveryStats{}, err
+	}
+	base, id := meta.GetLSN(), meta.GetDatabaseID()
+
+	stats := RecoveryStats{From: base, To: base}
+	if target.LSN != 0 && target.LSN < base {
+		return stats, fmt.Errorf("Restore: the backup is already at LSN %d, past %s", base, target)
+	}
+
+	segments, err := ArchivedSegments(dir, id)
+	if err != nil {
+		return stats, err
+	}
+
+	pager.replaying = true
+	defer func() {
+		pager.replaying = false
+	}()
+
+	// Every frame up to next has been read
+	next := base
+	reached := false
+
+	for _, seg := range segments {
+		if seg.End < base {
+			continue
+		}
+		if seg.Start > next {
+			return stats, fmt.Errorf("Restore: %s has no log for LSN %d, the next one starts at %d", dir, next+1, seg.Start+1)
+		}
+		if seg.Start < next && stats.Segments > 0 {
+			return stats, fmt.Errorf("Restore: %s has more than one log from LSN %d", dir, seg.Start+1)
+		}
+
+		err := readSegment(seg, pager.pageSize, id, log, func(frame *walFrame) error {
+			if frame.lsn <= base {
+				// Frames after the target time may already be in the backup
+				if !target.Time.IsZero() && frame.time.After(target.Time) {
+					return fmt.Errorf("Restore: the backup holds frame %d from %s, after %s",
+						frame.lsn, frame.time.Format(time.RFC3339Nano), target)
+				}
+				return nil
+			}
+			if target.past(frame) {
+				reached = true
+				return errStopReading
+			}
+
+			if err := pager.wal.applyFrame(frame); err != nil {
+				return err
+			}
+			stats.To, stats.Time = frame.lsn, frame.time
+			stats.Frames++
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopReading) {
+			return stats, err
+		}
+
+		stats.Segments++
+		next = seg.End
+		if reached || (target.LSN != 0 && next >= target.LSN) {
+			reached = true
+			break
+		}
+	}
+
+	// Stopping short would quietly restore less than was asked for
+	if !reached && !target.latest() {
+		return stats, fmt.Errorf("Restore: %s ends at LSN %d, before %s", dir, next, target)
+	}
+
+	// The restored file holds every frame up to To, its own log carries on from there
+	pager.wal.lastLSN = stats.To
+	return stats, nil
+}
+
+func readSegment(seg ArchivedSegment, pageSize int, id DatabaseID, log *logger.Logger, fn func(frame *walFrame) error) error {
+	f, err := os.Open(seg.Path)
+	if err != nil {
+		return fmt.Errorf("Restore: %s", err)
+	}
+	defer f.Close()
+
+	h, err := readWALHeader(f, seg.Path)
+	if err != nil {
+		return fmt.Errorf("Restore %w", err)
+	}
+	if h.dbID != id || h.pageSize != uint32(pageSize) || h.startLSN != seg.Start {
+		return fmt.Errorf("Restore %w: %s does not match its name or the backup", ErrWALMismatch, seg.Path)
+	}
+
+	_, err = readFrames(f, h.version, pageSize, log, fn)
+	return err
+}
@@ -0,0 +1,209 @@
+package storage_test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.store/internal/engine"
+	"go.store/internal/logger"
+	"go.store/internal/storage"
+)
+
+func copyModel(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// A backup is taken part way through the first log, then the writes after it
+// span a vacuum and two more checkpoints. Replaying the archive has to land on
+// exactly the state as of each point whichever way it is named
+func TestPointInTimeRestore(t *testing.T) {
+	cfg := createTestDB(t, "test_pitr")
+	cfg.Durability = "none"
+	cfg.WALArchive = t.TempDir()
+	archive := cfg.WALArchiveFor("test_pitr")
+
+	db, err := engine.Open("test_pitr", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[string]string)
+	set := func(k, v string) {
+		t.Helper()
+		if err := db.Set(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = v
+	}
+
+	for i := 0; i < 2000; i++ {
+		v := crashValue(i, 100)
+		if i%200 == 0 {
+			v = crashValue(i, 2*storage.DefaultPageSize)
+		}
+		set(fmt.Sprintf("key%05d", i), v)
+	}
+
+	backup := filepath.Join(t.TempDir(), "backup.db")
+	bstats, err := db.BackupFile(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atBackup := copyModel(want)
+
+	for i := 0; i < 2000; i++ {
+		k := fmt.Sprintf("key%05d", i)
+		if i%4 != 0 {
+			if err := db.Delete(k); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, k)
+		} else if i%8 == 0 {
+			set(k, crashValue(i+1, 300))
+		}
+	}
+	beforeVacuum := copyModel(want)
+	lsnBeforeVacuum := db.WALStats().LSN
+
+	// The vacuum checkpoints, so the log up to here is archived, and drops the end of the file
+	vstats, err := db.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vstats.PagesAfter >= vstats.PagesBefore {
+		t.Fatalf("Expected vacuum to shrink the file, got %+v", vstats)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	afterVacuum := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	// New pages go where the file used to end
+	tx := db.Begin()
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("new%05d", i)
+		tx.Set(k, []byte(crashValue(i, 200)))
+		want[k] = crashValue(i, 200)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	middle := copyModel(want)
+	lsnMiddle := db.WALStats().LSN
+
+	for i := 0; i < 2000; i += 8 {
+		set(fmt.Sprintf("key%05d", i), "last")
+	}
+	last := copyModel(want)
+
+	// Closing checkpoints and archives the rest
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := storage.ArchivedSegments(archive, databaseID(t, backup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || segments[0].Start != 0 || segments[1].Start != segments[0].End {
+		t.Fatalf("Expected two archived logs one after the other, got %+v", segments)
+	}
+
+	tests := []struct {
+		name  string
+		until storage.RecoveryTarget
+		want  map[string]string
+		pages uint32
+	}{
+		{name: "backup", until: storage.RecoveryTarget{LSN: bstats.LSN}, want: atBackup},
+		{name: "before vacuum", until: storage.RecoveryTarget{LSN: lsnBeforeVacuum}, want: beforeVacuum},
+		{name: "after vacuum", until: storage.RecoveryTarget{Time: afterVacuum}, want: beforeVacuum, pages: vstats.PagesAfter},
+		{name: "middle", until: storage.RecoveryTarget{LSN: lsnMiddle}, want: middle},
+		{name: "latest", want: last},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored, stats := restoreBackup(t, backup, "test_pitr", storage.RestoreOptions{Archive: archive, Until: tt.until})
+			verifyContents(t, restored, tt.want, tt.name)
+
+			if stats.Recovery.From != bstats.LSN {
+				t.Fatalf("Expected to replay from the backup at %d, got %+v", bstats.LSN, stats.Recovery)
+			}
+			if tt.pages != 0 && stats.Report.Pages != tt.pages {
+				t.Fatalf("Expected the vacuum to be replayed down to %d pages, got %d", tt.pages, stats.Report.Pages)
+			}
+
+			// A restored database starts a history of its own
+			if err := restored.Set("after", []byte("restore")); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	log := logger.New(io.Discard, logger.ERROR)
+	restore := func(opts storage.RestoreOptions) error {
+		dst := filepath.Join(t.TempDir(), "restored.db")
+		_, err := storage.Restore(backup, dst, opts, log)
+		if _, statErr := os.Stat(dst); err != nil && !os.IsNotExist(statErr) {
+			t.Fatalf("Expected nothing restored after %v", err)
+		}
+		return err
+	}
+
+	if err := restore(storage.RestoreOptions{Archive: archive, Until: storage.RecoveryTarget{LSN: lsnMiddle + 1000}}); err == nil {
+		t.Fatal("Expected a target past the end of the archive to fail")
+	}
+	if err := restore(storage.RestoreOptions{Archive: archive, Until: storage.RecoveryTarget{Time: time.Now().Add(-time.Hour)}}); err == nil {
+		t.Fatal("Expected a time before the backup was taken to fail")
+	}
+
+	if err := os.Remove(segments[0].Path); err != nil {
+		t.Fatal(err)
+	}
+	if err := restore(storage.RestoreOptions{Archive: archive}); err == nil {
+		t.Fatal("Expected a gap in the archive to fail")
+	}
+}
+
+func databaseID(t *testing.T, path string) storage.DatabaseID {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage.WrapMetaPage(&storage.Page{Data: data[:storage.DefaultPageSize]}).GetDatabaseID()
+}
+
+func TestParseRecoveryTarget(t *testing.T) {
+	tests := []struct {
+		in   string
+		want storage.RecoveryTarget
+	}{
+		{in: "latest", want: storage.RecoveryTarget{}},
+		{in: "42", want: storage.RecoveryTarget{LSN: 42}},
+		{in: "2026-03-01T12:30:00Z", want: storage.RecoveryTarget{Time: time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)}},
+	}
+
+	for _, tt := range tests {
+		got, err := storage.ParseRecoveryTarget(tt.in)
+		if err != nil || got.LSN != tt.want.LSN || !got.Time.Equal(tt.want.Time) {
+			t.Fatalf("%s: expected %v, got %v %v", tt.in, tt.want, got, err)
+		}
+	}
+
+	for _, in := range []string{"", "0", "yesterday", "-5"} {
+		if _, err := storage.ParseRecoveryTarget(in); err == nil {
+			t.Fatalf("Expected %q to be refused", in)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.store/internal/logger"
+)
+
+// A backup is a copy of the DB file as of the last write that committed before
+// it started, read through a snapshot so writers carry on while it is taken.
+// Unlike other snapshots a backup copies every page, free pages and the meta
+// page included, so the copy has the same page IDs and free list as the file it
+// was taken from and opens like any other database.
+//
+// Free pages only change in frames so they are versioned like the rest. The meta
+// page is also changed by checkpoints and vacuum outside a frame, it is copied
+// when the backup starts while neither can run, and vacuum leaves the file its
+// size rather than truncate pages a backup hasn't read yet. The copy records the
+// LSN of the last frame it holds so archived logs can be replayed over it
+
+type BackupStats struct {
+	PageSize int
+	Pages    uint32
+	Bytes    int64
+	// LSN of the last frame in the backup
+	LSN uint64
+	// CRC32 of everything written, every page also carries its own checksum
+	Checksum uint32
+}
+
+// Backup writes the database to w as a complete DB file
+func (bt *BTree) Backup(w io.Writer) (BackupStats, error) {
+	s, meta := bt.backupSnapshot()
+	defer s.Release()
+
+	stats := BackupStats{PageSize: bt.pager.pageSize, LSN: s.lsn}
+	crc := crc32.NewIEEE()
+	out := io.MultiWriter(w, crc)
+
+	for id := uint32(0); id < s.numPages; id++ {
+		data := meta
+		if id != 0 {
+			var err error
+			if data, err = s.rawPage(id); err != nil {
+				return stats, err
+			}
+		}
+
+		stampChecksum(data)
+		if _, err := out.Write(data); err != nil {
+			return stats, fmt.Errorf("Backup: %w", err)
+		}
+
+		stats.Pages++
+		stats.Bytes += int64(len(data))
+	}
+
+	stats.Checksum = crc.Sum32()
+	return stats, nil
+}
+
+// Take a snapshot for a backup along with a copy of the meta page as of the same frame
+func (bt *BTree) backupSnapshot() (*Snapshot, []byte) {
+	// Keeps checkpoints and vacuum away from the meta page while it is copied
+	bt.pager.write.RLock()
+	defer bt.pager.write.RUnlock()
+
+	pager := bt.pager
+	pager.mu.Lock()
+	defer pager.mu.Unlock()
+
+	s := bt.snapshotLocked()
+	s.backup = true
+	pager.versions.backups++
+
+	// A running frame may be part way through changing it
+	meta := bt.meta.Page.Data
+	if img, ok := pager.frameImages[0]; ok {
+		meta = img.data
+	}
+	meta = append([]byte(nil), meta...)
+
+	// The live file only records the LSN of its last checkpoint
+	WrapMetaPage(&Page{Data: meta}).SetLSN(s.lsn)
+	return s, meta
+}
+
+// Whether a backup is reading pages, must hold pager.mu
+func (pager *Pager) backupRunning() bool {
+	return pager.versions.backups > 0
+}
+
+// Read a private copy of a page as the snapshot sees it. Pages that aren't cached
+// are read straight from the file so a backup doesn't push everything else out
+// of the cache
+func (s *Snapshot) rawPage(id uint32) ([]byte, error) {
+	pager := s.bt.pager
+
+	pager.mu.Lock()
+	data, err := s.cachedCopy(id)
+	pager.mu.Unlock()
+	if data != nil || err != nil {
+		return data, err
+	}
+
+	data = make([]byte, pager.pageSize)
+	_, readErr := pager.file.ReadAt(data, int64(id)*int64(pager.pageSize))
+
+	// A writer may have loaded and changed the page while we read it, in which
+	// case it kept a version first. Otherwise the file holds the page as we see it
+	pager.mu.Lock()
+	p, err := s.version(id)
+	pager.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		return append([]byte(nil), p.Data...), nil
+	}
+
+	if readErr != nil {
+		return nil, fmt.Errorf("Error occured while reading page %d: %s", id, readErr)
+	}
+	if !verifyChecksum(data) {
+		return nil, &ErrCorruptPage{PageID: id}
+	}
+	return data, nil
+}
+
+// Copy the page from its version or the cache, nil if it is in neither. Must hold pager.mu
+func (s *Snapshot) cachedCopy(id uint32) ([]byte, error) {
+	p, err := s.version(id)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		cp, ok := s.bt.pager.cache.pages[id]
+		if !ok {
+			return nil, nil
+		}
+		p = cp.page
+	}
+	return append([]byte(nil), p.Data...), nil
+}
+
+// BackupFile writes a backup to a new file at path and verifies it, the file
+// is removed again if anything is wrong with it
+func (bt *BTree) BackupFile(path string) (BackupStats, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if errors.Is(err, os.ErrExist) {
+		return BackupStats{}, fmt.Errorf("Backup: %s already exists", path)
+	}
+	if err != nil {
+		return BackupStats{}, fmt.Errorf("Backup: %s", err)
+	}
+
+	stats, err := bt.Backup(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = verifyBackup(path, bt.log)
+	}
+
+	if err != nil {
+		os.Remove(path)
+		os.Remove(path + ".wal")
+		return stats, err
+	}
+
+	bt.log.Infof("backup: %d pages up to LSN %d written to %s (crc32 %08x)", stats.Pages, stats.LSN, path, stats.Checksum)
+	return stats, nil
+}
+
+// Verify only reads the file so the checksum reported for it still holds afterwards
+func verifyBackup(path string, log *logger.Logger) error {
+	report, err := Verify(path, log)
+	if err != nil {
+		return fmt.Errorf("Backup: verifying %s: %w", path, err)
+	}
+	if !report.OK() {
+		return fmt.Errorf("Backup: %s has %d problem(s), the first is page %d: %s",
+			path, len(report.Problems), report.Problems[0].Page, report.Problems[0].Message)
+	}
+	return nil
+}
+
+type RestoreOptions struct {
+	// Archive to replay over the backup, nothing is replayed when empty
+	Archive string
+	// Where to stop replaying
+	Until RecoveryTarget
+}
+
+type RestoreStats struct {
+	Report   *VerifyReport
+	Recovery RecoveryStats
+}
+
+// Restore copies the backup at src to a new database at dst, replaying the
+// archive over it when there is one, and only puts it in place once the copy has
+// been verified. src itself is left as it is
+func Restore(src, dst string, opts RestoreOptions, log *logger.Logger) (RestoreStats, error) {
+	var stats RestoreStats
+	if _, err := os.Stat(dst); err == nil {
+		return stats, fmt.Errorf("Restore: %s already exists", dst)
+	}
+
+	work := dst + ".restore"
+	os.Remove(work)
+	os.Remove(work + ".wal")
+
+	if err := copyDBFile(src, work); err != nil {
+		return stats, fmt.Errorf("Restore: %w", err)
+	}
+
+	var err error
+	stats.Recovery, err = recoverFile(work, opts, log)
+	if err == nil {
+		stats.Report, err = Verify(work, log)
+	}
+	if err == nil && !stats.Report.OK() {
+		err = fmt.Errorf("Restore: %s has %d problem(s), the first is page %d: %s",
+			src, len(stats.Report.Problems), stats.Report.Problems[0].Page, stats.Report.Problems[0].Message)
+	}
+	if err != nil {
+		os.Remove(work)
+		os.Remove(work + ".wal")
+		return stats, err
+	}
+
+	// A log left by a database that used to live at dst belongs to another file
+	os.Remove(dst + ".wal")
+	if err := os.Rename(work, dst); err != nil {
+		return stats, fmt.Errorf("Restore: %s", err)
+	}
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		return stats, fmt.Errorf("Restore: %w", err)
+	}
+
+	stats.Report.Path = dst
+	log.Infof("restore: %s restored to %s at LSN %d", src, dst, stats.Recovery.To)
+	return stats, nil
+}
+
+// Replay the archive into the copy at path and give it an ID of its own. The
+// restored database goes its own way from here, its logs must never be mistaken
+// for those of the database the backup was taken from
+func recoverFile(path string, opts RestoreOptions, log *logger.Logger) (RecoveryStats, error) {
+	pager, err := OpenWithOptions(path, log, Options{Durability: DurabilityNone})
+	if err != nil {
+		return RecoveryStats{}, fmt.Errorf("Restore: %w", err)
+	}
+
+	var stats RecoveryStats
+	if opts.Archive != "" {
+		stats, err = recoverArchive(pager, opts.Archive, opts.Until, log)
+	} else {
+		stats.From, stats.To = pager.wal.lastLSN, pager.wal.lastLSN
+	}
+
+	if err == nil {
+		err = pager.newDatabaseID()
+	}
+	if cErr := pager.Close(); err == nil {
+		err = cErr
+	}
+	return stats, err
+}
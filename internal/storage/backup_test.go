@@ -0,0 +1,271 @@
+package storage_test
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"go.store/internal/engine"
+	"go.store/internal/logger"
+	"go.store/internal/storage"
+)
+
+// Restore the backup at src into a fresh GoStore home and open it
+func restoreBackup(t *testing.T, src, dbname string, opts storage.RestoreOptions) (*engine.Database, storage.RestoreStats) {
+	t.Helper()
+
+	cfg := createTestDB(t, dbname)
+	path := testDBPath(cfg, dbname)
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := storage.Restore(src, path, opts, logger.New(io.Discard, logger.ERROR))
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if !stats.Report.OK() {
+		t.Fatalf("Expected no problems, got %v", stats.Report.Problems)
+	}
+
+	db, err := engine.Open(dbname, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, stats
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	db := openTestDB(t, "test_backup")
+
+	want := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("key%05d", i)
+		v := crashValue(i, 120)
+		if i%250 == 0 {
+			v = crashValue(i, 3*storage.DefaultPageSize)
+		}
+		if err := db.Set(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = v
+	}
+	// Leave free pages behind so the free list has to come across too
+	for i := 0; i < 3000; i += 4 {
+		k := fmt.Sprintf("key%05d", i)
+		if err := db.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, k)
+	}
+
+	var buf bytes.Buffer
+	stats, err := db.Backup(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Bytes != int64(buf.Len()) || stats.Bytes != int64(stats.Pages)*int64(storage.DefaultPageSize) {
+		t.Fatalf("Expected %d whole pages, got %d bytes", stats.Pages, buf.Len())
+	}
+	if stats.Checksum != crc32.ChecksumIEEE(buf.Bytes()) {
+		t.Fatalf("Checksum %08x does not match the bytes written", stats.Checksum)
+	}
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	fstats, err := db.BackupFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Verifying the backup must not change the file the checksum was reported for
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fstats.Checksum != crc32.ChecksumIEEE(data) {
+		t.Fatalf("Checksum %08x does not match %s, which has %08x", fstats.Checksum, path, crc32.ChecksumIEEE(data))
+	}
+	if _, err := os.Stat(path + ".wal"); !os.IsNotExist(err) {
+		t.Fatalf("Expected no log next to the backup, got %v", err)
+	}
+
+	if _, err := db.BackupFile(path); err == nil {
+		t.Fatal("Expected a backup over an existing file to fail")
+	}
+
+	// Nothing written after the backup ends up in it
+	for i := 1; i < 3000; i += 4 {
+		if err := db.Set(fmt.Sprintf("key%05d", i), []byte("later")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restored, restore := restoreBackup(t, path, "test_restored", storage.RestoreOptions{})
+	verifyContents(t, restored, want, "restored")
+
+	// Same pages and free list as the file it was taken from
+	report := restore.Report
+	if report.Pages != stats.Pages || report.FreePages == 0 {
+		t.Fatalf("Expected %d pages with some free, got %+v", stats.Pages, report)
+	}
+}
+
+func TestRestoreRefusesBadBackups(t *testing.T) {
+	db := openTestDB(t, "test_backup_bad")
+	for i := 0; i < 500; i++ {
+		if err := db.Set(fmt.Sprintf("key%05d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	if _, err := db.BackupFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := createTestDB(t, "test_restore_bad")
+	dst := testDBPath(cfg, "test_restore_bad")
+	log := logger.New(io.Discard, logger.ERROR)
+
+	if _, err := storage.Restore(path, dst, storage.RestoreOptions{}, log); err == nil {
+		t.Fatal("Expected a restore over an existing database to fail")
+	}
+	if err := os.Remove(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	// Out of order keys only a full check of the tree finds
+	editPage(t, path, 1, func(page []byte) {
+		leaf := storage.WrapLeafPage(&storage.Page{Data: page})
+		a, b := leaf.GetCellPointer(0), leaf.GetCellPointer(1)
+		leaf.SetCellPointer(0, b)
+		leaf.SetCellPointer(1, a)
+	})
+
+	if _, err := storage.Restore(path, dst, storage.RestoreOptions{}, log); err == nil {
+		t.Fatal("Expected a damaged backup to be refused")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("Expected nothing restored, got %v", err)
+	}
+}
+
+// Holds the first write until resume is closed so the test decides when the backup moves on
+type gatedWriter struct {
+	w       io.Writer
+	started chan struct{}
+	resume  chan struct{}
+	once    sync.Once
+}
+
+func (g *gatedWriter) Write(p []byte) (int, error) {
+	g.once.Do(func() {
+		close(g.started)
+		<-g.resume
+	})
+	return g.w.Write(p)
+}
+
+// Run with -race. The backup is held after its first page while writers change
+// the tree and vacuum runs, the restored copy must match the tree when it started
+func TestBackupDuringWrites(t *testing.T) {
+	cfg := createTestDBWithPageSize(t, "test_backup_live", storage.MinPageSize)
+	cfg.CachePages = 32
+	cfg.Durability = "none"
+
+	db, err := engine.Open("test_backup_live", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	want := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("key%05d", i)
+		v := crashValue(i, 50+i%300)
+		if err := db.Set(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = v
+	}
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := &gatedWriter{w: f, started: make(chan struct{}), resume: make(chan struct{})}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := db.Backup(g)
+		errc <- err
+	}()
+	<-g.started
+
+	// Single key writes, transactions and batches all carry on
+	var wg sync.WaitGroup
+	for w := 0; w < 3; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < 3000; i += 3 {
+				k := fmt.Sprintf("key%05d", i)
+				var err error
+				switch {
+				case w == 0:
+					err = db.Delete(k)
+				case w == 1:
+					tx := db.Begin()
+					tx.Delete(k)
+					tx.Set("tx"+k, []byte(strconv.Itoa(i)))
+					err = tx.Commit()
+				default:
+					b := db.NewWriteBatch()
+					b.Delete(k)
+					_, err = b.Write()
+				}
+				if err != nil {
+					t.Errorf("Write %s failed: %v", k, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	stats, err := db.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Moved == 0 || stats.PagesAfter != stats.PagesBefore {
+		t.Fatalf("Expected vacuum to move pages but leave the file alone during a backup, got %+v", stats)
+	}
+
+	close(g.resume)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, _ := restoreBackup(t, path, "test_backup_restored", storage.RestoreOptions{})
+	verifyContents(t, restored, want, "restored")
+
+	if stats := db.SnapshotStats(); stats.Open != 0 || stats.Versions != 0 {
+		t.Fatalf("Expected the backup to let go of its versions, got %+v", stats)
+	}
+
+	// With the backup done vacuum can shrink the file again
+	if stats, err := db.Vacuum(); err != nil || stats.PagesAfter >= stats.PagesBefore {
+		t.Fatalf("Expected vacuum to shrink the file, got %+v %v", stats, err)
+	}
+}
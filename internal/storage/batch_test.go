@@ -0,0 +1,123 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"go.store/internal/storage"
+)
+
+func TestWriteBatchResults(t *testing.T) {
+	db := openTestDB(t, "test_batch")
+
+	for _, k := range []string{"exists", "doomed"} {
+		if err := db.Set(k, []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := db.NewWriteBatch()
+	b.Set("zebra", []byte("1"))
+	b.SetNX("exists", []byte("2"))
+	b.SetXX("missing", []byte("3"))
+	b.Delete("doomed")
+	b.Delete("never-there")
+	b.Set(strings.Repeat("k", storage.MaxKeySize+1), []byte("4"))
+	b.SetXX("exists", []byte("5"))
+	// Writes to one key keep their order even though the batch is sorted
+	b.Set("apple", []byte("6"))
+	b.Delete("apple")
+	b.SetNX("apple", []byte("7"))
+
+	if b.Len() != 10 {
+		t.Fatalf("Expected 10 queued writes, got %d", b.Len())
+	}
+
+	results, err := b.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []error{nil, storage.ErrKeyExists, storage.ErrKeyNotFound, nil, storage.ErrKeyNotFound, storage.ErrKeyTooLarge, nil, nil, nil, nil}
+	if len(results) != len(want) {
+		t.Fatalf("Expected %d results, got %d", len(want), len(results))
+	}
+	for i := range want {
+		if !errors.Is(results[i], want[i]) || (want[i] == nil && results[i] != nil) {
+			t.Fatalf("Write %d: expected %v, got %v", i, want[i], results[i])
+		}
+	}
+
+	verifyContents(t, db, map[string]string{"zebra": "1", "exists": "5", "apple": "7"}, "after batch")
+
+	if b.Len() != 0 {
+		t.Fatalf("Expected Write to empty the batch, %d writes left", b.Len())
+	}
+	if results, err := b.Write(); err != nil || results != nil {
+		t.Fatalf("Expected an empty batch to do nothing, got %v %v", results, err)
+	}
+}
+
+func TestWriteBatchIsOneCommit(t *testing.T) {
+	db := openTestDB(t, "test_batch_commit")
+
+	rng := rand.New(rand.NewSource(1))
+	want := make(map[string]string)
+
+	b := db.NewWriteBatch()
+	for i := 0; i < 5000; i++ {
+		k := fmt.Sprintf("key%05d", rng.Intn(10000))
+		v := strings.Repeat("v", rng.Intn(200))
+		b.Set(k, []byte(v))
+		want[k] = v
+	}
+
+	// Durability defaults to always so each commit is one fsync
+	before := db.WALStats().Syncs
+	results, err := b.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := db.WALStats().Syncs - before; got != 1 {
+		t.Fatalf("Expected one fsync for the whole batch, got %d", got)
+	}
+	for i, err := range results {
+		if err != nil {
+			t.Fatalf("Write %d failed: %v", i, err)
+		}
+	}
+	verifyContents(t, db, want, "after sets")
+
+	for k := range want {
+		if rng.Intn(2) == 0 {
+			b.Delete(k)
+			delete(want, k)
+		}
+	}
+	if _, err := b.Write(); err != nil {
+		t.Fatal(err)
+	}
+	verifyContents(t, db, want, "after deletes")
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteBatchReset(t *testing.T) {
+	db := openTestDB(t, "test_batch_reset")
+
+	b := db.NewWriteBatch()
+	b.Set("a", []byte("1"))
+	b.Reset()
+
+	if results, err := b.Write(); err != nil || results != nil {
+		t.Fatalf("Expected a reset batch to do nothing, got %v %v", results, err)
+	}
+	if _, err := db.Get("a"); err == nil {
+		t.Fatal("Expected the reset write to be dropped")
+	}
+}
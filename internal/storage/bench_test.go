@@ -0,0 +1,109 @@
+package storage_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"go.store/internal/engine"
+)
+
+const benchKeys = 20000
+
+func benchKey(i int) string { return fmt.Sprintf("key%06d", i) }
+
+// A loaded database without fsyncs so benchmarks measure the tree rather than the disk
+func openBenchDB(b *testing.B) *engine.Database {
+	b.Helper()
+
+	cfg := createTestDB(b, "bench")
+	cfg.Durability = "none"
+
+	db, err := engine.Open("bench", cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	batch := db.NewWriteBatch()
+	for i := 0; i < benchKeys; i++ {
+		batch.Set(benchKey(i), []byte(benchKey(i)))
+	}
+	if _, err := batch.Write(); err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+// Run with -cpu 1,2,4,8 to see how readers and writers scale together
+func BenchmarkMixedReadWrite(b *testing.B) {
+	for _, reads := range []int{100, 95, 80, 50} {
+		b.Run(fmt.Sprintf("reads=%d%%", reads), func(b *testing.B) {
+			db := openBenchDB(b)
+			var seed atomic.Int64
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(seed.Add(1)))
+				val := bytes.Repeat([]byte("v"), 100)
+
+				for pb.Next() {
+					k := benchKey(rng.Intn(benchKeys))
+					if rng.Intn(100) < reads {
+						if _, err := db.Get(k); err != nil {
+							b.Error(err)
+							return
+						}
+					} else if err := db.Set(k, val); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// Gets while another goroutine keeps writing values large enough to need a
+// chain of overflow pages, the slow writes shouldn't hold up the reads
+func BenchmarkGetDuringLargeWrites(b *testing.B) {
+	db := openBenchDB(b)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		val := bytes.Repeat([]byte("v"), 256<<10)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := db.Set(fmt.Sprintf("large%d", i%8), val); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+
+	var seed atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(seed.Add(1)))
+		for pb.Next() {
+			if _, err := db.Get(benchKey(rng.Intn(benchKeys))); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+
+	close(done)
+	wg.Wait()
+}
@@ -2,47 +2,66 @@ package storage
 
 import "fmt"
 
-func (bt *BTree) canBorrowLeaf(sib, leaf *LeafPage, right bool) bool {
-	if sib.GetNumCells() == 0 {
+func (bt *BTree) canBorrowLeaf(sib, leaf *LeafPage, parent *InternalPage, sepIdx int, right bool) bool {
+	if sib.GetNumCells() < 2 {
 		return false
 	}
 
+	// The separator is replaced by the new first key of the right hand page
 	var borrowSize int
+	var newSep []byte
 	if right {
 		borrowSize = sib.GetFirstRecordSize()
+		newSep = sib.ReadKey(sib.GetCellPointer(1))
 	} else {
 		borrowSize = sib.GetLastRecordSize()
+		newSep = sib.ReadKey(sib.GetCellPointer(sib.GetNumCells() - 1))
 	}
 
-	newUsed := sib.GetSpaceUsed() - borrowSize
-	return newUsed >= PageSize/2
-}
-
-func (bt *BTree) canBorrowInternal(sib, page *InternalPage, right bool) bool {
-	sibKeys := sib.GetNumKeys()
-	pageKeys := page.GetNumKeys()
-
-	if sibKeys <= 1 {
+	if parent.GetSpaceUsed()-len(parent.GetKey(sepIdx))+len(newSep) > bt.pager.pageSize {
 		return false
 	}
 
-	if pageKeys+1 > maxChildren-1 {
-		return false
+	// The borrowed key can shorten the prefix of leaf and make all of its cells longer
+	if leaf.IsPrefixed() {
+		var r rec
+		if right {
+			r = sib.readRec(sib.GetCellPointer(0))
+		} else {
+			r = sib.readRec(sib.GetCellPointer(sib.GetNumCells() - 1))
+		}
+		if leafSpaceFor(append(leaf.records(), r), true) > bt.pager.pageSize {
+			return false
+		}
 	}
 
-	var ptr uint16
+	newUsed := sib.GetSpaceUsed() - borrowSize
+	return newUsed >= bt.pager.pageSize/2
+}
 
+func (bt *BTree) canBorrowInternal(sib, page, parent *InternalPage, sepIdx int, right bool) bool {
+	if sib.GetNumKeys() <= 1 {
+		return false
+	}
+
+	var key []byte
 	if right {
-		ptr = sib.GetKeyPointer(0)
+		key = sib.GetKey(0)
 	} else {
-		ptr = sib.GetKeyPointer(sib.GetNumKeys() - 1)
+		key = sib.GetKey(sib.GetNumKeys() - 1)
 	}
 
-	key := sib.ReadKey(ptr)
-	borrowSize := 4 + len(key)
+	// The separator comes down into page and the borrowed key replaces it in the parent
+	sep := parent.GetKey(sepIdx)
+	if page.GetSpaceUsed()+internalCellSize(sep) > bt.pager.pageSize {
+		return false
+	}
+	if parent.GetSpaceUsed()-len(sep)+len(key) > bt.pager.pageSize {
+		return false
+	}
 
-	newUsed := sib.GetSpaceUsed() - borrowSize
-	return newUsed >= PageSize/2
+	newUsed := sib.GetSpaceUsed() - internalCellSize(key)
+	return newUsed >= bt.pager.pageSize/2
 }
 
 func (bt *BTree) borrowLeaf(sib, leaf *LeafPage, parent *InternalPage, sepIdx int, right bool) error {
@@ -50,49 +69,39 @@ func (bt *BTree) borrowLeaf(sib, leaf *LeafPage, parent *InternalPage, sepIdx in
 		bt.log.Errorf("borrowLeaf: %v", ErrSamePage)
 		return fmt.Errorf("borrowLeaf: %w", ErrSamePage)
 	}
-	var key, val []byte
-	var ptr uint16
+	var r rec
 
+	// Records are moved as-is so overflow cells keep pointing at their chain
 	if right {
-		ptr = sib.GetCellPointer(0)
-		k, v := sib.ReadRecord(ptr)
-
-		key = append([]byte(nil), k...)
-		val = append([]byte(nil), v...)
-		sib.Delete(key)
+		r = sib.readRec(sib.GetCellPointer(0))
+		sib.Delete(r.key)
 	} else {
 		idx := sib.GetNumCells() - 1
-		ptr = sib.GetCellPointer(idx)
-		k, v := sib.ReadRecord(ptr)
-
-		key = append([]byte(nil), k...)
-		val = append([]byte(nil), v...)
-		sib.Delete(key)
+		r = sib.readRec(sib.GetCellPointer(idx))
+		sib.Delete(r.key)
 	}
 
-	if err := leaf.Insert(key, val); err != nil {
-		return err
-	}
-	if err := leaf.Compact(); err != nil {
+	if err := leaf.insertRec(r); err != nil {
 		return err
 	}
 
-	var newMin []byte
+	// The borrowed record is now the last key of the left page or the first of the right one
+	var newSep []byte
 	if right {
 		if sib.GetNumCells() == 0 {
 			return fmt.Errorf("borrowLeaf: right %w", ErrSiblingEmpty)
 		}
 		off := sib.GetCellPointer(0)
-		newMin = sib.ReadKey(off)
+		newSep = shortestSeparator(r.key, sib.ReadKey(off))
 	} else {
-		if leaf.GetNumCells() == 0 {
+		if sib.GetNumCells() == 0 {
 			return fmt.Errorf("borrowLeaf: left %w", ErrSiblingEmpty)
 		}
-		off := leaf.GetCellPointer(0)
-		newMin = leaf.ReadKey(off)
+		off := sib.GetCellPointer(sib.GetNumCells() - 1)
+		newSep = shortestSeparator(sib.ReadKey(off), r.key)
 	}
 
-	if err := parent.ReplaceKey(sepIdx, newMin); err != nil {
+	if err := parent.ReplaceKey(sepIdx, newSep); err != nil {
 		return err
 	}
 
@@ -118,23 +127,25 @@ func (bt *BTree) borrowInternal(sib, page, parent *InternalPage, sepIdx int, rig
 
 	var borrowKey []byte
 	var borrowChild uint32
-	var ptr uint16
+
+	parentKey := append([]byte(nil), parent.GetKey(sepIdx)...)
 
 	if right {
 		if sib.GetNumKeys() == 0 {
 			return fmt.Errorf("borrowInternal: right %w", ErrSiblingEmpty)
 		}
 
-		ptr = sib.GetKeyPointer(0)
-		borrowKey = sib.ReadKey(ptr)
+		// The first child of the sibling moves over with the key to its right
+		borrowKey = append([]byte(nil), sib.GetKey(0)...)
 		borrowChild = sib.GetChild(0)
 
-		if err := sib.DeleteChild(0); err != nil {
+		if err := sib.DeleteCell(0); err != nil {
 			return err
 		}
 
-		if err := sib.DeleteKey(0); err != nil {
-			return err
+		// It becomes the last child of page, after the separator from the parent
+		if page.InsertSeparator(parentKey, borrowChild) {
+			return fmt.Errorf("borrowInternal: %w", ErrPageFull)
 		}
 	} else {
 		n := sib.GetNumKeys()
@@ -142,33 +153,20 @@ func (bt *BTree) borrowInternal(sib, page, parent *InternalPage, sepIdx int, rig
 			return fmt.Errorf("borrowInternal: left %w", ErrSiblingEmpty)
 		}
 
-		ptr = sib.GetKeyPointer(n - 1)
-		borrowKey = sib.ReadKey(ptr)
-
+		// The last child of the sibling moves over with the key to its left
+		borrowKey = append([]byte(nil), sib.GetKey(n-1)...)
 		borrowChild = sib.GetRightChild()
-		if err := sib.DeleteChild(n); err != nil {
+
+		if err := sib.RemoveSeparator(n - 1); err != nil {
 			return err
 		}
 
-		if err := sib.DeleteKey(n - 1); err != nil {
+		// It becomes the first child of page, before the separator from the parent
+		if err := page.InsertCell(0, borrowChild, parentKey); err != nil {
 			return err
 		}
 	}
 
-	oldKeyCount := page.GetNumKeys()
-	parentPtr := parent.GetKeyPointer(sepIdx)
-	parentKey := parent.ReadKey(parentPtr)
-
-	if right {
-		page.InsertChildPointer(oldKeyCount+1, borrowChild)
-	} else {
-		page.InsertChildPointer(0, borrowChild)
-	}
-
-	if err := page.InsertKey(parentKey); err != nil {
-		return err
-	}
-
 	if err := parent.ReplaceKey(sepIdx, borrowKey); err != nil {
 		return err
 	}
@@ -2,6 +2,8 @@ package storage
 
 import (
 	"bytes"
+	"fmt"
+	"sync/atomic"
 
 	"go.store/internal/logger"
 )
@@ -9,15 +11,22 @@ import (
 type BTree struct {
 	pager     *Pager
 	log       *logger.Logger
-	root      uint32
+	root      atomic.Uint32
 	meta      *MetaPage
 	metaDirty bool
+
+	// Bumped at the end of every write so cursors know when their cached position is stale
+	version atomic.Uint64
+
+	// Pages latched by the running write, nil when it holds the tree lock instead
+	latches *latchSet
 }
 
 // This type stores records when splitting / merging
 type rec struct {
-	key []byte
-	val []byte
+	key      []byte
+	val      []byte
+	overflow bool
 }
 
 func NewBTree(pager *Pager, log *logger.Logger) (*BTree, error) {
@@ -27,25 +36,32 @@ func NewBTree(pager *Pager, log *logger.Logger) (*BTree, error) {
 	}
 
 	metaPage := WrapMetaPage(m)
-	rootID := metaPage.GetRootID()
-	return &BTree{
+	if unknown := metaPage.GetFeatures() &^ knownFeatures; unknown != 0 {
+		return nil, fmt.Errorf("Open %w: %s uses features %#x this release doesn't know", ErrFormatTooNew, pager.filePath, unknown)
+	}
+
+	bt := &BTree{
 		pager:     pager,
 		log:       log,
-		root:      rootID,
 		meta:      metaPage,
 		metaDirty: false,
-	}, nil
+	}
+	bt.root.Store(metaPage.GetRootID())
+	pager.versions.root = metaPage.GetRootID()
+	return bt, nil
 }
 
 func (bt *BTree) Search(key []byte) ([]byte, bool, error) {
-
 	bt.pager.write.RLock()
 	defer bt.pager.write.RUnlock()
 
-	leaf, _, err := bt.descend(key)
+	cp, err := bt.latchLeaf(childFor(key), false)
 	if err != nil {
 		return nil, false, err
 	}
+	defer bt.pager.unlatch(cp, false)
+
+	leaf := WrapLeafPage(cp.page)
 
 	idx := leaf.FindInsertIndex(key)
 	if idx >= leaf.GetNumCells() {
@@ -55,7 +71,10 @@ func (bt *BTree) Search(key []byte) ([]byte, bool, error) {
 	ptr := leaf.GetCellPointer(idx)
 
 	if bytes.Equal(leaf.ReadKey(ptr), key) {
-		_, val := leaf.ReadRecord(ptr)
+		val, err := bt.readValue(leaf, ptr)
+		if err != nil {
+			return nil, false, err
+		}
 		return val, true, nil
 	} else {
 		return nil, false, nil
@@ -2,17 +2,18 @@ package storage_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"math/rand"
+	"strings"
 	"testing"
 
 	"go.store/internal/engine"
+	"go.store/internal/storage"
 )
 
 func TestDeleteAscending(t *testing.T) {
-	db, err := engine.Open("test_delete_ascending.db")
-	if err != nil {
-		t.Fatal(err)
-	}
+	db := openTestDB(t, "test_delete_ascending")
 
 	const N = 10000
 
@@ -36,10 +37,7 @@ func TestDeleteAscending(t *testing.T) {
 }
 
 func TestAscendingInsertAndGet(t *testing.T) {
-	db, err := engine.Open("test_insert.db")
-	if err != nil {
-		t.Fatal(err)
-	}
+	db := openTestDB(t, "test_insert")
 
 	const N = 10000
 
@@ -66,10 +64,7 @@ func TestAscendingInsertAndGet(t *testing.T) {
 }
 
 func TestAscendingInsertDescendingDelete(t *testing.T) {
-	db, err := engine.Open("test_ordered.db")
-	if err != nil {
-		t.Fatal(err)
-	}
+	db := openTestDB(t, "test_ordered")
 
 	const N = 10000
 
@@ -103,17 +98,14 @@ func TestAscendingInsertDescendingDelete(t *testing.T) {
 }
 
 func TestDuplicateKeys(t *testing.T) {
-	db, err := engine.Open("test_dup.db")
-	if err != nil {
-		t.Fatal(err)
-	}
+	db := openTestDB(t, "test_dup")
 
 	if err := db.Set("dup", []byte("1")); err != nil {
 		t.Fatalf("Set failed: %v", err)
 	}
 
-	// Second insert should fail
-	if err := db.Set("dup", []byte("2")); err == nil {
+	// Second set should replace the value
+	if err := db.Set("dup", []byte("2")); err != nil {
 		t.Fatalf("Duplicate Set failed: %v", err)
 	}
 
@@ -122,7 +114,7 @@ func TestDuplicateKeys(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if !bytes.Equal(v, []byte("1")) {
+	if !bytes.Equal(v, []byte("2")) {
 		t.Fatalf("Expected overwrite to store 2, got %s", v)
 	}
 
@@ -130,3 +122,226 @@ func TestDuplicateKeys(t *testing.T) {
 		t.Fatalf("Close failed: %v", err)
 	}
 }
+
+func TestSetNXAndSetXX(t *testing.T) {
+	db := openTestDB(t, "test_setnx")
+
+	if err := db.SetXX("k", []byte("1")); !errors.Is(err, storage.ErrKeyNotFound) {
+		t.Fatalf("Expected SetXX on missing key to fail with ErrKeyNotFound, got %v", err)
+	}
+
+	if err := db.SetNX("k", []byte("1")); err != nil {
+		t.Fatalf("SetNX failed: %v", err)
+	}
+
+	if err := db.SetNX("k", []byte("2")); !errors.Is(err, storage.ErrKeyExists) {
+		t.Fatalf("Expected SetNX on existing key to fail with ErrKeyExists, got %v", err)
+	}
+
+	if err := db.SetXX("k", []byte("3")); err != nil {
+		t.Fatalf("SetXX failed: %v", err)
+	}
+
+	v, err := db.Get("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(v, []byte("3")) {
+		t.Fatalf("Expected 3, got %s", v)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func TestOverwriteGrowsValues(t *testing.T) {
+	db := openTestDB(t, "test_overwrite")
+
+	const N = 2000
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		if err := db.Set(k, []byte("x")); err != nil {
+			t.Fatalf("Set %s failed: %v", k, err)
+		}
+	}
+
+	// Replacing with larger values forces leaves to split during the update
+	big := bytes.Repeat([]byte("y"), 200)
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		if err := db.Set(k, big); err != nil {
+			t.Fatalf("Overwrite %s failed: %v", k, err)
+		}
+	}
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		v, err := db.Get(k)
+		if err != nil {
+			t.Fatalf("Get %s failed: %v", k, err)
+		}
+		if !bytes.Equal(v, big) {
+			t.Fatalf("Get %s returned stale value", k)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func TestShortKeysGiveWideInternalPages(t *testing.T) {
+	cfg := createTestDB(t, "test_fanout")
+	cfg.Durability = "none"
+
+	db, err := engine.Open("test_fanout", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const N = 20000
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		if err := db.Set(k, []byte("x")); err != nil {
+			t.Fatalf("Set %s failed: %v", k, err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// More leaves than the old fixed fanout of 128 still hang off a single root
+	r := verifyFile(t, testDBPath(cfg, "test_fanout"))
+	if !r.OK() {
+		t.Fatalf("Expected no problems, got %v", r.Problems)
+	}
+	if r.LeafPages <= 128 || r.Depth != 2 || r.InternalPages != 1 {
+		t.Fatalf("Expected over 128 leaves under one root, got %d leaves, depth %d and %d internal pages",
+			r.LeafPages, r.Depth, r.InternalPages)
+	}
+}
+
+// Long keys that differ early only need a few bytes each in the parents
+func TestSeparatorsAreTruncated(t *testing.T) {
+	tests := []struct {
+		name  string
+		n     int
+		depth int
+	}{
+		// Whole keys would fit ten to an internal page and need four levels
+		{name: "leaf-splits", n: 2000, depth: 2},
+		// Enough leaves that internal pages split too
+		{name: "internal-splits", n: 20000, depth: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createTestDB(t, "test_truncate")
+			cfg.Durability = "none"
+
+			db, err := engine.Open("test_truncate", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keyFor := func(i int) string {
+				return fmt.Sprintf("%06d", i) + strings.Repeat("k", 300)
+			}
+
+			want := make(map[string]string)
+			for _, i := range rand.New(rand.NewSource(1)).Perm(tt.n) {
+				if err := db.Set(keyFor(i), []byte("x")); err != nil {
+					t.Fatal(err)
+				}
+				want[keyFor(i)] = "x"
+			}
+			verifyContents(t, db, want, "after inserts")
+
+			// Truncated separators look like keys that were never written, and
+			// keys between them and their neighbours must still miss
+			for i := 0; i < tt.n; i += 7 {
+				for _, k := range []string{fmt.Sprintf("%06d", i), keyFor(i) + "x", keyFor(i)[:150]} {
+					if _, err := db.Get(k); err == nil {
+						t.Fatalf("Expected %.10s... (%d bytes) to be missing", k, len(k))
+					}
+				}
+			}
+
+			// Borrows and merges replace separators with truncated ones too
+			for i := 0; i < tt.n; i += 3 {
+				if err := db.Delete(keyFor(i)); err != nil {
+					t.Fatal(err)
+				}
+				delete(want, keyFor(i))
+			}
+			verifyContents(t, db, want, "after deletes")
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := verifyFile(t, testDBPath(cfg, "test_truncate"))
+			if !r.OK() {
+				t.Fatalf("Expected no problems, got %v", r.Problems)
+			}
+			if r.Depth != tt.depth {
+				t.Fatalf("Expected depth %d, got %d", tt.depth, r.Depth)
+			}
+		})
+	}
+}
+
+// Separators of very different lengths move between internal pages as leaves
+// borrow and merge, none of them may overflow a parent
+func TestMixedKeyLengthsRebalance(t *testing.T) {
+	cfg := createTestDB(t, "test_mixed_keys")
+	cfg.Durability = "none"
+
+	db, err := engine.Open("test_mixed_keys", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	want := make(map[string]string)
+
+	// Keys sharing an id are replaced by a key of another length
+	keyFor := make(map[int]string)
+
+	for op := 0; op < 10000; op++ {
+		id := rng.Intn(2000)
+		if k, ok := keyFor[id]; ok {
+			if err := db.Delete(k); err != nil {
+				t.Fatalf("Delete %.10s failed at op %d: %v", k, op, err)
+			}
+			delete(want, k)
+			delete(keyFor, id)
+		}
+
+		if rng.Intn(3) == 0 {
+			continue
+		}
+
+		k := fmt.Sprintf("%05d", id) + strings.Repeat("k", rng.Intn(storage.MaxKeySize-5))
+		v := strings.Repeat("v", rng.Intn(200))
+		if err := db.Set(k, []byte(v)); err != nil {
+			t.Fatalf("Set %.10s failed at op %d: %v", k, op, err)
+		}
+		want[k] = v
+		keyFor[id] = k
+	}
+
+	verifyContents(t, db, want, "after rebalancing")
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r := verifyFile(t, testDBPath(cfg, "test_mixed_keys")); !r.OK() {
+		t.Fatalf("Expected no problems, got %v", r.Problems)
+	}
+}
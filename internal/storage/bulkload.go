@@ -0,0 +1,378 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.store/internal/logger"
+)
+
+// BulkLoad builds the tree of an empty database bottom-up from pairs in key
+// order. Leaves are filled one after another, each level of internal pages is
+// built from the separators of the level below, and every page is written
+// once straight to a copy of the file without going through the WAL.
+//
+// The root is only set in the meta page once every page is written and the
+// copy only replaces the original once it is synced, a failed load leaves the
+// database empty
+
+// Pairs for BulkLoad in strictly increasing key order. Key and Value only need
+// to stay valid until the next call to Next
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	// Why Next returned false, nil at the end of the input
+	Err() error
+}
+
+// Leave some room in every page so the first inserts after a load don't all split
+const DefaultFillFactor = 0.9
+
+type BulkLoadOptions struct {
+	// Fraction of each page to fill, from 0.5 to 1. 0 uses DefaultFillFactor
+	FillFactor float64
+}
+
+type BulkLoadStats struct {
+	Keys          int
+	LeafPages     int
+	InternalPages int
+	OverflowPages int
+	Depth         int
+}
+
+func BulkLoad(path string, it Iterator, opts BulkLoadOptions, log *logger.Logger) (BulkLoadStats, error) {
+	fill := opts.FillFactor
+	if fill == 0 {
+		fill = DefaultFillFactor
+	}
+	if fill < 0.5 || fill > 1 {
+		return BulkLoadStats{}, fmt.Errorf("BulkLoad: fill factor %v must be between 0.5 and 1", fill)
+	}
+
+	// Replays and removes the WAL, nothing in it belongs to the new file
+	meta, err := checkEmpty(path, log)
+	if err != nil {
+		return BulkLoadStats{}, err
+	}
+
+	work := path + ".load"
+	os.Remove(work)
+	os.Remove(work + ".wal")
+
+	// Archived logs of the empty file must never be replayed into the loaded one
+	id, err := NewDatabaseID()
+	if err != nil {
+		return BulkLoadStats{}, err
+	}
+
+	pageSize := meta.GetPageSize()
+	f, err := createDatabase(work, id, pageSize, meta.GetFeatures())
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		os.Remove(work)
+		return BulkLoadStats{}, err
+	}
+
+	b := &bulkBuilder{
+		file:     f,
+		pageSize: pageSize,
+		prefixed: meta.GetFeatures()&FeaturePrefixCompression != 0,
+		limit:    int(fill * float64(pageSize)),
+		next:     1,
+		prev:     InvalidPage,
+	}
+
+	err = b.load(it)
+	if err == nil {
+		err = b.finish()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(work)
+		return b.stats, err
+	}
+
+	if err := os.Rename(work, path); err != nil {
+		return b.stats, fmt.Errorf("BulkLoad: %s", err)
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return b.stats, fmt.Errorf("BulkLoad: %w", err)
+	}
+
+	log.Infof("BulkLoad: %s: %d keys in %d leaf, %d internal and %d overflow pages, depth %d",
+		path, b.stats.Keys, b.stats.LeafPages, b.stats.InternalPages, b.stats.OverflowPages, b.stats.Depth)
+	return b.stats, nil
+}
+
+// Open the database at path and make sure its tree holds nothing, returns a copy of its meta page
+func checkEmpty(path string, log *logger.Logger) (*MetaPage, error) {
+	pager, err := OpenWithOptions(path, log, Options{Durability: DurabilityNone})
+	if err != nil {
+		return nil, err
+	}
+
+	bt, err := NewBTree(pager, log)
+	if err != nil {
+		pager.Close()
+		return nil, err
+	}
+
+	root, err := pager.ReadPage(bt.root.Load())
+	if err == nil && (root.Type != PageTypeLeaf || WrapLeafPage(root).GetNumCells() != 0) {
+		err = fmt.Errorf("BulkLoad %w: %s", ErrDatabaseNotEmpty, path)
+	}
+
+	meta := NewPage(pager.pageSize)
+	copy(meta.Data, bt.meta.Page.Data)
+
+	if cErr := bt.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return WrapMetaPage(meta), nil
+}
+
+type bulkBuilder struct {
+	file     *os.File
+	pageSize int
+	prefixed bool
+	// Bytes each page is filled up to
+	limit int
+	// Pages are handed out in the order they are finished
+	next  uint32
+	stats BulkLoadStats
+
+	// Records of the leaf being filled and their size
+	recs     []rec
+	recBytes int
+	// The last finished leaf, written once the ID of the leaf after it is known
+	pending *LeafPage
+	prev    uint32
+	lastKey []byte
+
+	// Every leaf in order and the separators between them, seps[i] sits
+	// between children[i] and children[i+1]
+	children []uint32
+	seps     [][]byte
+}
+
+func (b *bulkBuilder) alloc() *Page {
+	p := NewPage(b.pageSize)
+	p.ID = b.next
+	b.next++
+	return p
+}
+
+func (b *bulkBuilder) write(p *Page) error {
+	stampChecksum(p.Data)
+	if _, err := b.file.WriteAt(p.Data, int64(p.ID)*int64(b.pageSize)); err != nil {
+		return fmt.Errorf("BulkLoad: writing page %d: %s", p.ID, err)
+	}
+	return nil
+}
+
+func (b *bulkBuilder) load(it Iterator) error {
+	var last []byte
+
+	for it.Next() {
+		key, val := it.Key(), it.Value()
+
+		if len(key) > MaxKeySize {
+			return fmt.Errorf("BulkLoad %w: %q", ErrKeyTooLarge, key)
+		}
+		if b.stats.Keys > 0 && bytes.Compare(key, last) <= 0 {
+			return fmt.Errorf("BulkLoad %w: %q follows %q", ErrUnsorted, key, last)
+		}
+		last = append(last[:0], key...)
+
+		r := rec{key: append([]byte(nil), key...), val: append([]byte(nil), val...)}
+		if 4+len(key)+len(val) > maxInlineRecord(b.pageSize) {
+			first, err := b.writeOverflow(val)
+			if err != nil {
+				return err
+			}
+			r = rec{key: r.key, val: encodeOverflowPointer(uint32(len(val)), first), overflow: true}
+		}
+
+		if len(b.recs) > 0 && b.spaceWith(r) > b.limit {
+			if err := b.finishLeaf(); err != nil {
+				return err
+			}
+		}
+		b.recs = append(b.recs, r)
+		b.recBytes += recSize(r)
+		b.stats.Keys++
+	}
+
+	return it.Err()
+}
+
+// Bytes the leaf being filled would use with r added. Keys arrive in order so
+// the prefix they all share is the one shared by the first key and r
+func (b *bulkBuilder) spaceWith(r rec) int {
+	used := dataStart + b.recBytes + recSize(r)
+	if b.prefixed {
+		shared := len(commonPrefix([]rec{b.recs[0], r}))
+		used += 2 + shared - (len(b.recs)+1)*shared
+	}
+	return used
+}
+
+func (b *bulkBuilder) writeOverflow(val []byte) (uint32, error) {
+	capacity := overflowCapacity(b.pageSize)
+	n := (len(val) + capacity - 1) / capacity
+
+	first := b.next
+	for i := 0; i < n; i++ {
+		op := NewOverflowPage(b.alloc())
+		op.SetData(val[i*capacity : min((i+1)*capacity, len(val))])
+		if i+1 < n {
+			op.SetNext(op.Page.ID + 1)
+		}
+
+		if err := b.write(op.Page); err != nil {
+			return InvalidPage, err
+		}
+		b.stats.OverflowPages++
+	}
+	return first, nil
+}
+
+func (b *bulkBuilder) finishLeaf() error {
+	lp := NewLeafPage(b.alloc())
+	if b.prefixed {
+		lp.SetPrefixed()
+	}
+	if err := lp.rebuild(b.recs); err != nil {
+		return fmt.Errorf("BulkLoad: %w", err)
+	}
+	lp.SetPrev(b.prev)
+
+	if b.pending != nil {
+		b.pending.SetNext(lp.Page.ID)
+		if err := b.write(b.pending.Page); err != nil {
+			return err
+		}
+		b.seps = append(b.seps, shortestSeparator(b.lastKey, b.recs[0].key))
+	}
+
+	b.children = append(b.children, lp.Page.ID)
+	b.stats.LeafPages++
+
+	b.pending = lp
+	b.prev = lp.Page.ID
+	b.lastKey = b.recs[len(b.recs)-1].key
+	b.recs = nil
+	b.recBytes = 0
+
+	return nil
+}
+
+// Write the last leaf, build the internal levels and point the meta page at the root
+func (b *bulkBuilder) finish() error {
+	if len(b.recs) > 0 {
+		if err := b.finishLeaf(); err != nil {
+			return err
+		}
+	}
+
+	// An empty input leaves the empty root leaf of the new file in place
+	root := uint32(1)
+	if b.pending != nil {
+		if err := b.write(b.pending.Page); err != nil {
+			return err
+		}
+
+		b.stats.Depth = 1
+		children, seps := b.children, b.seps
+		for len(children) > 1 {
+			var err error
+			if children, seps, err = b.buildLevel(children, seps); err != nil {
+				return err
+			}
+			b.stats.Depth++
+		}
+		root = children[0]
+	} else {
+		b.stats.Depth = 1
+	}
+
+	data := make([]byte, b.pageSize)
+	if _, err := b.file.ReadAt(data, 0); err != nil {
+		return fmt.Errorf("BulkLoad: reading meta page: %s", err)
+	}
+
+	meta := WrapMetaPage(&Page{Data: data})
+	meta.SetRootID(root)
+
+	stampChecksum(data)
+	if _, err := b.file.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("BulkLoad: writing meta page: %s", err)
+	}
+	return nil
+}
+
+// Pack children into internal pages and return the pages with the separators
+// between them for the level above
+func (b *bulkBuilder) buildLevel(children []uint32, seps [][]byte) ([]uint32, [][]byte, error) {
+	// Each group is the index of its first child, the separator in front of
+	// a group moves up a level
+	groups := []int{0}
+	used := internalDataStart
+	for i := 1; i < len(children); i++ {
+		size := internalCellSize(seps[i-1])
+		if i-groups[len(groups)-1] > 1 && used+size > b.limit {
+			groups = append(groups, i)
+			used = internalDataStart
+			continue
+		}
+		used += size
+	}
+
+	// Every internal page needs a key, a lone child at the end takes one from the group before it
+	if n := len(groups); n > 1 && groups[n-1] == len(children)-1 {
+		if groups[n-1]-groups[n-2] < 3 {
+			return nil, nil, fmt.Errorf("BulkLoad: %w", ErrPageOverflow)
+		}
+		groups[n-1]--
+	}
+
+	var upChildren []uint32
+	var upSeps [][]byte
+
+	for g, start := range groups {
+		end := len(children)
+		if g+1 < len(groups) {
+			end = groups[g+1]
+		}
+
+		ip := NewInternalPage(b.alloc())
+		if err := ip.rebuild(seps[start:end-1], children[start:end]); err != nil {
+			return nil, nil, fmt.Errorf("BulkLoad: %w", err)
+		}
+		if err := b.write(ip.Page); err != nil {
+			return nil, nil, err
+		}
+		b.stats.InternalPages++
+
+		if g > 0 {
+			upSeps = append(upSeps, seps[start-1])
+		}
+		upChildren = append(upChildren, ip.Page.ID)
+	}
+
+	return upChildren, upSeps, nil
+}
@@ -0,0 +1,201 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.store/internal/engine"
+	"go.store/internal/logger"
+	"go.store/internal/storage"
+)
+
+type pairIterator struct {
+	keys []string
+	vals map[string]string
+	pos  int
+}
+
+func newPairIterator(want map[string]string) *pairIterator {
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return &pairIterator{keys: keys, vals: want, pos: -1}
+}
+
+func (it *pairIterator) Next() bool {
+	it.pos++
+	return it.pos < len(it.keys)
+}
+
+func (it *pairIterator) Key() []byte   { return []byte(it.keys[it.pos]) }
+func (it *pairIterator) Value() []byte { return []byte(it.vals[it.keys[it.pos]]) }
+func (it *pairIterator) Err() error    { return nil }
+
+func bulkLoad(path string, it storage.Iterator, fill float64) (storage.BulkLoadStats, error) {
+	return storage.BulkLoad(path, it, storage.BulkLoadOptions{FillFactor: fill}, logger.New(io.Discard, logger.ERROR))
+}
+
+func TestBulkLoad(t *testing.T) {
+	tests := []struct {
+		name string
+		opts storage.CreateOptions
+	}{
+		{name: "plain"},
+		{name: "prefix-compression", opts: storage.CreateOptions{PrefixCompression: true}},
+		{name: "large-pages", opts: storage.CreateOptions{PageSize: 16384}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createTestDBWithOptions(t, "test_bulk", tt.opts)
+			path := testDBPath(cfg, "test_bulk")
+
+			want := make(map[string]string)
+			for i := 0; i < 30000; i++ {
+				v := fmt.Sprintf("value-%d", i)
+				if i%1000 == 0 {
+					v = strings.Repeat("o", 20000)
+				}
+				want[fmt.Sprintf("users/%08d", i)] = v
+			}
+
+			stats, err := bulkLoad(path, newPairIterator(want), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Keys != len(want) || stats.OverflowPages == 0 {
+				t.Fatalf("Unexpected stats %+v", stats)
+			}
+
+			r := verifyFile(t, path)
+			if !r.OK() {
+				t.Fatalf("Loaded file has problems: %v", r.Problems)
+			}
+			if r.Keys != len(want) || r.Depth != stats.Depth || r.LeafPages != stats.LeafPages || r.InternalPages != stats.InternalPages {
+				t.Fatalf("Stats %+v don't match the file: %+v", stats, r)
+			}
+			if stats.Depth < 2 {
+				t.Fatalf("Expected internal pages, got depth %d", stats.Depth)
+			}
+
+			db, err := engine.Open("test_bulk", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifyContents(t, db, want, "after load")
+
+			// The loaded tree takes writes like any other
+			for i := 0; i < 30000; i += 7 {
+				k := fmt.Sprintf("users/%08d", i)
+				if i%2 == 0 {
+					if err := db.Delete(k); err != nil {
+						t.Fatal(err)
+					}
+					delete(want, k)
+				} else {
+					if err := db.Set(k+"x", []byte("new")); err != nil {
+						t.Fatal(err)
+					}
+					want[k+"x"] = "new"
+				}
+			}
+			verifyContents(t, db, want, "after writes")
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if r := verifyFile(t, path); !r.OK() {
+				t.Fatalf("File has problems after writes: %v", r.Problems)
+			}
+		})
+	}
+}
+
+func TestBulkLoadFillFactor(t *testing.T) {
+	want := make(map[string]string)
+	for i := 0; i < 10000; i++ {
+		want[fmt.Sprintf("key%06d", i)] = "value"
+	}
+
+	leaves := func(fill float64) int {
+		cfg := createTestDB(t, "test_bulk_fill")
+		stats, err := bulkLoad(testDBPath(cfg, "test_bulk_fill"), newPairIterator(want), fill)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stats.LeafPages
+	}
+
+	full, half := leaves(1), leaves(0.5)
+	if half < full*19/10 {
+		t.Fatalf("Expected half full pages to need about twice the leaves, got %d and %d", half, full)
+	}
+
+	cfg := createTestDB(t, "test_bulk_fill")
+	if _, err := bulkLoad(testDBPath(cfg, "test_bulk_fill"), newPairIterator(want), 0.1); err == nil {
+		t.Fatal("Expected a fill factor of 0.1 to be refused")
+	}
+}
+
+func TestBulkLoadEmptyInput(t *testing.T) {
+	cfg := createTestDB(t, "test_bulk_empty")
+	path := testDBPath(cfg, "test_bulk_empty")
+
+	stats, err := bulkLoad(path, newPairIterator(nil), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 0 || stats.Depth != 1 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+	if r := verifyFile(t, path); !r.OK() {
+		t.Fatalf("Expected no problems, got %v", r.Problems)
+	}
+}
+
+func TestBulkLoadRejectsUnsortedInput(t *testing.T) {
+	cfg := createTestDB(t, "test_bulk_unsorted")
+	path := testDBPath(cfg, "test_bulk_unsorted")
+
+	it := &pairIterator{keys: []string{"a", "c", "b"}, vals: map[string]string{"a": "1", "b": "2", "c": "3"}, pos: -1}
+	if _, err := bulkLoad(path, it, 0); !errors.Is(err, storage.ErrUnsorted) {
+		t.Fatalf("Expected ErrUnsorted, got %v", err)
+	}
+
+	dup := &pairIterator{keys: []string{"a", "a"}, vals: map[string]string{"a": "1"}, pos: -1}
+	if _, err := bulkLoad(path, dup, 0); !errors.Is(err, storage.ErrUnsorted) {
+		t.Fatalf("Expected ErrUnsorted for a duplicate key, got %v", err)
+	}
+
+	// Nothing was written
+	r := verifyFile(t, path)
+	if !r.OK() || r.Keys != 0 {
+		t.Fatalf("Expected an empty healthy database, got %d keys and %v", r.Keys, r.Problems)
+	}
+}
+
+func TestBulkLoadRequiresEmptyDatabase(t *testing.T) {
+	cfg := createTestDB(t, "test_bulk_not_empty")
+
+	db, err := engine.Open("test_bulk_not_empty", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("existing", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = bulkLoad(testDBPath(cfg, "test_bulk_not_empty"), newPairIterator(map[string]string{"a": "1"}), 0)
+	if !errors.Is(err, storage.ErrDatabaseNotEmpty) {
+		t.Fatalf("Expected ErrDatabaseNotEmpty, got %v", err)
+	}
+}
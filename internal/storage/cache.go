@@ -0,0 +1,123 @@
+package storage
+
+import "sync"
+
+// Page cache with CLOCK eviction. The cache is owned by the pager and every
+// method expects pager.mu to be held by the caller
+
+type cachedPage struct {
+	page  *Page
+	dirty bool
+
+	// CLOCK reference bit, set on every access and cleared as the hand passes
+	ref bool
+	// Operation epoch of the last access, pages used by the running operation are pinned
+	epoch uint64
+	// Position in the clock ring
+	slot int
+
+	// Readers and the writer latch the page itself rather than the whole tree
+	latch sync.RWMutex
+	// Latches held or waited on, a pinned page is never evicted
+	pins int
+}
+
+type CacheStats struct {
+	Capacity  int
+	Pages     int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Pages read from the file, readers that miss on a page being loaded wait for it instead
+	Reads uint64
+}
+
+type pageCache struct {
+	// Maximum number of pages to keep, 0 disables eviction
+	capacity int
+	pages    map[uint32]*cachedPage
+	ring     []*cachedPage
+	hand     int
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	reads     uint64
+}
+
+func newPageCache(capacity int) *pageCache {
+	return &pageCache{
+		capacity: capacity,
+		pages:    make(map[uint32]*cachedPage),
+	}
+}
+
+func (c *pageCache) get(id uint32) (*cachedPage, bool) {
+	cp, ok := c.pages[id]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	cp.ref = true
+	return cp, true
+}
+
+func (c *pageCache) insert(cp *cachedPage) {
+	cp.ref = true
+	cp.slot = len(c.ring)
+	c.ring = append(c.ring, cp)
+	c.pages[cp.page.ID] = cp
+}
+
+func (c *pageCache) remove(cp *cachedPage) {
+	last := len(c.ring) - 1
+	c.ring[cp.slot] = c.ring[last]
+	c.ring[cp.slot].slot = cp.slot
+	c.ring = c.ring[:last]
+
+	if c.hand >= len(c.ring) {
+		c.hand = 0
+	}
+
+	delete(c.pages, cp.page.ID)
+}
+
+func (c *pageCache) overCapacity() bool {
+	return c.capacity > 0 && len(c.ring) > c.capacity
+}
+
+// Sweep the clock hand looking for a page that has not been referenced since
+// the last pass. Returns nil if every page is pinned by the current operation
+// or a latch
+func (c *pageCache) victim(epoch uint64) *cachedPage {
+	for i := 0; i < 2*len(c.ring); i++ {
+		cp := c.ring[c.hand]
+		c.hand = (c.hand + 1) % len(c.ring)
+
+		// The meta page is shared with the BTree for its whole lifetime
+		if cp.page.ID == 0 || cp.epoch == epoch || cp.pins > 0 {
+			continue
+		}
+
+		if cp.ref {
+			cp.ref = false
+			continue
+		}
+
+		return cp
+	}
+	return nil
+}
+
+func (c *pageCache) stats() CacheStats {
+	return CacheStats{
+		Capacity:  c.capacity,
+		Pages:     len(c.ring),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Reads:     c.reads,
+	}
+}
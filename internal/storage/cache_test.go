@@ -0,0 +1,75 @@
+package storage_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"go.store/internal/engine"
+)
+
+func TestBoundedCache(t *testing.T) {
+	cfg := createTestDB(t, "test_cache")
+	cfg.CachePages = 16
+
+	db, err := engine.Open("test_cache", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const N = 20000
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", (i*7919)%N)
+		if err := db.Set(k, []byte(k)); err != nil {
+			t.Fatalf("Set %s failed: %v", k, err)
+		}
+	}
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		v, err := db.Get(k)
+		if err != nil {
+			t.Fatalf("Get %s failed: %v", k, err)
+		}
+		if !bytes.Equal(v, []byte(k)) {
+			t.Fatalf("Get %s returned %s", k, v)
+		}
+	}
+
+	stats := db.CacheStats()
+	if stats.Evictions == 0 {
+		t.Fatalf("Expected pages to be evicted: %+v", stats)
+	}
+	if stats.Pages > stats.Capacity {
+		t.Fatalf("Cache holds %d pages, capacity is %d", stats.Pages, stats.Capacity)
+	}
+	if stats.Hits == 0 || stats.Misses == 0 {
+		t.Fatalf("Expected hits and misses to be counted: %+v", stats)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Evicted dirty pages and the final checkpoint must both have reached the file
+	db, err = engine.Open("test_cache", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < N; i += 97 {
+		k := fmt.Sprintf("%08d", i)
+		v, err := db.Get(k)
+		if err != nil {
+			t.Fatalf("Get %s after reopen failed: %v", k, err)
+		}
+		if !bytes.Equal(v, []byte(k)) {
+			t.Fatalf("Get %s after reopen returned %s", k, v)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package storage_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"go.store/internal/engine"
+	"go.store/internal/logger"
+	"go.store/internal/storage"
+)
+
+func TestCorruptPageIsDetected(t *testing.T) {
+	cfg := createTestDB(t, "test_checksum")
+
+	db, err := engine.Open("test_checksum", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("key%04d", i)
+		if err := db.Set(k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := testDBPath(cfg, "test_checksum")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit in the middle of the last page
+	last := len(data)/storage.DefaultPageSize - 1
+	data[last*storage.DefaultPageSize+storage.DefaultPageSize/2] ^= 0x10
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = engine.Open("test_checksum", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Scan("", "", 0)
+
+	var corrupt *storage.ErrCorruptPage
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected ErrCorruptPage, got %v", err)
+	}
+	if corrupt.PageID != uint32(last) {
+		t.Fatalf("Expected page %d to be reported, got %d", last, corrupt.PageID)
+	}
+}
+
+// The fixtures were written by earlier releases, v0 before leaves had sibling
+// links and v1 before pages had checksums, v1 also holds an overflow value
+func TestLegacyFilesAreUpgraded(t *testing.T) {
+	for _, fixture := range []string{"legacy-v0", "legacy-v1"} {
+		t.Run(fixture, func(t *testing.T) {
+			cfg := createTestDB(t, "test_migrate")
+			path := testDBPath(cfg, "test_migrate")
+			copyFile(t, "testdata/"+fixture+".db", path)
+
+			if _, err := engine.Open("test_migrate", cfg); !errors.Is(err, storage.ErrUpgradeRequired) {
+				t.Fatalf("Expected ErrUpgradeRequired, got %v", err)
+			}
+
+			stats, err := storage.Upgrade(path, logger.New(io.Discard, logger.ERROR))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.From != 1 || stats.To != storage.FormatVersion {
+				t.Fatalf("Expected an upgrade from version 1 to %d, got %+v", storage.FormatVersion, stats)
+			}
+
+			db, err := engine.Open("test_migrate", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := make(map[string]string)
+			for i := 0; i < 300; i++ {
+				want[fmt.Sprintf("key%04d", i)] = strings.Repeat(fmt.Sprintf("value-%04d|", i), 4)
+			}
+			if fixture == "legacy-v1" {
+				want["big"] = strings.Repeat("0123456789abcdef", 3*4096/16+7)
+			}
+
+			verifyContents(t, db, want, fixture)
+
+			if err := db.Set("new", []byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			original, err := os.ReadFile("testdata/" + fixture + ".db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			kept, err := os.ReadFile(path + ".v1")
+			if err != nil {
+				t.Fatalf("Original file was not kept: %v", err)
+			}
+			if !bytes.Equal(kept, original) {
+				t.Fatal("Kept file differs from the original")
+			}
+
+			// The upgraded file opens without being rebuilt again
+			db, err = engine.Open("test_migrate", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want["new"] = "x"
+			verifyContents(t, db, want, fixture+" reopened")
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+package storage_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"go.store/internal/engine"
+	"go.store/internal/storage"
+)
+
+// Offset of the fragmented byte count in a leaf header
+const fragmentedOffset = 7
+
+func TestDeleteLeavesHolesUntilSpaceIsNeeded(t *testing.T) {
+	lp := storage.NewLeafPage(storage.NewPage(storage.DefaultPageSize))
+
+	val := bytes.Repeat([]byte("v"), 100)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%04d", i)) }
+
+	for i := 0; i < 30; i++ {
+		if err := lp.Insert(key(i), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	end, used := lp.GetFreeEnd(), lp.GetSpaceUsed()
+	for i := 0; i < 30; i += 3 {
+		if err := lp.Delete(key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing moved, the deleted cells are only counted
+	cell := 4 + len(key(0)) + len(val)
+	if lp.GetFreeEnd() != end {
+		t.Fatalf("Expected the free end to stay at %d, got %d", end, lp.GetFreeEnd())
+	}
+	if lp.GetFragmented() != 10*cell {
+		t.Fatalf("Expected %d fragmented bytes, got %d", 10*cell, lp.GetFragmented())
+	}
+	if lp.GetSpaceUsed() != used-10*(cell+2) {
+		t.Fatalf("Expected %d bytes in use, got %d", used-10*(cell+2), lp.GetSpaceUsed())
+	}
+
+	// Fill the contiguous space, the next insert has to reclaim the holes
+	i := 100
+	for lp.GetFreeEnd()-lp.GetFreeStart() >= cell+2 {
+		if err := lp.Insert(key(i), val); err != nil {
+			t.Fatal(err)
+		}
+		i++
+	}
+	if lp.GetFragmented() == 0 {
+		t.Fatal("Expected the page to still be fragmented")
+	}
+
+	if err := lp.Insert(key(i), val); err != nil {
+		t.Fatal(err)
+	}
+	if lp.GetFragmented() != 0 {
+		t.Fatalf("Expected the insert to compact the page, %d bytes still fragmented", lp.GetFragmented())
+	}
+
+	for _, k := range lp.DebugKeys() {
+		n := lp.FindInsertIndex([]byte(k))
+		_, v := lp.ReadRecord(lp.GetCellPointer(n))
+		if !bytes.Equal(v, val) {
+			t.Fatalf("Record %s lost its value", k)
+		}
+	}
+	if got := len(lp.DebugKeys()); got != 20+i-100+1 {
+		t.Fatalf("Expected %d keys, got %d", 20+i-100+1, got)
+	}
+}
+
+func TestDeleteHeavyWorkload(t *testing.T) {
+	cfg := createTestDB(t, "test_lazy_compaction")
+	cfg.Durability = "none"
+
+	db, err := engine.Open("test_lazy_compaction", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	want := make(map[string]string)
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 2000; i++ {
+			k := fmt.Sprintf("key%05d", rng.Intn(5000))
+			v := strings.Repeat("v", rng.Intn(300))
+			if err := db.Set(k, []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+			want[k] = v
+		}
+
+		// Delete most of what is there so leaves fill with holes and underflow
+		for k := range want {
+			if rng.Intn(4) == 0 {
+				continue
+			}
+			if err := db.Delete(k); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, k)
+		}
+		verifyContents(t, db, want, fmt.Sprintf("round %d", round))
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r := verifyFile(t, testDBPath(cfg, "test_lazy_compaction")); !r.OK() {
+		t.Fatalf("Expected no problems, got %v", r.Problems)
+	}
+}
+
+func TestVerifyDetectsWrongFragmentedCount(t *testing.T) {
+	cfg := createTestDB(t, "test_verify_fragmented")
+
+	db, err := engine.Open("test_verify_fragmented", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Set(fmt.Sprintf("key%d", i), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := testDBPath(cfg, "test_verify_fragmented")
+	if r := verifyFile(t, path); !r.OK() {
+		t.Fatalf("Expected no problems before the edit, got %v", r.Problems)
+	}
+
+	editPage(t, path, 1, func(page []byte) {
+		binary.LittleEndian.PutUint16(page[fragmentedOffset:], 0)
+	})
+
+	if r := verifyFile(t, path); !hasProblem(r, storage.ProblemPage) {
+		t.Fatalf("Expected a page problem, got %v", r.Problems)
+	}
+}
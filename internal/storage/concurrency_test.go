@@ -0,0 +1,343 @@
+package storage_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.store/internal/engine"
+	"go.store/internal/storage"
+)
+
+// Run with -race. A tiny cache keeps every reader faulting pages in from the
+// file at the same time as the others and as the writer evicts dirty pages
+func TestConcurrentReadersAndWriter(t *testing.T) {
+	cfg := createTestDB(t, "test_concurrent")
+	cfg.CachePages = 8
+	cfg.Durability = "none"
+
+	db, err := engine.Open("test_concurrent", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const N = 5000
+	key := func(i int) string { return fmt.Sprintf("key%05d", i) }
+	// Some values spill into overflow chains so reads follow those too
+	val := func(i int) []byte {
+		if i%50 == 0 {
+			return bytes.Repeat([]byte(key(i)), 800)
+		}
+		return []byte(strings.Repeat("v", i%100) + key(i))
+	}
+
+	for i := 0; i < N; i++ {
+		if err := db.Set(key(i), val(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const readers = 8
+	var wg sync.WaitGroup
+
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+
+			for op := 0; op < 2000; op++ {
+				i := rng.Intn(N)
+
+				if op%10 == 0 {
+					kvs, err := db.Scan(key(i), "", 20)
+					if err != nil {
+						t.Errorf("Scan from %s failed: %v", key(i), err)
+						return
+					}
+					for j, kv := range kvs {
+						if i+j < N && (kv.Key != key(i+j) || !bytes.Equal(kv.Value, val(i+j))) {
+							t.Errorf("Scan from %s returned %s at %d", key(i), kv.Key, j)
+							return
+						}
+					}
+					continue
+				}
+
+				v, err := db.Get(key(i))
+				if err != nil {
+					t.Errorf("Get %s failed: %v", key(i), err)
+					return
+				}
+				if !bytes.Equal(v, val(i)) {
+					t.Errorf("Get %s returned the wrong value", key(i))
+					return
+				}
+			}
+		}(int64(r))
+	}
+
+	// Keys after every key the readers check, rewriting the existing ones
+	// with the same values splits and dirties the pages they read
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			if err := db.Set(fmt.Sprintf("new%05d", i), val(i)); err != nil {
+				t.Errorf("Set new%05d failed: %v", i, err)
+				return
+			}
+			if err := db.Set(key(i*2), val(i*2)); err != nil {
+				t.Errorf("Set %s failed: %v", key(i*2), err)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+
+	stats := db.CacheStats()
+	if stats.Evictions == 0 || stats.Misses == 0 {
+		t.Fatalf("Expected the readers to fault pages in, got %+v", stats)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r := verifyFile(t, testDBPath(cfg, "test_concurrent")); !r.OK() {
+		t.Fatalf("Expected no problems, got %v", r.Problems)
+	}
+}
+
+// Readers that miss on the same pages at once share a single read of each
+func TestConcurrentColdReads(t *testing.T) {
+	cfg := createTestDB(t, "test_cold_reads")
+	cfg.Durability = "none"
+
+	db, err := engine.Open("test_cold_reads", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		k := fmt.Sprintf("key%05d", i)
+		if err := db.Set(k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Slow reads make sure the readers pile up behind each other's loads
+	t.Cleanup(storage.SetReadDelay(2 * time.Millisecond))
+
+	// Every reader starts from an empty cache and walks the same keys
+	for round := 0; round < 5; round++ {
+		db, err := engine.Open("test_cold_reads", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for r := 0; r < 16; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				for i := 0; i < 2000; i += 37 {
+					k := fmt.Sprintf("key%05d", i)
+					v, err := db.Get(k)
+					if err != nil || string(v) != k {
+						t.Errorf("Get %s returned %s %v", k, v, err)
+						return
+					}
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		// Nothing was evicted so every page in the cache was read from the file once
+		stats := db.CacheStats()
+		if stats.Evictions != 0 || stats.Reads != uint64(stats.Pages) {
+			t.Fatalf("Expected %d pages read once each, got %+v", stats.Pages, stats)
+		}
+		if stats.Misses <= stats.Reads {
+			t.Fatalf("Expected readers to miss on pages being loaded, got %+v", stats)
+		}
+
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Run with -race. Small pages keep writers splitting and merging leaves and
+// internal pages while readers descend through them and cursors walk across
+// them in both directions. Every third key is never written so readers always
+// know what they should find
+func TestConcurrentSplitsAndMerges(t *testing.T) {
+	cfg := createTestDBWithPageSize(t, "test_latches", storage.MinPageSize)
+	cfg.CachePages = 32
+	cfg.Durability = "none"
+
+	db, err := engine.Open("test_latches", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys only differ at the end so separators stay long and internal pages
+	// split and merge as often as leaves
+	const N = 3000
+	pad := strings.Repeat("k", 180)
+	key := func(i int) string { return fmt.Sprintf("%s%05d", pad, i) }
+	stable := func(i int) bool { return i%3 == 0 }
+
+	for i := 0; i < N; i++ {
+		if err := db.Set(key(i), []byte(key(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every stable key between the first and last returned must be there, in order
+	checkRange := func(kvs []engine.KV, reverse bool) error {
+		for j := 1; j < len(kvs); j++ {
+			if (kvs[j-1].Key < kvs[j].Key) == reverse {
+				return fmt.Errorf("%s and %s out of order", kvs[j-1].Key, kvs[j].Key)
+			}
+		}
+
+		seen := make(map[string]bool)
+		for _, kv := range kvs {
+			seen[kv.Key] = true
+		}
+		if len(kvs) < 2 {
+			return nil
+		}
+
+		lo, hi := kvs[0].Key, kvs[len(kvs)-1].Key
+		if reverse {
+			lo, hi = hi, lo
+		}
+		for i := 0; i < N; i += 3 {
+			if key(i) > lo && key(i) < hi && !seen[key(i)] {
+				return fmt.Errorf("%s missing between %s and %s", key(i), lo, hi)
+			}
+		}
+		return nil
+	}
+
+	done := make(chan struct{})
+	var readers, writers sync.WaitGroup
+
+	for r := 0; r < 6; r++ {
+		readers.Add(1)
+		go func(seed int64) {
+			defer readers.Done()
+			rng := rand.New(rand.NewSource(seed))
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				i := rng.Intn(N/3) * 3
+				var err error
+				switch rng.Intn(3) {
+				case 0:
+					var v []byte
+					v, err = db.Get(key(i))
+					if err == nil && string(v) != key(i) {
+						err = fmt.Errorf("Get %s returned %q", key(i), v)
+					}
+				case 1:
+					var kvs []engine.KV
+					if kvs, err = db.Scan(key(i), "", 40); err == nil {
+						err = checkRange(kvs, false)
+					}
+				case 2:
+					var kvs []engine.KV
+					if kvs, err = db.ReverseScan("", key(i), 40); err == nil {
+						err = checkRange(kvs, true)
+					}
+				}
+
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(int64(r))
+	}
+
+	// Two single key writers and one writing batches, which take the whole tree
+	for w := 0; w < 3; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			rng := rand.New(rand.NewSource(int64(100 + w)))
+
+			for op := 0; op < 1500; op++ {
+				i := rng.Intn(N)
+				if stable(i) {
+					i++
+				}
+
+				// Some values spill into overflow chains
+				val := []byte(strings.Repeat("v", rng.Intn(1500)))
+
+				var err error
+				switch {
+				case w == 2:
+					b := db.NewWriteBatch()
+					for j := 0; j < 5; j++ {
+						if k := (i + j) % N; !stable(k) {
+							b.Set(key(k), val)
+						}
+					}
+					_, err = b.Write()
+				case rng.Intn(2) == 0:
+					err = db.Set(key(i), val)
+				default:
+					if err = db.Delete(key(i)); errors.Is(err, storage.ErrKeyNotFound) {
+						err = nil
+					}
+				}
+
+				if err != nil {
+					t.Errorf("Write %s failed: %v", key(i), err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	for i := 0; i < N; i += 3 {
+		if v, err := db.Get(key(i)); err != nil || string(v) != key(i) {
+			t.Fatalf("Get %s returned %q %v", key(i), v, err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := verifyFile(t, testDBPath(cfg, "test_latches"))
+	if !r.OK() {
+		t.Fatalf("Expected no problems, got %v", r.Problems)
+	}
+	if r.Depth < 3 {
+		t.Fatalf("Expected internal pages below the root, got depth %d", r.Depth)
+	}
+}
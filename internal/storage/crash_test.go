@@ -0,0 +1,278 @@
+package storage_test
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.store/internal/config"
+	"go.store/internal/engine"
+	"go.store/internal/storage"
+)
+
+// Crash recovery tests. A workload runs against a checkpointed database while
+// its WAL is captured, then the crash is simulated by replaying every prefix
+// of that WAL cut at a record boundary, i.e. the writer dying after each page
+// it logged. Every recovered tree has to match the state after the last
+// operation that finished before the cut
+
+// State of the model after an operation whose WAL frame ends at offset
+type crashPoint struct {
+	offset int64
+	state  map[string]string
+}
+
+type crashWorkload struct {
+	t      *testing.T
+	db     *engine.Database
+	model  map[string]string
+	points []crashPoint
+}
+
+// Record the model once the operation's frame is in the log
+func (w *crashWorkload) done() {
+	state := make(map[string]string, len(w.model))
+	for k, v := range w.model {
+		state[k] = v
+	}
+	w.points = append(w.points, crashPoint{offset: int64(w.db.WALStats().Bytes), state: state})
+}
+
+func (w *crashWorkload) set(k, v string) {
+	w.t.Helper()
+	if err := w.db.Set(k, []byte(v)); err != nil {
+		w.t.Fatalf("Set %s failed: %v", k, err)
+	}
+	w.model[k] = v
+	w.done()
+}
+
+func (w *crashWorkload) del(k string) {
+	w.t.Helper()
+	if err := w.db.Delete(k); err != nil {
+		w.t.Fatalf("Delete %s failed: %v", k, err)
+	}
+	delete(w.model, k)
+	w.done()
+}
+
+func crashValue(i, size int) string {
+	return strings.Repeat(fmt.Sprintf("%06d", i), size/6+1)[:size]
+}
+
+func TestCrashAtEveryPageBoundary(t *testing.T) {
+	cfg := createTestDB(t, "test_crash")
+	// The simulated crash copies the files, fsync has nothing to add here
+	cfg.Durability = "none"
+
+	db, err := engine.Open("test_crash", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Base data, checkpointed into the DB file on close. This leaves the root
+	// one leaf split away from being full
+	model := make(map[string]string)
+	for i := 0; i < 2300; i += 2 {
+		k := fmt.Sprintf("key%05d", i)
+		v := crashValue(i, 200)
+		if err := db.Set(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		model[k] = v
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = engine.Open("test_crash", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &crashWorkload{t: t, db: db, model: model}
+	w.done()
+
+	// Fill gaps with larger values so leaves split and the root splits and grows
+	for i := 1001; i < 1100; i += 2 {
+		w.set(fmt.Sprintf("key%05d", i), crashValue(i, 400))
+	}
+
+	// Values large enough to need overflow chains, then replace and delete them
+	w.set("key01100", crashValue(1100, 3*storage.DefaultPageSize))
+	w.set("key01100", crashValue(1101, 5*storage.DefaultPageSize))
+	w.set("key01200", crashValue(1200, 2*storage.DefaultPageSize))
+	w.del("key01200")
+
+	// A transaction that fails part way through leaves an unfinished frame behind
+	w.set("missing", "x")
+
+	failed := db.Begin()
+	for i := 0; i < 60; i++ {
+		failed.Set(fmt.Sprintf("tx%05d", i), []byte(crashValue(i, 100)))
+	}
+	failed.SetXX("missing", []byte("y"))
+	w.del("missing")
+	if err := failed.Commit(); err == nil {
+		t.Fatalf("Expected commit to fail")
+	}
+
+	// A transaction large enough to split several leaves in one frame
+	committed := db.Begin()
+	for i := 0; i < 60; i++ {
+		k := fmt.Sprintf("tx%05d", i)
+		committed.Set(k, []byte(crashValue(i, 100)))
+		w.model[k] = crashValue(i, 100)
+	}
+	if err := committed.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	w.done()
+
+	// Delete a run of keys so leaves borrow from and merge with their siblings
+	for i := 1000; i < 1150; i++ {
+		k := fmt.Sprintf("key%05d", i)
+		if _, ok := w.model[k]; ok {
+			w.del(k)
+		}
+	}
+
+	// Nothing is evicted so the DB file still holds the base data
+	base, err := os.ReadFile(testDBPath(cfg, "test_crash"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := os.ReadFile(testDBPath(cfg, "test_crash") + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every recovery reuses the same DB directory
+	crashCfg := createTestDB(t, "test_crash")
+	crashCfg.Durability = "none"
+
+	for _, cut := range walBoundaries(t, log) {
+		verifyCrash(t, crashCfg, base, log, cut, w.points)
+
+		// A torn end record has to discard the whole frame
+		if cut < int64(len(log)) && log[cut] == 2 {
+			verifyCrash(t, crashCfg, base, log, cut+storage.WALMarkerRecordSize/2, w.points)
+		}
+	}
+}
+
+// Offsets of every record boundary in the log, including an empty log and the end
+func walBoundaries(t *testing.T, log []byte) []int64 {
+	t.Helper()
+
+	cuts := []int64{0, storage.WALHeaderSize}
+	off := int64(storage.WALHeaderSize)
+
+	for off < int64(len(log)) {
+		switch log[off] {
+		case storage.WALRecordPage:
+			off += int64(storage.WALPageRecordSize)
+		case storage.WALRecordEnd, storage.WALRecordBegin:
+			off += storage.WALMarkerRecordSize
+		default:
+			t.Fatalf("Unknown WAL record kind %d at offset %d", log[off], off)
+		}
+		cuts = append(cuts, off)
+	}
+
+	if off != int64(len(log)) {
+		t.Fatalf("WAL ends part way through a record")
+	}
+	return cuts
+}
+
+// Recover the base DB file with the log cut at offset and compare it to the model
+func verifyCrash(t *testing.T, cfg *config.Config, base, log []byte, cut int64, points []crashPoint) {
+	t.Helper()
+
+	// The first point is the base data that is already in the DB file
+	want := points[0].state
+	for _, p := range points {
+		if p.offset > cut {
+			break
+		}
+		want = p.state
+	}
+
+	path := testDBPath(cfg, "test_crash")
+
+	if err := os.WriteFile(path, base, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path+".wal", log[:cut], 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := engine.Open("test_crash", cfg)
+	if err != nil {
+		t.Fatalf("cut=%d: open failed: %v", cut, err)
+	}
+	defer db.Close()
+
+	verifyContents(t, db, want, fmt.Sprintf("cut=%d", cut))
+
+	// The recovered tree must still accept writes
+	if err := db.Set("after-crash", []byte("x")); err != nil {
+		t.Fatalf("cut=%d: Set after recovery failed: %v", cut, err)
+	}
+	if err := db.Delete("after-crash"); err != nil {
+		t.Fatalf("cut=%d: Delete after recovery failed: %v", cut, err)
+	}
+}
+
+// Compare the tree to want walking the leaves in both directions
+func verifyContents(t *testing.T, db *engine.Database, want map[string]string, label string) {
+	t.Helper()
+
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	kvs, err := db.Scan("", "", 0)
+	if err != nil {
+		t.Fatalf("%s: Scan failed: %v", label, err)
+	}
+	if len(kvs) != len(keys) {
+		t.Fatalf("%s: expected %d keys, found %d", label, len(keys), len(kvs))
+	}
+	for i, kv := range kvs {
+		if kv.Key != keys[i] || string(kv.Value) != want[kv.Key] {
+			t.Fatalf("%s: key %d is %s, expected %s", label, i, kv.Key, keys[i])
+		}
+	}
+
+	rev, err := db.ReverseScan("", "", 0)
+	if err != nil {
+		t.Fatalf("%s: ReverseScan failed: %v", label, err)
+	}
+	if len(rev) != len(keys) {
+		t.Fatalf("%s: reverse scan found %d keys, expected %d", label, len(rev), len(keys))
+	}
+	for i, kv := range rev {
+		if kv.Key != keys[len(keys)-1-i] {
+			t.Fatalf("%s: reverse scan key %d is %s", label, i, kv.Key)
+		}
+	}
+
+	for i := 0; i < len(keys); i += 37 {
+		v, err := db.Get(keys[i])
+		if err != nil || string(v) != want[keys[i]] {
+			t.Fatalf("%s: Get %s failed: %v", label, keys[i], err)
+		}
+	}
+}
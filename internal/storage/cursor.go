@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Cursor walks the leaf level of the tree in key order using the sibling links.
+// Every movement latches the leaves it reads on its own so writers can run between
+// steps, if the tree was modified since the last step the cursor re-seeks from its key
+type Cursor struct {
+	bt      *BTree
+	leaf    uint32
+	idx     int
+	key     []byte
+	valid   bool
+	version uint64
+	err     error
+}
+
+func (bt *BTree) Cursor() *Cursor {
+	return &Cursor{
+		bt:   bt,
+		leaf: InvalidPage,
+	}
+}
+
+func (c *Cursor) Valid() bool {
+	return c.valid
+}
+
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Key at the current position, only valid until the next movement
+func (c *Cursor) Key() []byte {
+	return c.key
+}
+
+func (c *Cursor) Value() ([]byte, error) {
+	if !c.valid {
+		return nil, ErrKeyNotFound
+	}
+
+	c.bt.pager.write.RLock()
+	defer c.bt.pager.write.RUnlock()
+
+	cp, idx, exact, err := c.reposition()
+	if err != nil {
+		return nil, err
+	}
+	defer c.bt.pager.unlatch(cp, false)
+
+	if !exact {
+		return nil, ErrKeyNotFound
+	}
+
+	leaf := WrapLeafPage(cp.page)
+	return c.bt.readValue(leaf, leaf.GetCellPointer(idx))
+}
+
+// Position the cursor on the first key >= key
+func (c *Cursor) Seek(key []byte) bool {
+	c.bt.pager.write.RLock()
+	defer c.bt.pager.write.RUnlock()
+
+	return c.forward(func() (*cachedPage, int, error) {
+		cp, err := c.bt.latchLeaf(childFor(key), false)
+		if err != nil {
+			return nil, 0, err
+		}
+		return cp, WrapLeafPage(cp.page).FindInsertIndex(key), nil
+	})
+}
+
+func (c *Cursor) First() bool {
+	c.bt.pager.write.RLock()
+	defer c.bt.pager.write.RUnlock()
+
+	return c.forward(func() (*cachedPage, int, error) {
+		cp, err := c.bt.latchLeaf(edgeChild(false), false)
+		return cp, 0, err
+	})
+}
+
+func (c *Cursor) Last() bool {
+	c.bt.pager.write.RLock()
+	defer c.bt.pager.write.RUnlock()
+
+	return c.backward(func() (*cachedPage, int, error) {
+		cp, err := c.bt.latchLeaf(edgeChild(true), false)
+		if err != nil {
+			return nil, 0, err
+		}
+		return cp, WrapLeafPage(cp.page).GetNumCells() - 1, nil
+	})
+}
+
+func (c *Cursor) Next() bool {
+	if !c.valid {
+		return false
+	}
+
+	c.bt.pager.write.RLock()
+	defer c.bt.pager.write.RUnlock()
+
+	return c.forward(func() (*cachedPage, int, error) {
+		cp, idx, exact, err := c.reposition()
+
+		// If our key was deleted idx already points at the next larger key
+		if exact {
+			idx++
+		}
+		return cp, idx, err
+	})
+}
+
+func (c *Cursor) Prev() bool {
+	if !c.valid {
+		return false
+	}
+
+	c.bt.pager.write.RLock()
+	defer c.bt.pager.write.RUnlock()
+
+	return c.backward(func() (*cachedPage, int, error) {
+		cp, idx, _, err := c.reposition()
+		return cp, idx - 1, err
+	})
+}
+
+// Find and latch the leaf / index of the current key, reusing the cached
+// position if nothing has been written since we last moved
+func (c *Cursor) reposition() (*cachedPage, int, bool, error) {
+	if c.leaf != InvalidPage && c.version == c.bt.version.Load() {
+		cp, err := c.bt.pager.latch(c.leaf, false)
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		// A write may have finished while we waited for the latch
+		if c.version == c.bt.version.Load() {
+			return cp, c.idx, true, nil
+		}
+		c.bt.pager.unlatch(cp, false)
+	}
+
+	cp, err := c.bt.latchLeaf(childFor(c.key), false)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	leaf := WrapLeafPage(cp.page)
+	idx := leaf.FindInsertIndex(c.key)
+	exact := idx < leaf.GetNumCells() && bytes.Equal(leaf.ReadKey(leaf.GetCellPointer(idx)), c.key)
+	return cp, idx, exact, nil
+}
+
+// A sibling link changed while the cursor was between two leaves
+var errStaleLink = errors.New("stale sibling link")
+
+// Settle on the first key at or after the position seek latches, following
+// next links past the end of a leaf. Seeks again if a link goes stale
+func (c *Cursor) forward(seek func() (*cachedPage, int, error)) bool {
+	for {
+		cp, idx, err := seek()
+		for err == nil && cp != nil && idx >= WrapLeafPage(cp.page).GetNumCells() {
+			cp, err = c.step(cp, WrapLeafPage(cp.page).GetNext())
+			idx = 0
+		}
+
+		if errors.Is(err, errStaleLink) {
+			continue
+		}
+		return c.land(cp, idx, err)
+	}
+}
+
+// Settle on the last key at or before the position seek latches, following
+// prev links past the start of a leaf. Seeks again if a link goes stale
+func (c *Cursor) backward(seek func() (*cachedPage, int, error)) bool {
+	for {
+		cp, idx, err := seek()
+		for err == nil && cp != nil && idx < 0 {
+			cp, err = c.step(cp, WrapLeafPage(cp.page).GetPrev())
+			if cp != nil {
+				idx = WrapLeafPage(cp.page).GetNumCells() - 1
+			}
+		}
+
+		if errors.Is(err, errStaleLink) {
+			continue
+		}
+		return c.land(cp, idx, err)
+	}
+}
+
+// Let go of cp and latch its neighbour id, nil at either end of the tree.
+// Holding one leaf at a time means a writer changing both never waits on us,
+// but the link can go stale in between. A write that changed it has bumped the
+// version by the time we get the neighbour, and one that hasn't finished can't
+// have touched the neighbour since we hold it
+func (c *Cursor) step(cp *cachedPage, id uint32) (*cachedPage, error) {
+	version := c.bt.version.Load()
+	c.bt.pager.unlatch(cp, false)
+
+	if id == InvalidPage {
+		return nil, nil
+	}
+
+	next, err := c.bt.pager.latch(id, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.bt.version.Load() != version {
+		c.bt.pager.unlatch(next, false)
+		return nil, errStaleLink
+	}
+	return next, nil
+}
+
+func (c *Cursor) land(cp *cachedPage, idx int, err error) bool {
+	switch {
+	case err != nil:
+		return c.fail(err)
+	case cp == nil:
+		return c.invalidate()
+	}
+
+	defer c.bt.pager.unlatch(cp, false)
+	return c.settle(WrapLeafPage(cp.page), idx)
+}
+
+func (c *Cursor) settle(leaf *LeafPage, idx int) bool {
+	c.leaf = leaf.Page.ID
+	c.idx = idx
+	c.key = append(c.key[:0], leaf.ReadKey(leaf.GetCellPointer(idx))...)
+	c.version = c.bt.version.Load()
+	c.valid = true
+	return true
+}
+
+func (c *Cursor) invalidate() bool {
+	c.leaf = InvalidPage
+	c.valid = false
+	return false
+}
+
+func (c *Cursor) fail(err error) bool {
+	c.err = err
+	return c.invalidate()
+}
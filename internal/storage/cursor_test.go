@@ -0,0 +1,143 @@
+package storage_test
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCursorForwardAndBackward(t *testing.T) {
+	tree := openTestTree(t, "test_cursor")
+
+	const N = 5000
+
+	// Insert out of order so leaves are split all over the tree
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", (i*7919)%N)
+		if _, err := tree.Insert([]byte(k), []byte(k)); err != nil {
+			t.Fatalf("Insert %s failed: %v", k, err)
+		}
+	}
+
+	c := tree.Cursor()
+	i := 0
+	for ok := c.First(); ok; ok = c.Next() {
+		want := fmt.Sprintf("%08d", i)
+		if string(c.Key()) != want {
+			t.Fatalf("Forward: expected %s got %s", want, c.Key())
+		}
+		i++
+	}
+	if i != N {
+		t.Fatalf("Forward: expected %d keys got %d", N, i)
+	}
+
+	i = N - 1
+	for ok := c.Last(); ok; ok = c.Prev() {
+		want := fmt.Sprintf("%08d", i)
+		if string(c.Key()) != want {
+			t.Fatalf("Backward: expected %s got %s", want, c.Key())
+		}
+		i--
+	}
+	if i != -1 {
+		t.Fatalf("Backward: stopped early at %d", i)
+	}
+
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func TestCursorSurvivesDeletes(t *testing.T) {
+	tree := openTestTree(t, "test_cursor_delete")
+
+	const N = 5000
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		if _, err := tree.Insert([]byte(k), []byte("x")); err != nil {
+			t.Fatalf("Insert %s failed: %v", k, err)
+		}
+	}
+
+	// Delete the successor of every key while walking, merges must keep the sibling links intact
+	c := tree.Cursor()
+	for ok := c.First(); ok; ok = c.Next() {
+		var i int
+		fmt.Sscanf(string(c.Key()), "%d", &i)
+
+		if i+1 < N {
+			next := fmt.Sprintf("%08d", i+1)
+			if err := tree.Delete([]byte(next)); err != nil {
+				t.Fatalf("Delete %s failed: %v", next, err)
+			}
+		}
+	}
+
+	i := 0
+	for ok := c.First(); ok; ok = c.Next() {
+		if i%2 == 1 {
+			i++
+		}
+		want := fmt.Sprintf("%08d", i)
+		if string(c.Key()) != want {
+			t.Fatalf("Expected %s got %s", want, c.Key())
+		}
+		i++
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func TestScanRange(t *testing.T) {
+	db := openTestDB(t, "test_scan")
+
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("%04d", i)
+		if err := db.Set(k, []byte(k)); err != nil {
+			t.Fatalf("Set %s failed: %v", k, err)
+		}
+	}
+
+	kvs, err := db.Scan("0100", "0200", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 100 || kvs[0].Key != "0100" || kvs[99].Key != "0199" {
+		t.Fatalf("Unexpected range result: %d keys", len(kvs))
+	}
+
+	kvs, err = db.Scan("0990", "", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 5 || kvs[4].Key != "0994" || string(kvs[4].Value) != "0994" {
+		t.Fatalf("Unexpected limited scan result: %v", kvs)
+	}
+
+	kvs, err = db.ReverseScan("0100", "0200", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 3 || kvs[0].Key != "0199" || kvs[2].Key != "0197" {
+		t.Fatalf("Unexpected reverse scan result: %v", kvs)
+	}
+
+	kvs, err = db.ReverseScan("0998", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 2 || kvs[0].Key != "0999" || kvs[1].Key != "0998" {
+		t.Fatalf("Unexpected unbounded reverse scan result: %v", kvs)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
@@ -1,6 +1,13 @@
 package storage
 
+import "bytes"
+
 func (bt *BTree) deleteFromLeaf(leaf *LeafPage, key []byte) (bool, error) {
+	idx := leaf.FindInsertIndex(key)
+	if idx < leaf.GetNumCells() && bytes.Equal(leaf.ReadKey(leaf.GetCellPointer(idx)), key) {
+		bt.freeValue(leaf, leaf.GetCellPointer(idx))
+	}
+
 	if err := leaf.Delete(key); err != nil {
 		return false, err
 	}
@@ -9,7 +16,7 @@ func (bt *BTree) deleteFromLeaf(leaf *LeafPage, key []byte) (bool, error) {
 		return false, err
 	}
 
-	if leaf.Page.ID == bt.root || leaf.GetSpaceUsed() >= PageSize/2 {
+	if leaf.Page.ID == bt.root.Load() || leaf.GetSpaceUsed() >= bt.pager.pageSize/2 {
 		return false, nil
 	}
 
@@ -18,8 +25,8 @@ func (bt *BTree) deleteFromLeaf(leaf *LeafPage, key []byte) (bool, error) {
 
 func (bt *BTree) shrinkRoot(root *InternalPage) error {
 	if root.GetNumKeys() == 0 {
-		onlyChild := root.GetChild(0)
-		bt.root = onlyChild
+		onlyChild := root.GetRightChild()
+		bt.root.Store(onlyChild)
 		bt.meta.SetRootID(onlyChild)
 		bt.FreePage(root.Page.ID)
 	}
@@ -34,13 +41,14 @@ func (bt *BTree) propogateDelete(stack *ParentStack, childID uint32) error {
 			return nil
 		}
 
-		parentPage, err := bt.pager.ReadPage(parentInfo.pageID)
+		// Both were latched on the way down
+		parentPage, err := bt.modify(parentInfo.pageID)
 		if err != nil {
 			return err
 		}
 		parent := WrapInternalPage(parentPage)
 
-		childPage, err := bt.pager.ReadPage(childID)
+		childPage, err := bt.modify(childID)
 		if err != nil {
 			return err
 		}
@@ -64,7 +72,13 @@ func (bt *BTree) propogateDelete(stack *ParentStack, childID uint32) error {
 			continue
 		}
 
+		// Like leaves, an internal page only looks to its siblings once it is
+		// less than half full
 		internal := WrapInternalPage(childPage)
+		if internal.GetSpaceUsed() >= bt.pager.pageSize/2 {
+			return nil
+		}
+
 		idx := bt.findChildIndex(parent, childID)
 
 		merged, err := bt.rebalanceInternal(internal, parent, idx, childID)
@@ -78,22 +92,54 @@ func (bt *BTree) propogateDelete(stack *ParentStack, childID uint32) error {
 
 		childID = parent.Page.ID
 
-		if childID == bt.root {
+		if childID == bt.root.Load() {
 			return bt.shrinkRoot(parent)
 		}
 	}
 }
 
 func (bt *BTree) Delete(key []byte) error {
+	return bt.updateLatched(func() error {
+		return bt.deleteLatched(key)
+	})
+}
+
+// Like putLatched, a delete that leaves its leaf at least half full only
+// latches the leaf and anything else starts again from the root
+func (bt *BTree) deleteLatched(key []byte) error {
+	cp, err := bt.latchLeaf(childFor(key), true)
+	if err != nil {
+		return err
+	}
+	leaf := WrapLeafPage(cp.page)
+
+	safe := bt.deleteSafe(key)
+	if safe(leaf.Page) {
+		prop, err := bt.deleteFromLeaf(leaf, key)
+		if err == nil && prop {
+			return errUnsafeLeaf(leaf.Page.ID)
+		}
+		return err
+	}
+	bt.latches.release(leaf.Page.ID)
 
-	bt.pager.write.Lock()
-	defer bt.pager.write.Unlock()
+	leaf, stack, err := bt.descendExclusive(key, safe)
+	if err != nil {
+		return err
+	}
+	return bt.deleteFrom(leaf, stack, key)
+}
 
+// Caller must hold pager.write exclusively
+func (bt *BTree) deleteLocked(key []byte) error {
 	leaf, stack, err := bt.descend(key)
 	if err != nil {
 		return err
 	}
+	return bt.deleteFrom(leaf, stack, key)
+}
 
+func (bt *BTree) deleteFrom(leaf *LeafPage, stack *ParentStack, key []byte) error {
 	prop, err := bt.deleteFromLeaf(leaf, key)
 	if err != nil {
 		return err
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Durability decides when a write's WAL records are fsynced
+type Durability int
+
+const (
+	// fsync before every write returns
+	DurabilityAlways Durability = iota
+	// Batch concurrent writers into one fsync per commit window
+	DurabilityGroup
+	// Never fsync on commit, a crash can lose recently acknowledged writes
+	DurabilityNone
+)
+
+const DefaultCommitWindow = 2 * time.Millisecond
+
+func ParseDurability(s string) (Durability, error) {
+	switch strings.ToLower(s) {
+	case "", "always":
+		return DurabilityAlways, nil
+	case "group":
+		return DurabilityGroup, nil
+	case "none":
+		return DurabilityNone, nil
+	default:
+		return DurabilityAlways, fmt.Errorf("invalid durability mode %q (always, group, none)", s)
+	}
+}
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityGroup:
+		return "group"
+	case DurabilityNone:
+		return "none"
+	default:
+		return "always"
+	}
+}
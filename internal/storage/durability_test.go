@@ -0,0 +1,155 @@
+package storage_test
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"go.store/internal/config"
+	"go.store/internal/engine"
+	"go.store/internal/storage"
+)
+
+func TestDurabilityModes(t *testing.T) {
+	const N = 50
+
+	for _, mode := range []string{"always", "group", "none"} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := createTestDB(t, "test_durability")
+			cfg.Durability = mode
+
+			db, err := engine.Open("test_durability", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < N; i++ {
+				k := fmt.Sprintf("key%03d", i)
+				if err := db.Set(k, []byte(k)); err != nil {
+					t.Fatalf("Set %s failed: %v", k, err)
+				}
+			}
+
+			stats := db.WALStats()
+			if stats.Durability.String() != mode {
+				t.Fatalf("Expected durability %s, got %s", mode, stats.Durability)
+			}
+
+			switch mode {
+			case "always":
+				if stats.Syncs < N {
+					t.Fatalf("Expected at least one fsync per write, got %d for %d writes", stats.Syncs, N)
+				}
+			case "group":
+				if stats.Syncs == 0 {
+					t.Fatalf("Expected group commit to fsync")
+				}
+			case "none":
+				if stats.Syncs != 0 {
+					t.Fatalf("Expected no fsyncs, got %d", stats.Syncs)
+				}
+			}
+
+			// Acknowledged writes must be in the WAL even if we crash right now
+			crashCfg := createTestDB(t, "test_durability")
+			copyFile(t, testDBPath(cfg, "test_durability"), testDBPath(crashCfg, "test_durability"))
+			copyFile(t, testDBPath(cfg, "test_durability")+".wal", testDBPath(crashCfg, "test_durability")+".wal")
+
+			if err := db.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+
+			crashed, err := engine.Open("test_durability", crashCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < N; i++ {
+				k := fmt.Sprintf("key%03d", i)
+				v, err := crashed.Get(k)
+				if err != nil {
+					t.Fatalf("Get %s after replay failed: %v", k, err)
+				}
+				if !bytes.Equal(v, []byte(k)) {
+					t.Fatalf("Get %s after replay returned %s", k, v)
+				}
+			}
+
+			if err := crashed.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestGroupCommitBatchesFsyncs(t *testing.T) {
+	cfg := createTestDB(t, "test_group_commit")
+	cfg.Databases = map[string]config.DatabaseConfig{
+		"test_group_commit": {Durability: "group", CommitWindow: 5 * time.Millisecond},
+	}
+
+	db, err := engine.Open("test_group_commit", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 16
+	const perWriter = 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				k := fmt.Sprintf("w%02d-%03d", w, i)
+				if err := db.Set(k, []byte(k)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Concurrent Set failed: %v", err)
+	}
+
+	stats := db.WALStats()
+	if stats.Durability != storage.DurabilityGroup {
+		t.Fatalf("Expected the per database override to select group commit, got %s", stats.Durability)
+	}
+	if stats.Syncs == 0 || stats.Syncs >= writers*perWriter {
+		t.Fatalf("Expected concurrent writers to share fsyncs, got %d fsyncs for %d writes", stats.Syncs, writers*perWriter)
+	}
+
+	kvs, err := db.Scan("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != writers*perWriter {
+		t.Fatalf("Expected %d keys, got %d", writers*perWriter, len(kvs))
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func TestParseDurability(t *testing.T) {
+	for _, s := range []string{"always", "GROUP", "none", ""} {
+		if _, err := storage.ParseDurability(s); err != nil {
+			t.Fatalf("ParseDurability(%q) failed: %v", s, err)
+		}
+	}
+
+	if _, err := storage.ParseDurability("sometimes"); err == nil {
+		t.Fatalf("Expected an invalid mode to be rejected")
+	}
+}
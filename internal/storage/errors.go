@@ -1,6 +1,9 @@
 package storage
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// btree
@@ -8,15 +11,37 @@ var (
 	ErrCorruptTree  = errors.New("btree is corrupt")
 	ErrSiblingEmpty = errors.New("sibling empty")
 	ErrPageOverflow = errors.New("operation cause page overflow")
+	ErrKeyTooLarge  = errors.New("key exceeds maximum key size")
+	ErrUnsorted     = errors.New("keys are not in increasing order")
+	// snapshots
+	ErrSnapshotReleased = errors.New("snapshot has been released")
 	// pager
 	ErrCorruptFile       = errors.New("file is corrupt")
 	ErrCorruptFreeList   = errors.New("free list is corrupt")
 	ErrInvalidPointer    = errors.New("invalid page pointer")
 	ErrInvalidFileSig    = errors.New("invalid file signature")
 	ErrWriteSizeMismatch = errors.New("data written does not match page size")
+	ErrUpgradeRequired   = errors.New("database must be upgraded to the current format")
+	ErrFormatTooNew      = errors.New("database format is newer than this release supports")
+	ErrDatabaseNotEmpty  = errors.New("database is not empty")
 	// pages
-	ErrKeyExists = errors.New("key already exists")
-	ErrPageFull  = errors.New("not enough space to write record")
+	ErrCorruptOverflow = errors.New("overflow chain is corrupt")
+	ErrKeyExists       = errors.New("key already exists")
+	ErrKeyNotFound     = errors.New("key not found")
+	// Deletes keep the message they have always reported
+	ErrDeleteMissingKey = fmt.Errorf("Key does not exist: %w", ErrKeyNotFound)
+	ErrPageFull         = errors.New("not enough space to write record")
 	// wal
 	ErrChecksumMismatch = errors.New("checksum does not match")
+	ErrWALMismatch      = errors.New("WAL does not match database")
+	ErrInvalidPageSize  = errors.New("invalid page size")
 )
+
+// ErrCorruptPage is returned when a page read from the DB file fails its checksum
+type ErrCorruptPage struct {
+	PageID uint32
+}
+
+func (e *ErrCorruptPage) Error() string {
+	return fmt.Sprintf("page %d is corrupt: %v", e.PageID, ErrChecksumMismatch)
+}
@@ -0,0 +1,22 @@
+package storage
+
+import "time"
+
+// SetReadDelay slows every page read from a file by d until the returned func is called
+func SetReadDelay(d time.Duration) func() {
+	readDelay = d
+	return func() { readDelay = 0 }
+}
+
+// WAL layout for tests that cut or rewrite logs at record boundaries
+const (
+	WALHeaderSize       = walHeaderSize
+	WALRecordHeaderSize = walRecordHeaderSize
+	WALMarkerRecordSize = walMarkerRecordSize
+
+	WALRecordPage  = walRecordPage
+	WALRecordEnd   = walRecordEnd
+	WALRecordBegin = walRecordBegin
+)
+
+var WALPageRecordSize = walPageRecordSize(DefaultPageSize)
@@ -3,15 +3,10 @@ package storage_test
 import (
 	"fmt"
 	"testing"
-
-	"go.store/internal/engine"
 )
 
 func TestFreePage(t *testing.T) {
-	db, err := engine.Open("TestPageAllocation.db")
-	if err != nil {
-		t.Fatal(err)
-	}
+	db := openTestDB(t, "TestPageAllocation")
 
 	const N = 10000
 
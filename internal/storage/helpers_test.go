@@ -0,0 +1,87 @@
+package storage_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.store/internal/config"
+	"go.store/internal/engine"
+	"go.store/internal/logger"
+	"go.store/internal/storage"
+)
+
+// Create a fresh database inside a temporary GoStore home and open it
+func openTestDB(t *testing.T, dbname string) *engine.Database {
+	t.Helper()
+
+	cfg := createTestDB(t, dbname)
+
+	db, err := engine.Open(dbname, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Create a fresh database inside a temporary GoStore home and return its config
+func createTestDB(t testing.TB, dbname string) *config.Config {
+	t.Helper()
+	return createTestDBWithPageSize(t, dbname, storage.DefaultPageSize)
+}
+
+func createTestDBWithPageSize(t testing.TB, dbname string, pageSize int) *config.Config {
+	t.Helper()
+	return createTestDBWithOptions(t, dbname, storage.CreateOptions{PageSize: pageSize})
+}
+
+func createTestDBWithOptions(t testing.TB, dbname string, opts storage.CreateOptions) *config.Config {
+	t.Helper()
+
+	home := t.TempDir()
+	cfg := &config.Config{
+		Home:    home,
+		DataDir: filepath.Join(home, "data"),
+		LogDir:  filepath.Join(home, "log"),
+	}
+
+	dbDir := filepath.Join(cfg.DataDir, dbname)
+	if err := os.MkdirAll(dbDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(cfg.LogDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := storage.CreateDatabaseWithOptions(testDBPath(cfg, dbname), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	return cfg
+}
+
+func testDBPath(cfg *config.Config, dbname string) string {
+	return filepath.Join(cfg.DataDir, dbname, dbname+".db")
+}
+
+// Open the B+Tree of a fresh database directly, bypassing the engine
+func openTestTree(t *testing.T, dbname string) *storage.BTree {
+	t.Helper()
+
+	cfg := createTestDB(t, dbname)
+	log := logger.New(io.Discard, logger.ERROR)
+
+	pager, err := storage.Open(testDBPath(cfg, dbname), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := storage.NewBTree(pager, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
@@ -5,27 +5,67 @@ import (
 	"errors"
 )
 
-func (bt *BTree) insertIntoLeaf(leaf *LeafPage, key, val []byte) (bool, []byte, uint32, error) {
+// PutMode controls how Put treats a key that is already in the tree
+type PutMode int
+
+const (
+	// Insert the key or replace the existing value
+	PutUpsert PutMode = iota
+	// Only insert if the key is not already present (SETNX)
+	PutIfAbsent
+	// Only replace the value if the key is already present (SETXX)
+	PutIfPresent
+)
+
+func (bt *BTree) insertIntoLeaf(leaf *LeafPage, key, val []byte, mode PutMode) (bool, []byte, uint32, error) {
+	idx := leaf.FindInsertIndex(key)
+	exists := idx < leaf.GetNumCells() && bytes.Equal(leaf.ReadKey(leaf.GetCellPointer(idx)), key)
+
+	switch {
+	case exists && mode == PutIfAbsent:
+		return false, nil, 0, ErrKeyExists
+	case !exists && mode == PutIfPresent:
+		return false, nil, 0, ErrKeyNotFound
+	}
+
+	// Drop the old record first so the new value can reuse its space,
+	// if it still doesn't fit we fall through to a normal split
+	if exists {
+		bt.freeValue(leaf, leaf.GetCellPointer(idx))
+		if err := leaf.Delete(key); err != nil {
+			return false, nil, 0, err
+		}
+	}
+
+	r := rec{key: key, val: val}
+	if bt.needsOverflow(key, val) {
+		first, err := bt.writeOverflow(val)
+		if err != nil {
+			return false, nil, 0, err
+		}
+		r = rec{key: key, val: encodeOverflowPointer(uint32(len(val)), first), overflow: true}
+	}
+
 	// First try and insert the key, val into the leafpage
-	if err := leaf.Insert(key, val); err == nil {
+	if err := leaf.insertRec(r); err == nil {
 		return true, nil, 0, bt.writePage(leaf.Page)
 	} else if errors.Is(err, ErrKeyExists) {
 		return false, nil, 0, err
 	}
 
 	// If we get any other error it means the page is full and we have to split
-	sepKey, rightPageID := bt.splitLeaf(leaf)
+	sepKey, rightPageID := bt.splitLeaf(leaf, key)
 
 	// Now decide which leaf to insert the value into after the split
 	var err error
-	if bytes.Compare(key, sepKey) <= 0 {
+	if bytes.Compare(key, sepKey) < 0 {
 		// There is always space after a split
-		_ = leaf.Insert(key, val)
+		_ = leaf.insertRec(r)
 		err = bt.writePage(leaf.Page)
 	} else {
 		right, _ := bt.pager.ReadPage(rightPageID)
 		rleaf := WrapLeafPage(right)
-		_ = rleaf.Insert(key, val)
+		_ = rleaf.insertRec(r)
 		err = bt.writePage(rleaf.Page)
 	}
 
@@ -48,7 +88,8 @@ func (bt *BTree) propogateSplit(
 			return bt.growRoot(sepKey, leftID, rightID)
 		}
 
-		page, err := bt.pager.ReadPage(parent.pageID)
+		// Already latched on the way down
+		page, err := bt.modify(parent.pageID)
 		if err != nil {
 			return false, err
 		}
@@ -81,18 +122,72 @@ func (bt *BTree) propogateSplit(
 	}
 }
 
-// Entry point into insertion logic
+// Entry point into insertion logic - fails with ErrKeyExists if the key is present
 func (bt *BTree) Insert(key, val []byte) (bool, error) {
+	return bt.put(key, val, PutIfAbsent)
+}
 
-	bt.pager.write.Lock()
-	defer bt.pager.write.Unlock()
+// Put writes a key / value pair according to mode, replacing values in place
+// when the key already exists
+func (bt *BTree) Put(key, val []byte, mode PutMode) error {
+	_, err := bt.put(key, val, mode)
+	return err
+}
+
+func (bt *BTree) put(key, val []byte, mode PutMode) (bool, error) {
+	var inserted bool
+	err := bt.updateLatched(func() (err error) {
+		inserted, err = bt.putLatched(key, val, mode)
+		return err
+	})
+	return inserted, err
+}
+
+// Most writes fit in their leaf and only latch that. One that could split it
+// starts again from the root, latching everything the split can reach
+func (bt *BTree) putLatched(key, val []byte, mode PutMode) (bool, error) {
+	if len(key) > MaxKeySize {
+		return false, ErrKeyTooLarge
+	}
+
+	cp, err := bt.latchLeaf(childFor(key), true)
+	if err != nil {
+		return false, err
+	}
+	leaf := WrapLeafPage(cp.page)
+
+	if bt.leafFits(leaf, key, val) {
+		inserted, sepKey, _, err := bt.insertIntoLeaf(leaf, key, val, mode)
+		if err == nil && sepKey != nil {
+			return false, errUnsafeLeaf(leaf.Page.ID)
+		}
+		return inserted, err
+	}
+	bt.latches.release(leaf.Page.ID)
+
+	leaf, stack, err := bt.descendExclusive(key, bt.insertSafe(key, val))
+	if err != nil {
+		return false, err
+	}
+	return bt.putInto(leaf, stack, key, val, mode)
+}
+
+// Caller must hold pager.write exclusively
+func (bt *BTree) putLocked(key, val []byte, mode PutMode) (bool, error) {
+	// Values can spill into overflow pages but keys must always fit inline
+	if len(key) > MaxKeySize {
+		return false, ErrKeyTooLarge
+	}
 
 	leaf, parentStack, err := bt.descend(key)
 	if err != nil {
 		return false, err
 	}
+	return bt.putInto(leaf, parentStack, key, val, mode)
+}
 
-	inserted, sepKey, rightPageID, err := bt.insertIntoLeaf(leaf, key, val)
+func (bt *BTree) putInto(leaf *LeafPage, parentStack *ParentStack, key, val []byte, mode PutMode) (bool, error) {
+	inserted, sepKey, rightPageID, err := bt.insertIntoLeaf(leaf, key, val, mode)
 	if err != nil {
 		return false, err
 	}
@@ -10,13 +10,28 @@ type InternalPage struct {
 	Page *Page
 }
 
+// Internal pages are laid out like leaves, a cell pointer array grows from the
+// header and cells grow down from the end of the page. Cell i holds child i and
+// the separator key to its right, the last child is kept in the header
+//
+// Cell
+// Child: uint32
+// Key Length: uint16
+// Key: []byte
+//
+// Fanout depends only on how many keys fit, short keys give wide shallow trees
 const (
-	numKeysOffset    int = 1
-	rChildOffset     int = 7
-	childStartOffset int = 11
-	keyPointerOffset     = childStartOffset + (maxChildren * 4)
+	numKeysOffset      int = pageHeaderSize
+	rChildOffset       int = pageHeaderSize + 6
+	internalDataStart  int = pageHeaderSize + 10
+	internalCellHeader int = 6
 )
 
+// Bytes a separator takes up in an internal page including its cell pointer
+func internalCellSize(key []byte) int {
+	return internalCellHeader + len(key) + 2
+}
+
 func NewInternalPage(page *Page) *InternalPage {
 	pType := byte(PageTypeInternal)
 
@@ -24,10 +39,10 @@ func NewInternalPage(page *Page) *InternalPage {
 	binary.LittleEndian.PutUint16(nKeys[:], uint16(0))
 
 	var fStart [2]byte
-	binary.LittleEndian.PutUint16(fStart[:], uint16(keyPointerOffset))
+	binary.LittleEndian.PutUint16(fStart[:], uint16(internalDataStart))
 
 	var fEnd [2]byte
-	binary.LittleEndian.PutUint16(fEnd[:], uint16(PageSize))
+	binary.LittleEndian.PutUint16(fEnd[:], uint16(len(page.Data)))
 
 	var rChild [4]byte
 	binary.LittleEndian.PutUint32(rChild[:], uint32(0))
@@ -66,8 +81,7 @@ func (ip *InternalPage) GetFreeStart() int {
 
 func (ip *InternalPage) GetFreeEnd() int {
 	raw := ip.Page.Data[endOffset : endOffset+2]
-	n := int(binary.LittleEndian.Uint16(raw))
-	return n
+	return decodeFreeEnd(binary.LittleEndian.Uint16(raw), len(ip.Page.Data))
 }
 
 func (ip *InternalPage) GetRightChild() uint32 {
@@ -77,20 +91,28 @@ func (ip *InternalPage) GetRightChild() uint32 {
 }
 
 func (ip *InternalPage) GetChild(i int) uint32 {
-	off := childStartOffset + (i * 4)
+	off := int(ip.GetKeyPointer(i))
 	raw := ip.Page.Data[off : off+4]
 
 	return binary.LittleEndian.Uint32(raw)
 }
 
 func (ip *InternalPage) GetKeyPointer(i int) uint16 {
-	off := keyPointerOffset + (i * 2)
+	off := internalDataStart + (i * 2)
 	raw := ip.Page.Data[off : off+2]
 	return binary.LittleEndian.Uint16(raw)
 }
 
+func (ip *InternalPage) GetKey(i int) []byte {
+	return ip.ReadKey(ip.GetKeyPointer(i))
+}
+
 func (ip *InternalPage) GetSpaceUsed() int {
-	return ip.GetFreeStart() + (PageSize - ip.GetFreeEnd())
+	return ip.GetFreeStart() + (len(ip.Page.Data) - ip.GetFreeEnd())
+}
+
+func (ip *InternalPage) GetFreeSpace() int {
+	return ip.GetFreeEnd() - ip.GetFreeStart()
 }
 
 // SETTERS
@@ -123,68 +145,25 @@ func (ip *InternalPage) SetRightChild(n uint32) {
 }
 
 func (ip *InternalPage) SetChild(i int, ptr uint32) {
-	if i >= maxChildren {
-		panic("SetChild: index greater than maxChildren")
+	if i >= ip.GetNumKeys() {
+		panic(fmt.Sprintf("SetChild: index %d out of range (%d)", i, ip.GetNumKeys()))
 	}
 
 	var cPtr [4]byte
 	binary.LittleEndian.PutUint32(cPtr[:], uint32(ptr))
 
-	off := childStartOffset + (i * 4)
+	off := int(ip.GetKeyPointer(i))
 	copy(ip.Page.Data[off:off+4], cPtr[:])
 }
 
-// This is not as efficient as it could be - but we can edit it after debugging
-func (ip *InternalPage) InsertChildPointer(idx int, childPageID uint32) {
-	n := ip.GetNumKeys()
-
-	if n+2 > maxChildren {
-		panic(fmt.Sprintf("InsertChildPointer: max children exceeded"))
-	}
-
-	if idx < 0 || idx > n+1 {
-		panic(fmt.Sprintf("InsertChildPointer: index %d out of range (%d)", idx, n+1))
-	}
-
-	if idx < n {
-		for j := n - 1; j >= idx; j-- {
-			ip.SetChild(j+1, ip.GetChild(j))
-		}
-		ip.SetChild(idx, childPageID)
-		return
-	}
-
-	if idx == n {
-		ip.SetChild(n, childPageID)
-		return
-	}
-
-	ip.SetChild(n, ip.GetRightChild())
-	ip.SetRightChild(childPageID)
-}
-
 func (ip *InternalPage) SetKeyPointer(i int, ptr uint16) {
 	var kPtr [2]byte
 	binary.LittleEndian.PutUint16(kPtr[:], ptr)
 
-	off := keyPointerOffset + (i * 2)
+	off := internalDataStart + (i * 2)
 	copy(ip.Page.Data[off:off+2], kPtr[:])
 }
 
-func (ip *InternalPage) InsertKeyPointer(i int, ptr uint16) {
-	n := ip.GetNumKeys()
-
-	for j := n - 1; j >= i; j-- {
-		ptrVal := ip.GetKeyPointer(j)
-		ip.SetKeyPointer(j+1, ptrVal)
-	}
-
-	ip.SetKeyPointer(i, ptr)
-
-	ip.SetNumKeys(n + 1)
-	ip.SetFreeStart(keyPointerOffset + ((n + 1) * 2))
-}
-
 func (ip *InternalPage) FindInsertIndex(key []byte) int {
 	n := ip.GetNumKeys()
 
@@ -205,139 +184,186 @@ func (ip *InternalPage) FindInsertIndex(key []byte) int {
 	return low
 }
 
-func (ip *InternalPage) InsertKey(key []byte) error {
-	idx := ip.FindInsertIndex(key)
+// Read the key of the cell at off
+func (ip *InternalPage) ReadKey(off uint16) []byte {
+	pos := int(off) + 4
+	keyLen := int(binary.LittleEndian.Uint16(ip.Page.Data[pos : pos+2]))
 
-	off, err := ip.WriteKey(key)
-	if err != nil {
-		return err
-	}
+	pos += 2
 
-	ip.InsertKeyPointer(idx, off)
-	return nil
+	return ip.Page.Data[pos : pos+keyLen]
 }
 
-func (ip *InternalPage) Compact() error {
-	n := ip.GetNumKeys()
+func (ip *InternalPage) writeCell(child uint32, key []byte) (uint16, error) {
+	recordLen := internalCellHeader + len(key)
 
-	keys := make([][]byte, n)
-	for i := 0; i < n; i++ {
-		ptr := ip.GetKeyPointer(i)
-		k := ip.ReadKey(ptr)
-		keys[i] = append([]byte(nil), k...)
-	}
+	off := ip.GetFreeEnd() - recordLen
 
-	children := make([]uint32, n+1)
-	for i := 0; i < n; i++ {
-		children[i] = ip.GetChild(i)
+	// Leave room for the cell pointer as well
+	if off < ip.GetFreeStart()+2 {
+		return 0, fmt.Errorf("writeCell: %w", ErrPageFull)
 	}
-	children[n] = ip.GetRightChild()
 
-	ip.SetNumKeys(0)
-	ip.SetFreeStart(keyPointerOffset)
-	ip.SetFreeEnd(PageSize)
+	binary.LittleEndian.PutUint32(ip.Page.Data[off:off+4], child)
+	binary.LittleEndian.PutUint16(ip.Page.Data[off+4:off+6], uint16(len(key)))
+	copy(ip.Page.Data[off+6:off+6+len(key)], key)
 
-	for i := 0; i < n; i++ {
-		off, err := ip.WriteKey(keys[i])
-		if err != nil {
-			return err
-		}
-		ip.SetKeyPointer(i, off)
+	ip.SetFreeEnd(off)
+	return uint16(off), nil
+}
 
-		ip.SetChild(i, children[i])
-	}
+// Insert a cell with child and key at position idx
+func (ip *InternalPage) InsertCell(idx int, child uint32, key []byte) error {
+	n := ip.GetNumKeys()
 
-	ip.SetRightChild(children[n])
+	if idx < 0 || idx > n {
+		return fmt.Errorf("InsertCell: index %d out of range (%d)", idx, n)
+	}
 
-	ip.SetFreeStart(keyPointerOffset + (n * 2))
-	ip.SetNumKeys(n)
-	return nil
-}
+	if ip.GetFreeSpace() < internalCellSize(key) {
+		if err := ip.Compact(); err != nil {
+			return err
+		}
+	}
 
-func (ip *InternalPage) ReplaceKey(idx int, key []byte) error {
-	off, err := ip.WriteKey(key)
+	off, err := ip.writeCell(child, key)
 	if err != nil {
 		return err
 	}
 
+	for j := n - 1; j >= idx; j-- {
+		ip.SetKeyPointer(j+1, ip.GetKeyPointer(j))
+	}
 	ip.SetKeyPointer(idx, off)
 
-	return ip.Compact()
+	ip.SetNumKeys(n + 1)
+	ip.SetFreeStart(internalDataStart + (n+1)*2)
+	return nil
 }
 
-func (ip *InternalPage) DeleteKey(idx int) error {
+// Remove cell idx, its key and the child to the left of it
+func (ip *InternalPage) DeleteCell(idx int) error {
 	n := ip.GetNumKeys()
 
+	if idx < 0 || idx >= n {
+		return fmt.Errorf("DeleteCell: index %d out of range (%d)", idx, n)
+	}
+
 	for j := idx + 1; j < n; j++ {
-		off := ip.GetKeyPointer(j)
-		ip.SetKeyPointer(j-1, off)
+		ip.SetKeyPointer(j-1, ip.GetKeyPointer(j))
 	}
 
 	ip.SetNumKeys(n - 1)
-	ip.SetFreeStart(keyPointerOffset + (ip.GetNumKeys() * 2))
+	ip.SetFreeStart(internalDataStart + (n-1)*2)
 
 	return ip.Compact()
 }
 
-func (ip *InternalPage) DeleteChild(idx int) error {
+// Insert key with newChild to the right of it. True means the page is full and needs to be split
+func (ip *InternalPage) InsertSeparator(key []byte, newChild uint32) bool {
+	idx := ip.FindInsertIndex(key)
 	n := ip.GetNumKeys()
 
-	if idx < 0 || idx > n {
-		return fmt.Errorf("DeleteChild: index %d out of range (%d)", idx, n)
+	// The child that held key moves into the new cell, newChild takes its place
+	var left uint32
+	if idx < n {
+		left = ip.GetChild(idx)
+	} else {
+		left = ip.GetRightChild()
+	}
+
+	if err := ip.InsertCell(idx, left, key); err != nil {
+		return true
 	}
+
 	if idx < n {
-		for j := idx; j < n-1; j++ {
-			ip.SetChild(j, ip.GetChild(j+1))
-		}
-		return nil
+		ip.SetChild(idx+1, newChild)
+	} else {
+		ip.SetRightChild(newChild)
 	}
 
-	ip.SetRightChild(ip.GetChild(n - 1))
-	return nil
+	return false
 }
 
-func (ip *InternalPage) ReadKey(off uint16) []byte {
-	pos := int(off)
-	keyLen := int(binary.LittleEndian.Uint16(ip.Page.Data[pos : pos+2]))
+// Drop key idx along with the child to the right of it, the child on its left takes over
+func (ip *InternalPage) RemoveSeparator(idx int) error {
+	n := ip.GetNumKeys()
 
-	pos += 2
+	if idx < 0 || idx >= n {
+		return fmt.Errorf("RemoveSeparator: index %d out of range (%d)", idx, n)
+	}
 
-	return ip.Page.Data[pos : pos+keyLen]
+	left := ip.GetChild(idx)
+	if err := ip.DeleteCell(idx); err != nil {
+		return err
+	}
+
+	if idx < n-1 {
+		ip.SetChild(idx, left)
+	} else {
+		ip.SetRightChild(left)
+	}
+	return nil
 }
 
-func (ip *InternalPage) WriteKey(key []byte) (uint16, error) {
-	var keyLen [2]byte
-	binary.LittleEndian.PutUint16(keyLen[:], uint16(len(key)))
+func (ip *InternalPage) ReplaceKey(idx int, key []byte) error {
+	keys, children := ip.entries()
+	keys[idx] = append([]byte(nil), key...)
 
-	recordLen := 2 + len(key)
+	return ip.rebuild(keys, children)
+}
 
-	off := ip.GetFreeEnd() - recordLen
+func (ip *InternalPage) Compact() error {
+	keys, children := ip.entries()
+	return ip.rebuild(keys, children)
+}
 
-	if off < ip.GetFreeStart() {
-		return 0, fmt.Errorf("Not enough space to write key")
-	}
+// Copy out the keys and children of the page, children has one more entry
+// than keys with the right child last
+func (ip *InternalPage) entries() ([][]byte, []uint32) {
+	n := ip.GetNumKeys()
 
-	copy(ip.Page.Data[off:off+2], keyLen[:])
+	keys := make([][]byte, n)
+	children := make([]uint32, n+1)
 
-	copy(ip.Page.Data[off+2:off+2+len(key)], key[:])
+	for i := 0; i < n; i++ {
+		keys[i] = append([]byte(nil), ip.GetKey(i)...)
+		children[i] = ip.GetChild(i)
+	}
+	children[n] = ip.GetRightChild()
 
-	ip.SetFreeEnd(off)
-	return uint16(off), nil
+	return keys, children
 }
 
-func (ip *InternalPage) InsertSeparator(key []byte, newChild uint32) bool {
-	if ip.GetNumKeys() >= maxChildren-1 {
-		return true
+// Bytes the page would use holding keys
+func internalSpaceFor(keys [][]byte) int {
+	used := internalDataStart
+	for _, k := range keys {
+		used += internalCellSize(k)
 	}
-	idx := ip.FindInsertIndex(key)
-	keyPtr, err := ip.WriteKey(key)
-	if err != nil {
-		// True means we need to split the page
-		return true
+	return used
+}
+
+// Rewrite the page to hold keys and children, left as it was if they don't fit
+func (ip *InternalPage) rebuild(keys [][]byte, children []uint32) error {
+	if internalSpaceFor(keys) > len(ip.Page.Data) {
+		return fmt.Errorf("rebuild: %w", ErrPageFull)
 	}
 
-	ip.InsertChildPointer(idx+1, newChild)
-	ip.InsertKeyPointer(idx, keyPtr)
+	ip.SetNumKeys(0)
+	ip.SetFreeStart(internalDataStart)
+	ip.SetFreeEnd(len(ip.Page.Data))
 
-	return false
+	for i, key := range keys {
+		off, err := ip.writeCell(children[i], key)
+		if err != nil {
+			return err
+		}
+		ip.SetKeyPointer(i, off)
+		ip.SetFreeStart(internalDataStart + (i+1)*2)
+	}
+
+	ip.SetRightChild(children[len(keys)])
+	ip.SetNumKeys(len(keys))
+	return nil
 }
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Readers and single key writers work on the tree at the same time by latching
+// the pages they use rather than locking the whole tree. pager.write is still
+// held by all of them, shared, and only taken exclusively by operations that
+// need the tree to themselves: multi key frames, vacuum and checkpoints.
+//
+// Readers couple shared latches down the tree, letting go of a parent once its
+// child is latched, and step between leaves without holding two at once.
+//
+// Writers take turns on pager.writer since the WAL frame, the free list and the
+// meta page belong to one writer at a time. A write descends like a reader and
+// latches only its leaf exclusively. If the leaf can take the write without a
+// split or merge nothing else changes, otherwise it starts again from the root
+// latching exclusively and letting go of everything above a page the change
+// can't get past. Pages the write changes stay latched until its frame has
+// committed or rolled back, so a reader never sees half an operation.
+//
+// Latches are only waited on top down, or on leaves and siblings under a parent
+// the writer already holds, and a reader never waits on a latch while holding
+// one a writer could be waiting on below it, so there are no cycles
+
+// Size of the largest separator a split can pass up or a merge can take down
+const maxSeparatorCell = internalCellHeader + MaxKeySize + 2
+
+// Fetch a page and latch it. The page stays cached until unlatch, shared
+// latches leave it out of the running operation
+func (pager *Pager) latch(id uint32, exclusive bool) (*cachedPage, error) {
+	cp, err := pager.fetch(id, exclusive, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if exclusive {
+		cp.latch.Lock()
+	} else {
+		cp.latch.RLock()
+	}
+	return cp, nil
+}
+
+func (pager *Pager) unlatch(cp *cachedPage, exclusive bool) {
+	if exclusive {
+		cp.latch.Unlock()
+	} else {
+		cp.latch.RUnlock()
+	}
+
+	pager.mu.Lock()
+	cp.pins--
+	pager.mu.Unlock()
+}
+
+// Pages latched exclusively by the running write
+type latchSet struct {
+	pager *Pager
+	held  map[uint32]*cachedPage
+}
+
+func (ls *latchSet) acquire(id uint32) (*cachedPage, error) {
+	if cp, ok := ls.held[id]; ok {
+		return cp, nil
+	}
+
+	cp, err := ls.pager.latch(id, true)
+	if err != nil {
+		return nil, err
+	}
+	ls.held[id] = cp
+	return cp, nil
+}
+
+func (ls *latchSet) release(id uint32) {
+	if cp, ok := ls.held[id]; ok {
+		ls.pager.unlatch(cp, true)
+		delete(ls.held, id)
+	}
+}
+
+func (ls *latchSet) releaseAll() {
+	for id := range ls.held {
+		ls.release(id)
+	}
+}
+
+// Run a single key write as a WAL frame under page latches, readers keep going
+// on every page it doesn't change
+func (bt *BTree) updateLatched(fn func() error) error {
+	offset, err := bt.updateLatchedLocked(fn)
+	if err != nil {
+		return err
+	}
+	return bt.pager.wal.Commit(offset)
+}
+
+func (bt *BTree) updateLatchedLocked(fn func() error) (uint64, error) {
+	bt.pager.write.RLock()
+	defer bt.pager.write.RUnlock()
+	bt.pager.writer.Lock()
+	defer bt.pager.writer.Unlock()
+
+	bt.latches = &latchSet{pager: bt.pager, held: make(map[uint32]*cachedPage)}
+	defer func() {
+		bt.latches.releaseAll()
+		bt.latches = nil
+	}()
+
+	return bt.frame(fn)
+}
+
+// Read a page the running write is going to change. Under latches it is held
+// exclusively until the frame is over
+func (bt *BTree) modify(id uint32) (*Page, error) {
+	if bt.latches == nil {
+		return bt.pager.ReadPage(id)
+	}
+
+	cp, err := bt.latches.acquire(id)
+	if err != nil {
+		return nil, err
+	}
+	return cp.page, nil
+}
+
+// Latch the root shared. A writer may move the root between reading it and
+// getting the latch, the old page can't be read until we know it didn't
+func (bt *BTree) latchRoot() (*cachedPage, error) {
+	for {
+		id := bt.root.Load()
+		cp, err := bt.pager.latch(id, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if bt.root.Load() == id {
+			return cp, nil
+		}
+		bt.pager.unlatch(cp, false)
+	}
+}
+
+// Couple shared latches from the root down to the leaf choose leads to. A reader
+// gets the leaf latched shared and must unlatch it, the writer gets it through
+// its latch set
+func (bt *BTree) latchLeaf(choose chooseChild, write bool) (*cachedPage, error) {
+	cp, err := bt.latchRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch cp.page.Type {
+		case PageTypeLeaf:
+			if !write {
+				return cp, nil
+			}
+
+			// Nothing but the writer changes pages so the leaf is the same once
+			// it has it exclusively
+			id := cp.page.ID
+			bt.pager.unlatch(cp, false)
+			return bt.latches.acquire(id)
+
+		case PageTypeInternal:
+		default:
+			bt.pager.unlatch(cp, false)
+			return nil, ErrCorruptTree
+		}
+
+		child, err := bt.pager.latch(choose(WrapInternalPage(cp.page)), false)
+		bt.pager.unlatch(cp, false)
+		if err != nil {
+			return nil, err
+		}
+		cp = child
+	}
+}
+
+// Descend to the leaf for key latching every page exclusively. Once a page is
+// safe, meaning the write can't change anything above it, its parents are let
+// go and dropped from the stack
+func (bt *BTree) descendExclusive(key []byte, safe func(*Page) bool) (*LeafPage, *ParentStack, error) {
+	curr := bt.root.Load()
+	stack := &ParentStack{}
+
+	for {
+		page, err := bt.modify(curr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if safe(page) {
+			for _, p := range stack.items {
+				bt.latches.release(p.pageID)
+			}
+			stack.items = stack.items[:0]
+		}
+
+		switch page.Type {
+		case PageTypeLeaf:
+			return WrapLeafPage(page), stack, nil
+		case PageTypeInternal:
+			stack.Push(Parent{pageID: curr})
+			curr = childFor(key)(WrapInternalPage(page))
+		default:
+			return nil, nil, ErrCorruptTree
+		}
+	}
+}
+
+// Whether putting key / val can't split the page. Leaves are checked against
+// the record itself, internal pages need room for any separator
+func (bt *BTree) insertSafe(key, val []byte) func(*Page) bool {
+	return func(p *Page) bool {
+		if p.Type == PageTypeLeaf {
+			return bt.leafFits(WrapLeafPage(p), key, val)
+		}
+		return WrapInternalPage(p).GetSpaceUsed()+maxSeparatorCell <= bt.pager.pageSize
+	}
+}
+
+// Ignores the space an existing value would give back, so it can only err towards a split
+func (bt *BTree) leafFits(leaf *LeafPage, key, val []byte) bool {
+	prefix := leaf.GetPrefix()
+	if !bytes.HasPrefix(key, prefix) {
+		return false
+	}
+
+	r := rec{key: key, val: val}
+	if bt.needsOverflow(key, val) {
+		r.val = encodeOverflowPointer(uint32(len(val)), InvalidPage)
+	}
+	return leaf.GetSpaceUsed()+recSize(r)-len(prefix) <= bt.pager.pageSize
+}
+
+// Whether deleting key can't leave the page to be rebalanced
+func (bt *BTree) deleteSafe(key []byte) func(*Page) bool {
+	return func(p *Page) bool {
+		// The root only goes once it is down to a single child
+		if p.ID == bt.root.Load() {
+			return p.Type == PageTypeLeaf || WrapInternalPage(p).GetNumKeys() > 1
+		}
+
+		if p.Type == PageTypeLeaf {
+			leaf := WrapLeafPage(p)
+			idx := leaf.FindInsertIndex(key)
+			if idx >= leaf.GetNumCells() || !bytes.Equal(leaf.ReadKey(leaf.GetCellPointer(idx)), key) {
+				return true
+			}
+			used := leaf.GetSpaceUsed() - leaf.cellSize(leaf.GetCellPointer(idx)) - 2
+			return used >= bt.pager.pageSize/2
+		}
+
+		// A merge below takes one separator out of the page
+		return WrapInternalPage(p).GetSpaceUsed()-maxSeparatorCell >= bt.pager.pageSize/2
+	}
+}
+
+// An optimistic write found its leaf can't take it alone
+func errUnsafeLeaf(id uint32) error {
+	return fmt.Errorf("leaf %d changed shape under a leaf only write: %w", id, ErrCorruptTree)
+}
@@ -11,33 +11,69 @@ type LeafPage struct {
 }
 
 const (
-	numCellsOffset int = 1
-	startOffset    int = 3
-	endOffset      int = 5
-	dataStart      int = 7
+	numCellsOffset int = pageHeaderSize
+	startOffset    int = pageHeaderSize + 2
+	endOffset      int = pageHeaderSize + 4
+	nextLeafOffset int = pageHeaderSize + 6
+	prevLeafOffset int = pageHeaderSize + 10
+	dataStart      int = pageHeaderSize + 14
+
+	// Leaves work out their free start from the cell count. The slot holds the
+	// bytes of deleted cells that have not been reclaimed yet instead
+	fragmentedOffset int = startOffset
 )
 
+// Records larger than an eighth of the page have their value moved to a chain of
+// overflow pages, the cell then stores the total value length and the first
+// overflow page. The high bit of the value length marks these cells.
+// Keys are limited by the smallest page size so any key fits in any database
+const (
+	overflowFlag    uint16 = 0x8000
+	overflowPtrSize int    = 8
+	MaxKeySize             = MinPageSize/8 - 4 - overflowPtrSize
+)
+
+// Leaves of databases created with prefix compression set the high bit of their
+// cell count. The prefix shared by every key in the page is stored once after
+// the header, followed by the cell pointers, and cells only hold the rest of
+// their key
+//
+// Prefix Length: uint16
+// Prefix: []byte
+const (
+	prefixedFlag    uint16 = 0x8000
+	prefixLenOffset int    = dataStart
+)
+
+func maxInlineRecord(pageSize int) int {
+	return pageSize / 8
+}
+
 func NewLeafPage(page *Page) *LeafPage {
 	pType := byte(PageTypeLeaf)
 
 	var nCells [2]byte
 	binary.LittleEndian.PutUint16(nCells[:], uint16(0))
 
-	var fStart [2]byte
-	binary.LittleEndian.PutUint16(fStart[:], uint16(dataStart))
+	var frag [2]byte
+	binary.LittleEndian.PutUint16(frag[:], uint16(0))
 
 	var fEnd [2]byte
-	binary.LittleEndian.PutUint16(fEnd[:], uint16(PageSize))
+	binary.LittleEndian.PutUint16(fEnd[:], uint16(len(page.Data)))
 
 	page.Type = PageTypeLeaf
 
 	page.Data[0] = pType
 	copy(page.Data[numCellsOffset:], nCells[:])
-	copy(page.Data[startOffset:], fStart[:])
+	copy(page.Data[fragmentedOffset:], frag[:])
 	copy(page.Data[endOffset:], fEnd[:])
-	return &LeafPage{
+
+	lp := &LeafPage{
 		Page: page,
 	}
+	lp.SetNext(InvalidPage)
+	lp.SetPrev(InvalidPage)
+	return lp
 }
 
 func WrapLeafPage(page *Page) *LeafPage {
@@ -60,24 +96,61 @@ func (lp *LeafPage) DebugKeys() []string {
 // GETTERS
 func (lp *LeafPage) GetNumCells() int {
 	raw := lp.Page.Data[numCellsOffset : numCellsOffset+2]
-	nCells := int(binary.LittleEndian.Uint16(raw))
+	nCells := int(binary.LittleEndian.Uint16(raw) &^ prefixedFlag)
 	return nCells
 }
 
+func (lp *LeafPage) IsPrefixed() bool {
+	raw := lp.Page.Data[numCellsOffset : numCellsOffset+2]
+	return binary.LittleEndian.Uint16(raw)&prefixedFlag != 0
+}
+
+// The prefix every key in the page starts with, empty for pages without compression
+func (lp *LeafPage) GetPrefix() []byte {
+	if !lp.IsPrefixed() {
+		return nil
+	}
+	n := int(binary.LittleEndian.Uint16(lp.Page.Data[prefixLenOffset : prefixLenOffset+2]))
+	return lp.Page.Data[prefixLenOffset+2 : prefixLenOffset+2+n]
+}
+
+// Where the cell pointer array begins, right after the prefix
+func (lp *LeafPage) cellStart() int {
+	if !lp.IsPrefixed() {
+		return dataStart
+	}
+	return prefixLenOffset + 2 + int(binary.LittleEndian.Uint16(lp.Page.Data[prefixLenOffset:prefixLenOffset+2]))
+}
+
+// Free space begins right after the cell pointers
 func (lp *LeafPage) GetFreeStart() int {
-	raw := lp.Page.Data[startOffset : startOffset+2]
-	fStart := int(binary.LittleEndian.Uint16(raw))
-	return fStart
+	return lp.cellStart() + lp.GetNumCells()*2
+}
+
+// Bytes of deleted cells between the free end and the end of the page
+func (lp *LeafPage) GetFragmented() int {
+	raw := lp.Page.Data[fragmentedOffset : fragmentedOffset+2]
+	return int(binary.LittleEndian.Uint16(raw))
 }
 
 func (lp *LeafPage) GetFreeEnd() int {
 	raw := lp.Page.Data[endOffset : endOffset+2]
-	fEnd := int(binary.LittleEndian.Uint16(raw))
-	return fEnd
+	return decodeFreeEnd(binary.LittleEndian.Uint16(raw), len(lp.Page.Data))
+}
+
+// Leaves are linked to their neighbours so cursors can walk keys in order
+func (lp *LeafPage) GetNext() uint32 {
+	raw := lp.Page.Data[nextLeafOffset : nextLeafOffset+4]
+	return binary.LittleEndian.Uint32(raw)
+}
+
+func (lp *LeafPage) GetPrev() uint32 {
+	raw := lp.Page.Data[prevLeafOffset : prevLeafOffset+4]
+	return binary.LittleEndian.Uint32(raw)
 }
 
 func (lp *LeafPage) GetCellPointer(i int) uint16 {
-	off := dataStart + (i * 2)
+	off := lp.cellStart() + (i * 2)
 	raw := lp.Page.Data[off : off+2]
 
 	return binary.LittleEndian.Uint16(raw)
@@ -104,23 +177,26 @@ func (lp *LeafPage) GetLastRecordSize() int {
 	return 4 + len(k) + len(v)
 }
 
+// Live bytes in the page, holes left by deleted cells count as free
 func (lp *LeafPage) GetSpaceUsed() int {
-	return lp.GetFreeStart() + (PageSize - lp.GetFreeEnd())
+	return lp.GetFreeStart() + (len(lp.Page.Data) - lp.GetFreeEnd()) - lp.GetFragmented()
 }
 
 // SETTERS
 func (lp *LeafPage) SetNumCells(n int) {
+	flags := binary.LittleEndian.Uint16(lp.Page.Data[numCellsOffset:numCellsOffset+2]) & prefixedFlag
+
 	var nCells [2]byte
-	binary.LittleEndian.PutUint16(nCells[:], uint16(n))
+	binary.LittleEndian.PutUint16(nCells[:], uint16(n)|flags)
 
 	copy(lp.Page.Data[numCellsOffset:], nCells[:])
 }
 
-func (lp *LeafPage) SetFreeStart(n int) {
-	var fStart [2]byte
-	binary.LittleEndian.PutUint16(fStart[:], uint16(n))
+func (lp *LeafPage) SetFragmented(n int) {
+	var frag [2]byte
+	binary.LittleEndian.PutUint16(frag[:], uint16(n))
 
-	copy(lp.Page.Data[startOffset:], fStart[:])
+	copy(lp.Page.Data[fragmentedOffset:], frag[:])
 }
 
 func (lp *LeafPage) SetFreeEnd(n int) {
@@ -130,11 +206,31 @@ func (lp *LeafPage) SetFreeEnd(n int) {
 	copy(lp.Page.Data[endOffset:], fEnd[:])
 }
 
+func (lp *LeafPage) SetNext(id uint32) {
+	var next [4]byte
+	binary.LittleEndian.PutUint32(next[:], id)
+
+	copy(lp.Page.Data[nextLeafOffset:nextLeafOffset+4], next[:])
+}
+
+func (lp *LeafPage) SetPrev(id uint32) {
+	var prev [4]byte
+	binary.LittleEndian.PutUint32(prev[:], id)
+
+	copy(lp.Page.Data[prevLeafOffset:prevLeafOffset+4], prev[:])
+}
+
+// Turn on prefix compression for an empty page, the prefix starts out empty
+func (lp *LeafPage) SetPrefixed() {
+	lp.Page.Data[numCellsOffset+1] |= byte(prefixedFlag >> 8)
+	binary.LittleEndian.PutUint16(lp.Page.Data[prefixLenOffset:prefixLenOffset+2], 0)
+}
+
 func (lp *LeafPage) SetCellPointer(i int, ptr uint16) {
 	var cPtr [2]byte
 	binary.LittleEndian.PutUint16(cPtr[:], ptr)
 
-	off := dataStart + (i * 2)
+	off := lp.cellStart() + (i * 2)
 	copy(lp.Page.Data[off:off+2], cPtr[:])
 }
 
@@ -148,8 +244,6 @@ func (lp *LeafPage) InsertCellPointer(i int, ptr uint16) {
 
 	lp.SetCellPointer(i, ptr)
 	lp.SetNumCells(n + 1)
-
-	lp.SetFreeStart(dataStart + ((n + 1) * 2))
 }
 
 func (lp *LeafPage) DeleteCellPointer(i int) {
@@ -161,19 +255,29 @@ func (lp *LeafPage) DeleteCellPointer(i int) {
 	}
 
 	lp.SetNumCells(n - 1)
-	lp.SetFreeStart(dataStart + ((n - 1) * 2))
 }
 
 func (lp *LeafPage) FindInsertIndex(key []byte) int {
 	n := lp.GetNumCells()
 
+	// Every key in the page starts with the prefix so a key without it sorts
+	// before or after all of them
+	prefix := lp.GetPrefix()
+	if !bytes.HasPrefix(key, prefix) {
+		if bytes.Compare(key, prefix) < 0 {
+			return 0
+		}
+		return n
+	}
+	suffix := key[len(prefix):]
+
 	low, high := 0, n
 
 	for low < high {
 		mid := (low + high) / 2
 		midPtr := lp.GetCellPointer(mid)
-		midKey := lp.ReadKey(midPtr)
-		cmp := bytes.Compare(key, midKey)
+		midSuffix := lp.readSuffix(midPtr)
+		cmp := bytes.Compare(suffix, midSuffix)
 		if cmp <= 0 {
 			high = mid
 		} else {
@@ -185,16 +289,34 @@ func (lp *LeafPage) FindInsertIndex(key []byte) int {
 }
 
 func (lp *LeafPage) Insert(key, val []byte) error {
-	idx := lp.FindInsertIndex(key)
+	return lp.insertRec(rec{key: key, val: val})
+}
+
+func (lp *LeafPage) insertRec(r rec) error {
+	idx := lp.FindInsertIndex(r.key)
 
 	if idx < lp.GetNumCells() {
 		existingKey := lp.ReadKey(lp.GetCellPointer(idx))
-		if bytes.Equal(existingKey, key) {
+		if bytes.Equal(existingKey, r.key) {
 			return ErrKeyExists
 		}
 	}
 
-	off, err := lp.WriteRecord(key, val)
+	// Holes left by deletes are only reclaimed once a record doesn't fit without them
+	if lp.GetFreeEnd()-lp.GetFreeStart() < recSize(r)-len(lp.GetPrefix()) && lp.GetFragmented() > 0 {
+		if err := lp.Compact(); err != nil {
+			return err
+		}
+	}
+
+	// The prefix has to shrink to take the key, which means rewriting every cell
+	if !bytes.HasPrefix(r.key, lp.GetPrefix()) {
+		recs := lp.records()
+		recs = append(recs[:idx], append([]rec{r}, recs[idx:]...)...)
+		return lp.rebuild(recs)
+	}
+
+	off, err := lp.writeRec(r)
 	if err != nil {
 		return err
 	}
@@ -217,36 +339,80 @@ func (lp *LeafPage) Overwrite(key, val []byte) error {
 	return nil
 }
 
+// Rewrite the cells back to back, for prefixed pages this also picks the
+// longest prefix the remaining keys share
 func (lp *LeafPage) Compact() error {
+	return lp.rebuild(lp.records())
+}
+
+// Deep copies of every record in the page in key order
+func (lp *LeafPage) records() []rec {
 	n := lp.GetNumCells()
 
-	type rec struct {
-		key []byte
-		val []byte
+	records := make([]rec, n)
+	for i := 0; i < n; i++ {
+		records[i] = lp.readRec(lp.GetCellPointer(i))
+	}
+	return records
+}
+
+// Longest prefix shared by the keys of recs
+func commonPrefix(recs []rec) []byte {
+	if len(recs) == 0 {
+		return nil
 	}
 
-	records := make([]rec, n)
+	prefix := recs[0].key
+	for _, r := range recs[1:] {
+		n := 0
+		for n < len(prefix) && n < len(r.key) && prefix[n] == r.key[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return prefix
+}
 
-	for i := 0; i < n; i++ {
-		ptr := lp.GetCellPointer(i)
-		k, v := lp.ReadRecord(ptr)
+// Bytes a leaf would use holding recs
+func leafSpaceFor(recs []rec, prefixed bool) int {
+	used := dataStart
+	shared := 0
+	if prefixed {
+		shared = len(commonPrefix(recs))
+		used += 2 + shared
+	}
 
-		kCopy := append([]byte(nil), k...)
-		vCopy := append([]byte(nil), v...)
-		records[i] = rec{key: kCopy, val: vCopy}
+	for _, r := range recs {
+		used += recSize(r) - shared
+	}
+	return used
+}
+
+// Rewrite the page to hold recs, which must be in key order. The page is left
+// as it was if they don't fit
+func (lp *LeafPage) rebuild(recs []rec) error {
+	prefixed := lp.IsPrefixed()
+	if leafSpaceFor(recs, prefixed) > len(lp.Page.Data) {
+		return fmt.Errorf("rebuild: %w", ErrPageFull)
 	}
 
 	lp.SetNumCells(0)
-	lp.SetFreeStart(dataStart)
-	lp.SetFreeEnd(PageSize)
+	if prefixed {
+		prefix := commonPrefix(recs)
+		binary.LittleEndian.PutUint16(lp.Page.Data[prefixLenOffset:prefixLenOffset+2], uint16(len(prefix)))
+		copy(lp.Page.Data[prefixLenOffset+2:], prefix)
+	}
 
-	for i := 0; i < n; i++ {
-		off, err := lp.WriteRecord(records[i].key, records[i].val)
+	lp.SetFragmented(0)
+	lp.SetFreeEnd(len(lp.Page.Data))
+
+	for i, r := range recs {
+		off, err := lp.writeRec(r)
 		if err != nil {
 			return err
 		}
-
-		lp.InsertCellPointer(i, off)
+		lp.SetCellPointer(i, off)
+		lp.SetNumCells(i + 1)
 	}
 	return nil
 }
@@ -255,31 +421,49 @@ func (lp *LeafPage) Delete(key []byte) error {
 	idx := lp.FindInsertIndex(key)
 
 	if idx >= lp.GetNumCells() {
-		return fmt.Errorf("Key does not exist")
+		return ErrDeleteMissingKey
 	}
 
 	targetKey := lp.ReadKey(lp.GetCellPointer(idx))
 	if !bytes.Equal(targetKey, key) {
-		return fmt.Errorf("Key does not exist")
+		return ErrDeleteMissingKey
 	}
 
+	// The cell stays where it is until an insert needs the space
+	lp.SetFragmented(lp.GetFragmented() + lp.cellSize(lp.GetCellPointer(idx)))
 	lp.DeleteCellPointer(idx)
 
-	return lp.Compact()
+	return nil
 }
 
 // RECORD READ / WRITE
 func (lp *LeafPage) WriteRecord(key, val []byte) (uint16, error) {
+	return lp.writeCell(key, val, 0)
+}
+
+// Write a cell whose value lives in the overflow chain starting at first
+func (lp *LeafPage) WriteOverflowRecord(key []byte, total, first uint32) (uint16, error) {
+	return lp.writeCell(key, encodeOverflowPointer(total, first), overflowFlag)
+}
+
+func (lp *LeafPage) writeCell(key, val []byte, flags uint16) (uint16, error) {
+	prefix := lp.GetPrefix()
+	if !bytes.HasPrefix(key, prefix) {
+		return 0, fmt.Errorf("writeCell: key %q does not start with the page prefix %q", key, prefix)
+	}
+	key = key[len(prefix):]
+
 	var keyLen [2]byte
 	binary.LittleEndian.PutUint16(keyLen[:], uint16(len(key)))
 
 	var valLen [2]byte
-	binary.LittleEndian.PutUint16(valLen[:], uint16(len(val)))
+	binary.LittleEndian.PutUint16(valLen[:], uint16(len(val))|flags)
 
 	recordLen := len(keyLen) + len(valLen) + len(key) + len(val)
 	off := lp.GetFreeEnd() - recordLen
 
-	if off < lp.GetFreeStart() {
+	// Leave room for the cell pointer that will reference this record
+	if off < lp.GetFreeStart()+2 {
 		return 0, ErrPageFull
 	}
 
@@ -296,27 +480,95 @@ func (lp *LeafPage) WriteRecord(key, val []byte) (uint16, error) {
 	return uint16(off), nil
 }
 
+// For overflow cells val holds the encoded overflow pointer rather than the value.
+// val always points into the page, key is a fresh copy on prefixed pages
 func (lp *LeafPage) ReadRecord(off uint16) (key, val []byte) {
 	pos := int(off)
 
 	keyLen := int(binary.LittleEndian.Uint16(lp.Page.Data[pos : pos+2]))
-	valLen := int(binary.LittleEndian.Uint16(lp.Page.Data[pos+2 : pos+4]))
+	valLen := int(binary.LittleEndian.Uint16(lp.Page.Data[pos+2:pos+4]) &^ overflowFlag)
 
-	keyStart := pos + 4
 	valStart := pos + 4 + keyLen
 
-	key = lp.Page.Data[keyStart : keyStart+keyLen]
+	key = lp.ReadKey(off)
 	val = lp.Page.Data[valStart : valStart+valLen]
 	return
 }
 
 func (lp *LeafPage) ReadKey(off uint16) (key []byte) {
+	suffix := lp.readSuffix(off)
+
+	prefix := lp.GetPrefix()
+	if len(prefix) == 0 {
+		return suffix
+	}
+
+	key = make([]byte, 0, len(prefix)+len(suffix))
+	key = append(key, prefix...)
+	return append(key, suffix...)
+}
+
+// Bytes the cell at off takes up, not counting its pointer
+func (lp *LeafPage) cellSize(off uint16) int {
+	pos := int(off)
+
+	keyLen := int(binary.LittleEndian.Uint16(lp.Page.Data[pos : pos+2]))
+	valLen := int(binary.LittleEndian.Uint16(lp.Page.Data[pos+2:pos+4]) &^ overflowFlag)
+	return 4 + keyLen + valLen
+}
+
+// The part of the key stored in the cell at off
+func (lp *LeafPage) readSuffix(off uint16) []byte {
 	pos := int(off)
 
 	keyLen := int(binary.LittleEndian.Uint16(lp.Page.Data[pos : pos+2]))
 
 	keyStart := pos + 4
 
-	key = lp.Page.Data[keyStart : keyStart+keyLen]
-	return
+	return lp.Page.Data[keyStart : keyStart+keyLen]
+}
+
+func (lp *LeafPage) IsOverflow(off uint16) bool {
+	pos := int(off)
+	return binary.LittleEndian.Uint16(lp.Page.Data[pos+2:pos+4])&overflowFlag != 0
+}
+
+// Returns the total value length and first page of an overflow cell
+func (lp *LeafPage) ReadOverflowPointer(off uint16) (uint32, uint32) {
+	_, ptr := lp.ReadRecord(off)
+	return decodeOverflowPointer(ptr)
+}
+
+// Point an overflow cell at a new first page, the value itself is unchanged
+func (lp *LeafPage) SetOverflowFirst(off uint16, first uint32) {
+	_, ptr := lp.ReadRecord(off)
+	binary.LittleEndian.PutUint32(ptr[4:8], first)
+}
+
+// Deep copy of a record so it survives the page being rewritten
+func (lp *LeafPage) readRec(off uint16) rec {
+	k, v := lp.ReadRecord(off)
+	return rec{
+		key:      append([]byte(nil), k...),
+		val:      append([]byte(nil), v...),
+		overflow: lp.IsOverflow(off),
+	}
+}
+
+func (lp *LeafPage) writeRec(r rec) (uint16, error) {
+	if r.overflow {
+		return lp.writeCell(r.key, r.val, overflowFlag)
+	}
+	return lp.writeCell(r.key, r.val, 0)
+}
+
+func encodeOverflowPointer(total, first uint32) []byte {
+	ptr := make([]byte, overflowPtrSize)
+	binary.LittleEndian.PutUint32(ptr[0:4], total)
+	binary.LittleEndian.PutUint32(ptr[4:8], first)
+	return ptr
+}
+
+func decodeOverflowPointer(ptr []byte) (uint32, uint32) {
+	return binary.LittleEndian.Uint32(ptr[0:4]), binary.LittleEndian.Uint32(ptr[4:8])
 }
@@ -3,22 +3,17 @@ package storage
 import "fmt"
 
 func (bt *BTree) canMergeLeaf(sib, leaf *LeafPage) bool {
-	return sib.GetSpaceUsed()+leaf.GetSpaceUsed() < PageSize
-}
-
-func (bt *BTree) canMergeInternal(sib, page *InternalPage) bool {
-	sibKeys := sib.GetNumKeys()
-	pageKeys := page.GetNumKeys()
-
-	if sibKeys+pageKeys > maxChildren-1 {
-		return false
-	}
-
-	if sib.GetSpaceUsed()+page.GetSpaceUsed() > PageSize {
-		return false
+	// The merged page may share a shorter prefix than either half, which makes every cell longer
+	if sib.IsPrefixed() {
+		return leafSpaceFor(append(sib.records(), leaf.records()...), true) <= bt.pager.pageSize
 	}
+	return sib.GetSpaceUsed()+leaf.GetSpaceUsed() < bt.pager.pageSize
+}
 
-	return true
+// The separator between the two pages comes down from the parent into the merged page
+func (bt *BTree) canMergeInternal(sib, page, parent *InternalPage, sepIdx int) bool {
+	used := sib.GetSpaceUsed() + page.GetSpaceUsed() - internalDataStart
+	return used+internalCellSize(parent.GetKey(sepIdx)) <= bt.pager.pageSize
 }
 
 func (bt *BTree) mergeLeaf(sib, leaf *LeafPage, parent *InternalPage, sepIdx int, right bool) error {
@@ -41,48 +36,17 @@ func (bt *BTree) mergeLeaf(sib, leaf *LeafPage, parent *InternalPage, sepIdx int
 		orphan = leaf
 	}
 
-	lNum := leftLeaf.GetNumCells()
-	rNum := rightLeaf.GetNumCells()
-
-	records := make([]rec, 0, lNum+rNum)
-
-	for i := 0; i < lNum; i++ {
-		ptr := leftLeaf.GetCellPointer(i)
-		k, v := leftLeaf.ReadRecord(ptr)
-
-		kCopy := append([]byte(nil), k...)
-		vCopy := append([]byte(nil), v...)
-		records = append(records, rec{key: kCopy, val: vCopy})
-	}
-	for i := 0; i < rNum; i++ {
-		ptr := rightLeaf.GetCellPointer(i)
-		k, v := rightLeaf.ReadRecord(ptr)
-
-		kCopy := append([]byte(nil), k...)
-		vCopy := append([]byte(nil), v...)
-		records = append(records, rec{key: kCopy, val: vCopy})
-	}
-
-	dest.SetNumCells(0)
-	dest.SetFreeStart(dataStart)
-	dest.SetFreeEnd(PageSize)
-
-	for i := 0; i < len(records); i++ {
-		off, err := dest.WriteRecord(records[i].key, records[i].val)
-		if err != nil {
-			return err
-		}
-		dest.SetCellPointer(i, off)
-	}
+	records := append(leftLeaf.records(), rightLeaf.records()...)
 
-	dest.SetNumCells(len(records))
-	dest.SetFreeStart(dataStart + len(records)*2)
-
-	if err := parent.DeleteChild(sepIdx + 1); err != nil {
+	if err := dest.rebuild(records); err != nil {
 		return err
 	}
 
-	if err := parent.DeleteKey(sepIdx); err != nil {
+	// dest is always the left leaf so it takes over the orphan's next link
+	next := orphan.GetNext()
+	dest.SetNext(next)
+
+	if err := parent.RemoveSeparator(sepIdx); err != nil {
 		return err
 	}
 
@@ -96,6 +60,16 @@ func (bt *BTree) mergeLeaf(sib, leaf *LeafPage, parent *InternalPage, sepIdx int
 	writePage(dest.Page)
 	writePage(parent.Page)
 
+	if next != InvalidPage {
+		np, rErr := bt.modify(next)
+		if rErr != nil && err == nil {
+			err = rErr
+		} else if rErr == nil {
+			WrapLeafPage(np).SetPrev(dest.Page.ID)
+			writePage(np)
+		}
+	}
+
 	bt.FreePage(orphan.Page.ID)
 	return err
 }
@@ -116,55 +90,23 @@ func (bt *BTree) mergeInternal(sib, page, parent *InternalPage, sepIdx int, righ
 		rightNode = page
 	}
 
-	lNum := leftNode.GetNumKeys()
-	rNum := rightNode.GetNumKeys()
-
-	sepPtr := parent.GetKeyPointer(sepIdx)
-	sepKey := parent.ReadKey(sepPtr)
+	lKeys, lChildren := leftNode.entries()
+	rKeys, rChildren := rightNode.entries()
 
-	keys := make([][]byte, 0, lNum+1+rNum)
-	children := make([]uint32, 0, lNum+rNum+2)
-
-	for i := 0; i < lNum; i++ {
-		children = append(children, leftNode.GetChild(i))
-		ptr := leftNode.GetKeyPointer(i)
-		keys = append(keys, leftNode.ReadKey(ptr))
-	}
-	children = append(children, leftNode.GetRightChild())
+	keys := make([][]byte, 0, len(lKeys)+1+len(rKeys))
+	keys = append(keys, lKeys...)
+	keys = append(keys, append([]byte(nil), parent.GetKey(sepIdx)...))
+	keys = append(keys, rKeys...)
 
-	keys = append(keys, sepKey)
-
-	for i := 0; i < rNum; i++ {
-		children = append(children, rightNode.GetChild(i))
-		ptr := rightNode.GetKeyPointer(i)
-		keys = append(keys, rightNode.ReadKey(ptr))
-	}
-	children = append(children, rightNode.GetRightChild())
-	leftNode.SetNumKeys(0)
-	leftNode.SetFreeStart(keyPointerOffset)
-	leftNode.SetFreeEnd(PageSize)
-
-	for i, key := range keys {
-		off, err := leftNode.WriteKey(key)
-		if err != nil {
-			return err
-		}
-		leftNode.SetKeyPointer(i, off)
-	}
-
-	leftNode.SetNumKeys(len(keys))
-	leftNode.SetFreeStart(keyPointerOffset + len(keys)*2)
-
-	for i := 0; i < len(children)-1; i++ {
-		leftNode.SetChild(i, children[i])
-	}
-	leftNode.SetRightChild(children[len(children)-1])
+	children := make([]uint32, 0, len(lChildren)+len(rChildren))
+	children = append(children, lChildren...)
+	children = append(children, rChildren...)
 
-	if err := parent.DeleteChild(sepIdx + 1); err != nil {
+	if err := leftNode.rebuild(keys, children); err != nil {
 		return err
 	}
 
-	if err := parent.DeleteKey(sepIdx); err != nil {
+	if err := parent.RemoveSeparator(sepIdx); err != nil {
 		return err
 	}
 
@@ -1,6 +1,10 @@
 package storage
 
-import "encoding/binary"
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
 
 type MetaPage struct {
 	Page *Page
@@ -9,16 +13,58 @@ type MetaPage struct {
 var sig = []byte{'G', 'o', 'S', 't', 'o', 'r', 'e', '2', '5'}
 
 const (
-	sizeOffset         int = 10
-	rootOffset         int = 12
-	freePageHeadOffset int = 16
+	sigOffset          int = pageHeaderSize
+	sizeOffset         int = sigOffset + 9
+	rootOffset         int = sigOffset + 11
+	freePageHeadOffset int = sigOffset + 15
+	uuidOffset         int = sigOffset + 19
+	checkpointOffset   int = sigOffset + 35
+	formatOffset       int = sigOffset + 43
+	featuresOffset     int = sigOffset + 45
+	lsnOffset          int = sigOffset + 49
+
+	// Free pages only hold the ID of the next page on the free list
+	freeNextOffset int = pageHeaderSize
+)
+
+// Optional layouts picked when a database is created, recorded in the meta
+// page. Files with features this release doesn't know are refused
+const (
+	// Leaves store the prefix their keys share once
+	FeaturePrefixCompression uint32 = 1 << iota
+
+	knownFeatures = FeaturePrefixCompression
 )
 
+// Random identifier given to a database when it is created, the WAL records
+// it in its header so a log is never replayed into the wrong file
+type DatabaseID [16]byte
+
+func NewDatabaseID() (DatabaseID, error) {
+	var id DatabaseID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, err
+	}
+
+	// RFC 4122 version 4
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id, nil
+}
+
+func (id DatabaseID) IsZero() bool {
+	return id == DatabaseID{}
+}
+
+func (id DatabaseID) String() string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
+
 func NewMetaPage(page *Page) *MetaPage {
 	page.Data[0] = byte(PageTypeMeta)
 
 	var pSize [2]byte
-	binary.LittleEndian.PutUint16(pSize[:], uint16(PageSize))
+	binary.LittleEndian.PutUint16(pSize[:], uint16(len(page.Data)))
 
 	var rootId [4]byte
 	binary.LittleEndian.PutUint32(rootId[:], uint32(1))
@@ -26,10 +72,11 @@ func NewMetaPage(page *Page) *MetaPage {
 	var freeHead [4]byte
 	binary.LittleEndian.PutUint32(freeHead[:], InvalidPage)
 
-	copy(page.Data[1:], sig)
+	copy(page.Data[sigOffset:], sig)
 	copy(page.Data[sizeOffset:], pSize[:])
 	copy(page.Data[rootOffset:], rootId[:])
 	copy(page.Data[freePageHeadOffset:], freeHead[:])
+	binary.LittleEndian.PutUint16(page.Data[formatOffset:], FormatVersion)
 
 	page.Type = PageTypeMeta
 
@@ -44,6 +91,18 @@ func WrapMetaPage(page *Page) *MetaPage {
 	}
 }
 
+// Stored in 16 bits, a 64 KiB page size is stored as 0
+func (mp *MetaPage) GetPageSize() int {
+	return decodePageSize(binary.LittleEndian.Uint16(mp.Page.Data[sizeOffset : sizeOffset+2]))
+}
+
+func decodePageSize(raw uint16) int {
+	if raw == 0 {
+		return MaxPageSize
+	}
+	return int(raw)
+}
+
 func (mp *MetaPage) GetRootID() uint32 {
 	return binary.LittleEndian.Uint32(mp.Page.Data[rootOffset : rootOffset+4])
 }
@@ -65,3 +124,55 @@ func (mp *MetaPage) SetFreeHead(id uint32) {
 
 	copy(mp.Page.Data[freePageHeadOffset:freePageHeadOffset+4], freeHead[:])
 }
+
+func (mp *MetaPage) GetDatabaseID() DatabaseID {
+	var id DatabaseID
+	copy(id[:], mp.Page.Data[uuidOffset:uuidOffset+16])
+	return id
+}
+
+func (mp *MetaPage) SetDatabaseID(id DatabaseID) {
+	copy(mp.Page.Data[uuidOffset:uuidOffset+16], id[:])
+}
+
+// Bumped every time the WAL is reset, the log header carries it as a salt
+func (mp *MetaPage) GetCheckpointSeq() uint64 {
+	return binary.LittleEndian.Uint64(mp.Page.Data[checkpointOffset : checkpointOffset+8])
+}
+
+func (mp *MetaPage) SetCheckpointSeq(seq uint64) {
+	binary.LittleEndian.PutUint64(mp.Page.Data[checkpointOffset:checkpointOffset+8], seq)
+}
+
+// Files from before the version was recorded have 0 here
+func (mp *MetaPage) GetFormatVersion() int {
+	return decodeFormatVersion(binary.LittleEndian.Uint16(mp.Page.Data[formatOffset : formatOffset+2]))
+}
+
+func (mp *MetaPage) SetFormatVersion(version int) {
+	binary.LittleEndian.PutUint16(mp.Page.Data[formatOffset:formatOffset+2], uint16(version))
+}
+
+func (mp *MetaPage) GetFeatures() uint32 {
+	return binary.LittleEndian.Uint32(mp.Page.Data[featuresOffset : featuresOffset+4])
+}
+
+func (mp *MetaPage) SetFeatures(features uint32) {
+	binary.LittleEndian.PutUint32(mp.Page.Data[featuresOffset:featuresOffset+4], features)
+}
+
+// LSN of the last frame whose pages are in the file, set when the WAL is reset
+func (mp *MetaPage) GetLSN() uint64 {
+	return binary.LittleEndian.Uint64(mp.Page.Data[lsnOffset : lsnOffset+8])
+}
+
+func (mp *MetaPage) SetLSN(lsn uint64) {
+	binary.LittleEndian.PutUint64(mp.Page.Data[lsnOffset:lsnOffset+8], lsn)
+}
+
+func decodeFormatVersion(raw uint16) int {
+	if raw == 0 {
+		return formatUnversioned
+	}
+	return int(raw)
+}
@@ -0,0 +1,430 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"go.store/internal/logger"
+)
+
+// Files written before pages carried a checksum in their header use the same
+// layouts with every offset starting right after the page type. Leaves from
+// before sibling links have a shorter header and never updated their free start.
+// migrateLegacy walks the old tree and loads every pair into a new file
+
+const (
+	// Before the page size was stored in the meta page every file used 4 KiB pages
+	legacyPageSize = 4096
+
+	legacySigOffset  int = 1
+	legacyRootOffset int = 12
+	legacyUUIDOffset int = 20
+
+	legacyNumOffset       int = 1
+	legacyStartOffset     int = 3
+	legacyDataStart       int = 7
+	legacyLinkedDataStart int = 15
+
+	legacyRChildOffset     int = 7
+	legacyChildStartOffset int = 11
+
+	legacyOverflowNextOffset int = 1
+	legacyOverflowLenOffset  int = 5
+	legacyOverflowDataStart  int = 7
+
+	// Deeper than any tree we could have written, guards against cycles
+	legacyMaxDepth = 32
+)
+
+type legacyReader struct {
+	file     *os.File
+	numPages uint32
+}
+
+func (r *legacyReader) page(id uint32) ([]byte, error) {
+	if id >= r.numPages {
+		return nil, fmt.Errorf("migrate: %w (page=%d)", ErrInvalidPointer, id)
+	}
+
+	data := make([]byte, legacyPageSize)
+	if _, err := r.file.ReadAt(data, int64(id)*legacyPageSize); err != nil {
+		return nil, fmt.Errorf("migrate: reading page %d: %s", id, err)
+	}
+	return data, nil
+}
+
+// Visit every pair below id in key order
+func (r *legacyReader) walk(id uint32, depth int, fn func(key, val []byte) error) error {
+	if depth > legacyMaxDepth {
+		return fmt.Errorf("migrate: %w", ErrCorruptTree)
+	}
+
+	data, err := r.page(id)
+	if err != nil {
+		return err
+	}
+
+	n := int(binary.LittleEndian.Uint16(data[legacyNumOffset:]))
+
+	switch PageType(data[0]) {
+	case PageTypeInternal:
+		for i := 0; i < n; i++ {
+			child := binary.LittleEndian.Uint32(data[legacyChildStartOffset+i*4:])
+			if err := r.walk(child, depth+1, fn); err != nil {
+				return err
+			}
+		}
+		return r.walk(binary.LittleEndian.Uint32(data[legacyRChildOffset:]), depth+1, fn)
+
+	case PageTypeLeaf:
+		// Leaves with sibling links keep the free start in step with the pointer
+		// array, earlier leaves always had their pointers right after the header
+		ptrs := legacyLinkedDataStart
+		if int(binary.LittleEndian.Uint16(data[legacyStartOffset:])) != ptrs+n*2 {
+			ptrs = legacyDataStart
+		}
+		if ptrs+n*2 > legacyPageSize {
+			return fmt.Errorf("migrate: %w (page=%d)", ErrCorruptTree, id)
+		}
+
+		for i := 0; i < n; i++ {
+			key, val, err := r.record(data, int(binary.LittleEndian.Uint16(data[ptrs+i*2:])))
+			if err != nil {
+				return fmt.Errorf("migrate: page %d: %w", id, err)
+			}
+			if err := fn(key, val); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("migrate: %w (page=%d type=%d)", ErrCorruptTree, id, data[0])
+	}
+}
+
+func (r *legacyReader) record(data []byte, off int) ([]byte, []byte, error) {
+	if off+4 > legacyPageSize {
+		return nil, nil, ErrCorruptTree
+	}
+
+	keyLen := int(binary.LittleEndian.Uint16(data[off:]))
+	rawLen := binary.LittleEndian.Uint16(data[off+2:])
+	valLen := int(rawLen &^ overflowFlag)
+
+	if off+4+keyLen+valLen > legacyPageSize {
+		return nil, nil, ErrCorruptTree
+	}
+
+	key := data[off+4 : off+4+keyLen]
+	val := data[off+4+keyLen : off+4+keyLen+valLen]
+
+	if rawLen&overflowFlag == 0 {
+		return key, val, nil
+	}
+
+	if valLen != overflowPtrSize {
+		return nil, nil, ErrCorruptOverflow
+	}
+
+	val, err := r.overflow(decodeOverflowPointer(val))
+	return key, val, err
+}
+
+func (r *legacyReader) overflow(total, first uint32) ([]byte, error) {
+	val := make([]byte, 0, total)
+	curr := first
+
+	for uint32(len(val)) < total {
+		data, err := r.page(curr)
+		if err != nil || PageType(data[0]) != PageTypeOverflow {
+			return nil, ErrCorruptOverflow
+		}
+
+		n := int(binary.LittleEndian.Uint16(data[legacyOverflowLenOffset:]))
+		if n == 0 || legacyOverflowDataStart+n > legacyPageSize {
+			return nil, ErrCorruptOverflow
+		}
+
+		val = append(val, data[legacyOverflowDataStart:legacyOverflowDataStart+n]...)
+		curr = binary.LittleEndian.Uint32(data[legacyOverflowNextOffset:])
+	}
+
+	if uint32(len(val)) != total {
+		return nil, ErrCorruptOverflow
+	}
+	return val, nil
+}
+
+// Rebuild a legacy file in the current layout. The new file is written next to
+// the old one and renamed over it once it is complete
+func migrateLegacy(path string, log *logger.Logger) error {
+	old, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("migrate: %s", err)
+	}
+	defer old.Close()
+
+	info, err := old.Stat()
+	if err != nil {
+		return fmt.Errorf("migrate: %s", err)
+	}
+	if info.Size()%legacyPageSize != 0 {
+		return fmt.Errorf("migrate: %w", ErrCorruptFile)
+	}
+
+	r := &legacyReader{file: old, numPages: uint32(info.Size() / legacyPageSize)}
+
+	meta, err := r.page(0)
+	if err != nil {
+		return err
+	}
+
+	// Keep the database ID if the file already had one
+	var id DatabaseID
+	copy(id[:], meta[legacyUUIDOffset:legacyUUIDOffset+16])
+	if id.IsZero() {
+		if id, err = NewDatabaseID(); err != nil {
+			return err
+		}
+	}
+
+	tmp := path + ".migrate"
+	os.Remove(tmp)
+	os.Remove(tmp + ".wal")
+
+	f, err := createDatabase(tmp, id, DefaultPageSize, 0)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	pager, err := OpenWithOptions(tmp, log, Options{Durability: DurabilityNone})
+	if err != nil {
+		return err
+	}
+
+	bt, err := NewBTree(pager, log)
+	if err != nil {
+		pager.Close()
+		return err
+	}
+
+	count := 0
+	root := binary.LittleEndian.Uint32(meta[legacyRootOffset:])
+	err = r.walk(root, 0, func(key, val []byte) error {
+		count++
+		return bt.Put(key, val, PutUpsert)
+	})
+
+	if cErr := bt.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("migrate: %s", err)
+	}
+
+	log.Infof("Migrated %s to checksummed pages (%d keys)", path, count)
+	return nil
+}
+
+// Later layout changes rewrite pages of the tree in place. treeMigrator walks
+// the tree from the root on the raw file and hands each page to rewrite
+type treeMigrator struct {
+	file     *os.File
+	pageSize int
+	numPages uint32
+	pages    int
+	seen     map[uint32]bool
+
+	// Update data in place and return the children of the page, changed
+	// pages are written back
+	rewrite func(id uint32, data []byte) (children []uint32, changed bool, err error)
+}
+
+func (m *treeMigrator) page(id uint32) ([]byte, error) {
+	if id == 0 || id >= m.numPages {
+		return nil, fmt.Errorf("migrate: %w (page=%d)", ErrInvalidPointer, id)
+	}
+
+	data := make([]byte, m.pageSize)
+	if _, err := m.file.ReadAt(data, int64(id)*int64(m.pageSize)); err != nil {
+		return nil, fmt.Errorf("migrate: reading page %d: %s", id, err)
+	}
+	if !verifyChecksum(data) {
+		return nil, &ErrCorruptPage{PageID: id}
+	}
+	return data, nil
+}
+
+func (m *treeMigrator) walk(id uint32, depth int) error {
+	if depth > legacyMaxDepth {
+		return fmt.Errorf("migrate: %w", ErrCorruptTree)
+	}
+
+	// Rewriting a page twice would read the new layout as the old one
+	if m.seen[id] {
+		return fmt.Errorf("migrate: %w (page %d is referenced twice)", ErrCorruptTree, id)
+	}
+	m.seen[id] = true
+
+	data, err := m.page(id)
+	if err != nil {
+		return err
+	}
+
+	switch PageType(data[0]) {
+	case PageTypeLeaf, PageTypeInternal:
+	default:
+		return fmt.Errorf("migrate: %w (page=%d type=%d)", ErrCorruptTree, id, data[0])
+	}
+
+	children, changed, err := m.rewrite(id, data)
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		stampChecksum(data)
+		if _, err := m.file.WriteAt(data, int64(id)*int64(m.pageSize)); err != nil {
+			return fmt.Errorf("migrate: writing page %d: %s", id, err)
+		}
+		m.pages++
+	}
+
+	for _, child := range children {
+		if err := m.walk(child, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run rewrite over every page of the tree in the file at path, then mark the
+// file as format version to
+func migrateTree(path string, log *logger.Logger, to int, desc string, rewrite func(uint32, []byte) ([]uint32, bool, error)) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return fmt.Errorf("migrate: %s", err)
+	}
+	defer f.Close()
+
+	pageSize, _, err := checkSignature(f)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("migrate: %s", err)
+	}
+	if !ValidPageSize(pageSize) || info.Size()%int64(pageSize) != 0 {
+		return fmt.Errorf("migrate: %w", ErrCorruptFile)
+	}
+
+	m := &treeMigrator{
+		file:     f,
+		pageSize: pageSize,
+		numPages: uint32(info.Size() / int64(pageSize)),
+		seen:     make(map[uint32]bool),
+		rewrite:  rewrite,
+	}
+
+	metaData := make([]byte, pageSize)
+	if _, err := f.ReadAt(metaData, 0); err != nil {
+		return fmt.Errorf("migrate: reading meta page: %s", err)
+	}
+	if !verifyChecksum(metaData) {
+		return &ErrCorruptPage{PageID: 0}
+	}
+	meta := WrapMetaPage(&Page{Data: metaData})
+
+	if err := m.walk(meta.GetRootID(), 0); err != nil {
+		return err
+	}
+
+	// Only once every page is rewritten does the file claim the new format
+	meta.SetFormatVersion(to)
+	stampChecksum(metaData)
+	if _, err := f.WriteAt(metaData, 0); err != nil {
+		return fmt.Errorf("migrate: writing meta page: %s", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("migrate: %s", err)
+	}
+
+	log.Infof("Migrated %s to %s (%d pages rewritten)", path, desc, m.pages)
+	return nil
+}
+
+// Internal pages in format 3 reserved room for 128 child pointers after the
+// header and kept their keys behind them. migrateFanout rewrites every internal
+// page of the tree, the new layout always holds what the old one did
+const (
+	fixedRChildOffset    int = pageHeaderSize + 6
+	fixedChildStart      int = pageHeaderSize + 10
+	fixedMaxChildren     int = 128
+	fixedKeyPointerStart int = fixedChildStart + fixedMaxChildren*4
+)
+
+func migrateFanout(path string, log *logger.Logger) error {
+	return migrateTree(path, log, formatFixedFanout+1, "variable fanout internal pages", rewriteFixedFanout)
+}
+
+func rewriteFixedFanout(id uint32, data []byte) ([]uint32, bool, error) {
+	if PageType(data[0]) == PageTypeLeaf {
+		return nil, false, nil
+	}
+
+	n := int(binary.LittleEndian.Uint16(data[numKeysOffset:]))
+	if n > fixedMaxChildren-1 {
+		return nil, false, fmt.Errorf("migrate: %w (page=%d keys=%d)", ErrCorruptTree, id, n)
+	}
+
+	keys := make([][]byte, n)
+	children := make([]uint32, n+1)
+
+	for i := 0; i < n; i++ {
+		off := int(binary.LittleEndian.Uint16(data[fixedKeyPointerStart+i*2:]))
+		key, ok := readCheckedKey(data, off, 2)
+		if !ok {
+			return nil, false, fmt.Errorf("migrate: %w (page=%d key=%d)", ErrCorruptTree, id, i)
+		}
+
+		keys[i] = append([]byte(nil), key...)
+		children[i] = binary.LittleEndian.Uint32(data[fixedChildStart+i*4:])
+	}
+	children[n] = binary.LittleEndian.Uint32(data[fixedRChildOffset:])
+
+	p := NewPage(len(data))
+	ip := NewInternalPage(p)
+	if err := ip.rebuild(keys, children); err != nil {
+		return nil, false, fmt.Errorf("migrate: page %d: %w", id, err)
+	}
+
+	copy(data, p.Data)
+	return children, true, nil
+}
+
+// Leaves in format 5 were compacted on every delete and stored their free
+// start where the count of fragmented bytes now lives. Their cells were always
+// back to back, so zeroing it is all they need
+func migrateFragmented(path string, log *logger.Logger) error {
+	return migrateTree(path, log, formatEagerCompaction+1, "lazily compacted leaves", rewriteEagerCompaction)
+}
+
+func rewriteEagerCompaction(id uint32, data []byte) ([]uint32, bool, error) {
+	if PageType(data[0]) == PageTypeInternal {
+		_, children := WrapInternalPage(&Page{ID: id, Data: data}).entries()
+		return children, false, nil
+	}
+
+	binary.LittleEndian.PutUint16(data[fragmentedOffset:], 0)
+	return nil, true, nil
+}
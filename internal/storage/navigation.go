@@ -29,7 +29,7 @@ func (s *ParentStack) Pop() (Parent, bool) {
 
 // Single function to traverse the tree and return the correct leaf page / stack with visited parents
 func (bt *BTree) descend(key []byte) (*LeafPage, *ParentStack, error) {
-	curr := bt.root
+	curr := bt.root.Load()
 	stack := &ParentStack{}
 
 	for {
@@ -43,17 +43,33 @@ func (bt *BTree) descend(key []byte) (*LeafPage, *ParentStack, error) {
 			return WrapLeafPage(page), stack, nil
 
 		case PageTypeInternal:
-			internal := WrapInternalPage(page)
-			idx := internal.FindInsertIndex(key)
-
 			stack.Push(Parent{pageID: curr})
+			curr = childFor(key)(WrapInternalPage(page))
+		}
+	}
+}
+
+// Picks which child of an internal page a descent follows
+type chooseChild func(*InternalPage) uint32
+
+// Follow the child key belongs under
+func childFor(key []byte) chooseChild {
+	return func(internal *InternalPage) uint32 {
+		idx := internal.FindInsertIndex(key)
+		if idx < internal.GetNumKeys() {
+			return internal.GetChild(idx)
+		}
+		return internal.GetRightChild()
+	}
+}
 
-			if idx < internal.GetNumKeys() {
-				curr = internal.GetChild(idx)
-			} else {
-				curr = internal.GetRightChild()
-			}
+// Follow the leftmost or rightmost edge of the tree
+func edgeChild(rightmost bool) chooseChild {
+	return func(internal *InternalPage) uint32 {
+		if rightmost || internal.GetNumKeys() == 0 {
+			return internal.GetRightChild()
 		}
+		return internal.GetChild(0)
 	}
 }
 
@@ -0,0 +1,108 @@
+package storage
+
+import "fmt"
+
+// Helpers to move large values in and out of overflow page chains
+
+func (bt *BTree) needsOverflow(key, val []byte) bool {
+	return 4+len(key)+len(val) > maxInlineRecord(bt.pager.pageSize)
+}
+
+// Spill val into a new chain of overflow pages and return the first page ID
+func (bt *BTree) writeOverflow(val []byte) (uint32, error) {
+	capacity := overflowCapacity(bt.pager.pageSize)
+	n := (len(val) + capacity - 1) / capacity
+
+	pages := make([]*OverflowPage, n)
+	for i := range pages {
+		pages[i] = NewOverflowPage(bt.pager.AllocatePage())
+	}
+
+	for i, op := range pages {
+		start := i * capacity
+		end := min(start+capacity, len(val))
+		op.SetData(val[start:end])
+
+		if i+1 < n {
+			op.SetNext(pages[i+1].Page.ID)
+		}
+
+		if err := bt.writePage(op.Page); err != nil {
+			return InvalidPage, err
+		}
+	}
+
+	return pages[0].Page.ID, nil
+}
+
+func (bt *BTree) readOverflow(total, first uint32) ([]byte, error) {
+	// Only readers follow chains, and the chain can't be freed while they hold its leaf
+	return readChain(bt.pager.peekPage, bt.pager.pageCount(), total, first)
+}
+
+// Follow a chain of overflow pages through read, which is either the cache or a snapshot
+func readChain(read func(uint32) (*Page, error), numPages, total, first uint32) ([]byte, error) {
+	val := make([]byte, 0, total)
+	curr := first
+
+	for uint32(len(val)) < total {
+		if curr == InvalidPage || curr >= numPages {
+			return nil, fmt.Errorf("readOverflow: %w (page=%d)", ErrCorruptOverflow, curr)
+		}
+
+		p, err := read(curr)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.Type != PageTypeOverflow {
+			return nil, fmt.Errorf("readOverflow: %w (page=%d)", ErrCorruptOverflow, curr)
+		}
+
+		op := WrapOverflowPage(p)
+		val = append(val, op.GetData()...)
+		curr = op.GetNext()
+	}
+
+	if uint32(len(val)) != total {
+		return nil, fmt.Errorf("readOverflow: %w (length)", ErrCorruptOverflow)
+	}
+
+	return val, nil
+}
+
+// Return every page in the chain to the free list
+func (bt *BTree) freeOverflow(first uint32) {
+	curr := first
+
+	for curr != InvalidPage && curr < bt.pager.numPages {
+		p, err := bt.pager.ReadPage(curr)
+		if err != nil || p.Type != PageTypeOverflow {
+			bt.log.Errorf("freeOverflow: %v (page:%d)", ErrCorruptOverflow, curr)
+			return
+		}
+
+		next := WrapOverflowPage(p).GetNext()
+		bt.FreePage(curr)
+		curr = next
+	}
+}
+
+// Resolve the value of the cell at off, following its overflow chain if needed
+func (bt *BTree) readValue(leaf *LeafPage, off uint16) ([]byte, error) {
+	// Copy inline values so callers never hold a slice into the cached page
+	if !leaf.IsOverflow(off) {
+		_, val := leaf.ReadRecord(off)
+		return append([]byte(nil), val...), nil
+	}
+
+	return bt.readOverflow(leaf.ReadOverflowPointer(off))
+}
+
+// Free the overflow chain of the cell at off if it has one
+func (bt *BTree) freeValue(leaf *LeafPage, off uint16) {
+	if leaf.IsOverflow(off) {
+		_, first := leaf.ReadOverflowPointer(off)
+		bt.freeOverflow(first)
+	}
+}
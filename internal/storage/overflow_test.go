@@ -0,0 +1,150 @@
+package storage_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"go.store/internal/engine"
+)
+
+func largeValue(i, size int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("%04d", i)), size/4)
+}
+
+func TestOverflowValues(t *testing.T) {
+	db := openTestDB(t, "test_overflow")
+
+	const N = 50
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		if err := db.Set(k, largeValue(i, 100*1024)); err != nil {
+			t.Fatalf("Set %s failed: %v", k, err)
+		}
+	}
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		v, err := db.Get(k)
+		if err != nil {
+			t.Fatalf("Get %s failed: %v", k, err)
+		}
+		if !bytes.Equal(v, largeValue(i, 100*1024)) {
+			t.Fatalf("Get %s returned wrong value", k)
+		}
+	}
+
+	// Shrinking a value back below the inline threshold must drop the chain
+	for i := 0; i < N; i += 2 {
+		k := fmt.Sprintf("%08d", i)
+		if err := db.Set(k, []byte("small")); err != nil {
+			t.Fatalf("Overwrite %s failed: %v", k, err)
+		}
+	}
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		v, err := db.Get(k)
+		if err != nil {
+			t.Fatalf("Get %s failed: %v", k, err)
+		}
+
+		want := largeValue(i, 100*1024)
+		if i%2 == 0 {
+			want = []byte("small")
+		}
+		if !bytes.Equal(v, want) {
+			t.Fatalf("Get %s returned wrong value after overwrite", k)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func TestOverflowPagesAreReused(t *testing.T) {
+	cfg := createTestDB(t, "test_overflow_reuse")
+
+	db, err := engine.Open("test_overflow_reuse", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const N = 20
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		if err := db.Set(k, largeValue(i, 64*1024)); err != nil {
+			t.Fatalf("Set %s failed: %v", k, err)
+		}
+	}
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		if err := db.Delete(k); err != nil {
+			t.Fatalf("Delete %s failed: %v", k, err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	info, err := os.Stat(testDBPath(cfg, "test_overflow_reuse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	peak := info.Size()
+
+	// Freed chains should be handed out again after reopening
+	db, err = engine.Open("test_overflow_reuse", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		if err := db.Set(k, largeValue(i, 64*1024)); err != nil {
+			t.Fatalf("Set %s failed: %v", k, err)
+		}
+	}
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		v, err := db.Get(k)
+		if err != nil {
+			t.Fatalf("Get %s failed: %v", k, err)
+		}
+		if !bytes.Equal(v, largeValue(i, 64*1024)) {
+			t.Fatalf("Get %s returned wrong value", k)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	info, err = os.Stat(testDBPath(cfg, "test_overflow_reuse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() > peak {
+		t.Fatalf("Expected freed overflow pages to be reused, file grew from %d to %d", peak, info.Size())
+	}
+}
+
+func TestKeyTooLarge(t *testing.T) {
+	db := openTestDB(t, "test_key_too_large")
+
+	if err := db.Set(string(bytes.Repeat([]byte("k"), 4096)), []byte("v")); err == nil {
+		t.Fatalf("Expected oversized key to be rejected")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package storage
+
+import "encoding/binary"
+
+// Overflow pages hold values that are too large to be stored inline in a leaf.
+// Each page stores a chunk of the value and a pointer to the next page in the chain
+
+type OverflowPage struct {
+	Page *Page
+}
+
+const (
+	overflowNextOffset int = pageHeaderSize
+	overflowLenOffset  int = pageHeaderSize + 4
+	overflowDataStart  int = pageHeaderSize + 6
+)
+
+// Bytes of a value each overflow page of the given size holds
+func overflowCapacity(pageSize int) int {
+	return pageSize - overflowDataStart
+}
+
+func NewOverflowPage(page *Page) *OverflowPage {
+	page.Type = PageTypeOverflow
+	page.Data[0] = byte(PageTypeOverflow)
+
+	op := &OverflowPage{
+		Page: page,
+	}
+	op.SetNext(InvalidPage)
+	op.SetDataLen(0)
+
+	return op
+}
+
+func WrapOverflowPage(page *Page) *OverflowPage {
+	return &OverflowPage{
+		Page: page,
+	}
+}
+
+// GETTERS
+func (op *OverflowPage) GetNext() uint32 {
+	raw := op.Page.Data[overflowNextOffset : overflowNextOffset+4]
+	return binary.LittleEndian.Uint32(raw)
+}
+
+func (op *OverflowPage) GetDataLen() int {
+	raw := op.Page.Data[overflowLenOffset : overflowLenOffset+2]
+	return int(binary.LittleEndian.Uint16(raw))
+}
+
+func (op *OverflowPage) GetData() []byte {
+	return op.Page.Data[overflowDataStart : overflowDataStart+op.GetDataLen()]
+}
+
+// SETTERS
+func (op *OverflowPage) SetNext(id uint32) {
+	binary.LittleEndian.PutUint32(op.Page.Data[overflowNextOffset:overflowNextOffset+4], id)
+}
+
+func (op *OverflowPage) SetDataLen(n int) {
+	binary.LittleEndian.PutUint16(op.Page.Data[overflowLenOffset:overflowLenOffset+2], uint16(n))
+}
+
+func (op *OverflowPage) SetData(data []byte) {
+	n := copy(op.Page.Data[overflowDataStart:], data)
+	op.SetDataLen(n)
+}
@@ -1,9 +1,25 @@
 package storage
 
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+const InvalidPage uint32 = 0xFFFFFFFF
+
+// The page size is chosen when a database is created and stored in its meta page.
+// Offsets inside a page are 16 bits so a 64 KiB page is the largest we can address
 const (
-	InvalidPage uint32 = 0xFFFFFFFF
-	PageSize           = 4096
-	maxChildren int    = 128
+	DefaultPageSize = 4096
+	MinPageSize     = 4096
+	MaxPageSize     = 65536
+)
+
+// Every page starts with its type and a CRC32 of the rest of the page, the
+// checksum is written when the page is flushed to the DB file and checked on read
+const (
+	pageChecksumOffset int = 1
+	pageHeaderSize     int = 5
 )
 
 type PageType uint8
@@ -22,8 +38,37 @@ type Page struct {
 	Data []byte
 }
 
-func NewPage() *Page {
+func NewPage(size int) *Page {
 	return &Page{
-		Data: make([]byte, PageSize),
+		Data: make([]byte, size),
 	}
 }
+
+func ValidPageSize(size int) bool {
+	return size >= MinPageSize && size <= MaxPageSize && size&(size-1) == 0
+}
+
+// The free space of a page ends at its last byte, in a 64 KiB page that offset
+// does not fit in 16 bits and is stored as 0
+func decodeFreeEnd(raw uint16, size int) int {
+	if raw == 0 {
+		return size
+	}
+	return int(raw)
+}
+
+func pageChecksum(data []byte) uint32 {
+	h := crc32.NewIEEE()
+	h.Write(data[:pageChecksumOffset])
+	h.Write(data[pageHeaderSize:])
+	return h.Sum32()
+}
+
+// Store the checksum in the page header, called right before the page is written to the file
+func stampChecksum(data []byte) {
+	binary.LittleEndian.PutUint32(data[pageChecksumOffset:pageHeaderSize], pageChecksum(data))
+}
+
+func verifyChecksum(data []byte) bool {
+	return binary.LittleEndian.Uint32(data[pageChecksumOffset:pageHeaderSize]) == pageChecksum(data)
+}
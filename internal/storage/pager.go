@@ -5,18 +5,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"sync"
+	"time"
 
 	"go.store/internal/logger"
 )
 
-type cachedPage struct {
-	page  *Page
-	dirty bool
-}
-
 type Pager struct {
 	file      *os.File
 	filePath  string
@@ -25,15 +20,66 @@ type Pager struct {
 	pageSize  int
 	numPages  uint32
 	replaying bool
+	readOnly  bool
 
-	cache map[uint32]*cachedPage
+	cache *pageCache
+	epoch uint64
 	mu    sync.Mutex
+	// Pages being read from the file, guarded by mu
+	loading map[uint32]*pageLoad
+
+	// State of the running frame, only touched by the writer
+	inFrame       bool
+	frameLSN      uint64
+	frameImages   map[uint32]frameImage
+	frameNumPages uint32
 
+	// Page images kept for open snapshots, guarded by mu
+	versions versionStore
+
+	// Held shared by every tree operation and exclusively by those that need
+	// the whole tree to themselves, see latch.go
 	write sync.RWMutex
+	// Writers that latch pages under a shared write lock take turns on this
+	writer sync.Mutex
+}
+
+type Options struct {
+	// Maximum number of pages held in the cache, 0 means unbounded
+	CachePages int
+	// Cache budget in bytes when CachePages is not set, turned into pages once the page size is known
+	CacheBytes int
+	// When writes are fsynced to the WAL before they return
+	Durability Durability
+	// How long a group commit waits for other writers, 0 uses DefaultCommitWindow
+	CommitWindow time.Duration
+	// Copy every log to this directory before it is reset, see archive.go
+	ArchiveDir string
+
+	// Open files of any format, only used by Upgrade on files with the current page layouts
+	anyFormat bool
+	// Only read the DB file, its log is neither replayed nor reset. Used by Verify
+	readOnly bool
+}
+
+func (opts Options) cachePages(pageSize int) int {
+	if opts.CachePages > 0 || opts.CacheBytes <= 0 {
+		return opts.CachePages
+	}
+	return max(opts.CacheBytes/pageSize, 1)
 }
 
 func Open(path string, log *logger.Logger) (*Pager, error) {
-	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	return OpenWithOptions(path, log, Options{})
+}
+
+func OpenWithOptions(path string, log *logger.Logger, opts Options) (*Pager, error) {
+	flag := os.O_RDWR
+	if opts.readOnly {
+		flag = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(path, flag, 0666)
 	if errors.Is(err, os.ErrNotExist) {
 		return nil, fmt.Errorf("Database does not exist")
 	}
@@ -42,20 +88,33 @@ func Open(path string, log *logger.Logger) (*Pager, error) {
 		return nil, fmt.Errorf("Error opening DB file: %s", err)
 	}
 
-	if sigErr := checkSignature(f); sigErr != nil {
-		f.Seek(0, io.SeekEnd)
+	pageSize, version, sigErr := checkSignature(f)
+	if sigErr != nil {
+		f.Close()
 		return nil, sigErr
 	}
 
+	if !opts.anyFormat {
+		if err := checkFormat(path, version); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
 	info, statErr := f.Stat()
 	if statErr != nil {
-		f.Seek(0, io.SeekEnd)
+		f.Close()
 		return nil, fmt.Errorf("Error getting file stats: %s", statErr)
 	}
 
+	if !ValidPageSize(pageSize) {
+		f.Close()
+		return nil, fmt.Errorf("Open %w: %d", ErrInvalidPageSize, pageSize)
+	}
+
 	size := info.Size()
-	if size%PageSize != 0 {
-		f.Seek(0, io.SeekEnd)
+	if size%int64(pageSize) != 0 {
+		f.Close()
 		return nil, fmt.Errorf("Open %w", ErrCorruptFile)
 	}
 
@@ -63,112 +122,263 @@ func Open(path string, log *logger.Logger) (*Pager, error) {
 		file:      f,
 		filePath:  path,
 		log:       log,
-		pageSize:  PageSize,
-		numPages:  uint32(size / PageSize),
+		pageSize:  pageSize,
+		numPages:  uint32(size / int64(pageSize)),
 		replaying: false,
-		cache:     make(map[uint32]*cachedPage),
+		readOnly:  opts.readOnly,
+		cache:     newPageCache(opts.cachePages(pageSize)),
+		loading:   make(map[uint32]*pageLoad),
+		versions:  newVersionStore(),
+	}
+
+	if opts.readOnly {
+		return pager, nil
 	}
 
 	wal, wErr := OpenWAL(path, pager, log)
 	if wErr != nil {
+		f.Close()
 		return nil, wErr
 	}
 
+	wal.durability = opts.Durability
+	if opts.CommitWindow > 0 {
+		wal.commitWindow = opts.CommitWindow
+	}
+	wal.archiveDir = opts.ArchiveDir
 	pager.wal = wal
 
 	if err := wal.Replay(); err != nil {
 		return nil, err
 	}
+	pager.versions.lsn = wal.lastLSN
 
 	return pager, nil
 }
 
-func checkSignature(f *os.File) error {
-	if _, sErr := f.Seek(1, io.SeekStart); sErr != nil {
-		return fmt.Errorf("Error seeking start of file: %s", sErr)
+// Check the file is a GoStore database and return its page size and format version
+func checkSignature(f *os.File) (int, int, error) {
+	h := make([]byte, formatOffset+2)
+	if _, err := f.ReadAt(h, 0); err != nil {
+		return 0, 0, fmt.Errorf("Error reading magic bytes: %s", err)
 	}
 
-	h := make([]byte, len(sig))
-	if _, err := io.ReadFull(f, h); err != nil {
-		return fmt.Errorf("Error reading magic bytes: %s", err)
+	if bytes.Equal(h[sigOffset:sigOffset+len(sig)], sig) {
+		pageSize := decodePageSize(binary.LittleEndian.Uint16(h[sizeOffset:]))
+		return pageSize, decodeFormatVersion(binary.LittleEndian.Uint16(h[formatOffset:])), nil
 	}
 
-	if !bytes.Equal(h, sig) {
-		return ErrInvalidFileSig
+	// Before the page header had a checksum the signature followed the page type
+	if bytes.Equal(h[legacySigOffset:legacySigOffset+len(sig)], sig) {
+		return legacyPageSize, formatLegacy, nil
 	}
-	return nil
+	return 0, 0, ErrInvalidFileSig
 }
 
 func CreateDatabase(path string) (*os.File, error) {
+	return CreateDatabaseWithPageSize(path, DefaultPageSize)
+}
+
+// The page size is fixed for the life of the database
+func CreateDatabaseWithPageSize(path string, pageSize int) (*os.File, error) {
+	if !ValidPageSize(pageSize) {
+		return nil, fmt.Errorf("%w: %d, must be a power of two from %d to %d", ErrInvalidPageSize, pageSize, MinPageSize, MaxPageSize)
+	}
+	return CreateDatabaseWithOptions(path, CreateOptions{PageSize: pageSize})
+}
+
+// Choices that are fixed for the life of the database
+type CreateOptions struct {
+	// 0 uses DefaultPageSize
+	PageSize int
+	// Store the prefix shared by the keys of each leaf once rather than in every cell
+	PrefixCompression bool
+}
+
+func CreateDatabaseWithOptions(path string, opts CreateOptions) (*os.File, error) {
+	pageSize := opts.PageSize
+	if pageSize == 0 {
+		pageSize = DefaultPageSize
+	}
+	if !ValidPageSize(pageSize) {
+		return nil, fmt.Errorf("%w: %d, must be a power of two from %d to %d", ErrInvalidPageSize, pageSize, MinPageSize, MaxPageSize)
+	}
+
+	var features uint32
+	if opts.PrefixCompression {
+		features |= FeaturePrefixCompression
+	}
+
+	id, idErr := NewDatabaseID()
+	if idErr != nil {
+		return nil, fmt.Errorf("Error generating database ID: %s", idErr)
+	}
+	return createDatabase(path, id, pageSize, features)
+}
+
+func createDatabase(path string, id DatabaseID, pageSize int, features uint32) (*os.File, error) {
 	f, cErr := os.Create(path)
 	if cErr != nil {
 		return nil, fmt.Errorf("Unable to create file %s: %s", path, cErr)
 	}
 
-	mPage := NewPage()
-	lPage := NewPage()
+	mPage := NewPage(pageSize)
+	lPage := NewPage(pageSize)
 
 	metaPage := NewMetaPage(mPage)
 	leafPage := NewLeafPage(lPage)
 
-	f.Seek(0, io.SeekStart)
+	metaPage.SetDatabaseID(id)
+	metaPage.SetFeatures(features)
 
-	metaSize, wMetaErr := f.Write(metaPage.Page.Data)
+	// Later leaves take the layout of the page they split from
+	if features&FeaturePrefixCompression != 0 {
+		leafPage.SetPrefixed()
+	}
+
+	stampChecksum(metaPage.Page.Data)
+	stampChecksum(leafPage.Page.Data)
+
+	metaSize, wMetaErr := f.WriteAt(metaPage.Page.Data, 0)
 	if wMetaErr != nil {
 		return f, fmt.Errorf("Error writing new Meta page to file: %s", wMetaErr)
-	} else if metaSize != PageSize {
-		return f, fmt.Errorf("Size mismatch writing Meta page to file: Expected %d Actual: %d", PageSize, metaSize)
+	} else if metaSize != pageSize {
+		return f, fmt.Errorf("Size mismatch writing Meta page to file: Expected %d Actual: %d", pageSize, metaSize)
 	}
 
-	f.Seek(0, io.SeekEnd)
-
-	leafSize, wLeafErr := f.Write(leafPage.Page.Data)
+	leafSize, wLeafErr := f.WriteAt(leafPage.Page.Data, int64(pageSize))
 	if wLeafErr != nil {
 		return f, fmt.Errorf("Error writing new Leaf page to file: %s", wLeafErr)
-	} else if leafSize != PageSize {
-		return f, fmt.Errorf("Size mismatch writing Leaf page to file: Expected: %d Actual: %d", PageSize, leafSize)
+	} else if leafSize != pageSize {
+		return f, fmt.Errorf("Size mismatch writing Leaf page to file: Expected: %d Actual: %d", pageSize, leafSize)
 	}
 
-	f.Seek(0, io.SeekEnd)
 	return f, nil
 }
 
+// Read a page for the running operation, pinning it for the rest of the
+// operation and recording it in the running frame
 func (pager *Pager) ReadPage(id uint32) (*Page, error) {
-	pager.mu.Lock()
-	if cp, ok := pager.cache[id]; ok {
+	cp, err := pager.fetch(id, true, false)
+	if err != nil {
+		return nil, err
+	}
+	return cp.page, nil
+}
+
+// Read a page outside of the running operation. Readers that run alongside a
+// writer use this so they neither pin its pages nor end up in its frame
+func (pager *Pager) peekPage(id uint32) (*Page, error) {
+	cp, err := pager.fetch(id, false, false)
+	if err != nil {
+		return nil, err
+	}
+	return cp.page, nil
+}
+
+// Find a page in the cache or load it. track makes the page part of the running
+// operation, latch pins it until unlatch
+func (pager *Pager) fetch(id uint32, track, latch bool) (*cachedPage, error) {
+	for {
+		pager.mu.Lock()
+		if cp, ok := pager.cache.get(id); ok {
+			pager.use(cp, track, latch)
+			pager.mu.Unlock()
+			return cp, nil
+		}
+
+		// Another reader is already loading the page, wait for it rather than read it twice.
+		// It may have been evicted again by the time we look so go round until it is cached
+		if load, ok := pager.loading[id]; ok {
+			pager.mu.Unlock()
+			<-load.done
+			if load.err != nil {
+				return nil, load.err
+			}
+			continue
+		}
+
+		load := &pageLoad{done: make(chan struct{})}
+		pager.loading[id] = load
 		pager.mu.Unlock()
-		return cp.page, nil
+
+		return pager.load(id, load, track, latch)
 	}
-	pager.mu.Unlock()
+}
 
-	page := NewPage()
-	page.ID = id
+// Must hold pager.mu
+func (pager *Pager) use(cp *cachedPage, track, latch bool) {
+	if track {
+		cp.epoch = pager.epoch
+		pager.captureFrame(cp)
+	}
+	if latch {
+		cp.pins++
+	}
+}
+
+// A page being read from the file, readers that miss on the same page wait on done
+type pageLoad struct {
+	done chan struct{}
+	err  error
+}
+
+// Read a page from the file and cache it, the caller has registered load for id
+func (pager *Pager) load(id uint32, load *pageLoad, track, latch bool) (*cachedPage, error) {
+	page, err := pager.readFromFile(id)
+
+	pager.mu.Lock()
+	defer pager.mu.Unlock()
+
+	pager.cache.reads++
+	delete(pager.loading, id)
+	load.err = err
+	close(load.done)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// A writer may have cached the page while we were reading it
+	if cp, ok := pager.cache.pages[id]; ok {
+		pager.use(cp, track, latch)
+		return cp, nil
+	}
 
-	offset := int64(id) * PageSize
+	cp := &cachedPage{page: page, dirty: false}
+	pager.cache.insert(cp)
+	pager.use(cp, track, latch)
+	pager.evict()
+	return cp, nil
+}
+
+// Only set by tests, holds every read open long enough for others to miss on the same page
+var readDelay time.Duration
+
+// Positional reads leave the file offset alone so any number can run at once
+func (pager *Pager) readFromFile(id uint32) (*Page, error) {
+	page := NewPage(pager.pageSize)
+	page.ID = id
 
-	if _, sErr := pager.file.Seek(offset, io.SeekStart); sErr != nil {
-		return nil, fmt.Errorf("Failed to seek to page with id %d: %s", id, sErr)
+	if readDelay > 0 {
+		time.Sleep(readDelay)
 	}
 
-	read, rErr := io.ReadFull(pager.file, page.Data)
-	if rErr != nil {
-		return nil, fmt.Errorf("Error occured while reading page: %s", rErr)
+	if _, err := pager.file.ReadAt(page.Data, int64(id)*int64(pager.pageSize)); err != nil {
+		return nil, fmt.Errorf("Error occured while reading page %d: %s", id, err)
 	}
 
-	if read != PageSize {
-		return nil, fmt.Errorf("Data read does not match page size: Expected %d Actual: %d", PageSize, read)
+	if !verifyChecksum(page.Data) {
+		return nil, &ErrCorruptPage{PageID: id}
 	}
 
 	page.Type = PageType(page.Data[0])
-	pager.mu.Lock()
-	pager.cache[id] = &cachedPage{page: page, dirty: false}
-	pager.mu.Unlock()
 	return page, nil
 }
 
 func (pager *Pager) WritePage(page *Page) error {
 	if !pager.replaying {
-		if err := pager.wal.LogPage(page); err != nil {
+		if err := pager.logPage(page); err != nil {
 			pager.log.Errorf("WritePage: WAL logging failed for page %d: %v", page.ID, err)
 			return err
 		}
@@ -176,45 +386,284 @@ func (pager *Pager) WritePage(page *Page) error {
 
 	pager.mu.Lock()
 	defer pager.mu.Unlock()
-	cp, ok := pager.cache[page.ID]
+	cp, ok := pager.cache.pages[page.ID]
 	if !ok {
-		cp = &cachedPage{page: page, dirty: true}
-		pager.cache[page.ID] = cp
+		cp = &cachedPage{page: page, dirty: true, epoch: pager.epoch}
+		pager.cache.insert(cp)
+		pager.evict()
 	} else {
 		copy(cp.page.Data, page.Data)
 		cp.page.Type = page.Type
 		cp.dirty = true
+		cp.ref = true
+		cp.epoch = pager.epoch
 	}
 	return nil
 }
 
-func (pager *Pager) flushDirty() error {
+// Every tree operation starts a new epoch. Pages touched during the current
+// epoch are pinned so an operation never ends up holding two copies of a page
+func (pager *Pager) beginOp() {
+	pager.mu.Lock()
+	pager.epoch++
+	pager.mu.Unlock()
+}
+
+// Cache state of a page from before the running frame touched it
+type frameImage struct {
+	data  []byte
+	typ   PageType
+	dirty bool
+}
+
+// Every write operation runs inside a frame. Its pages are logged between a
+// begin and an end record so replay only applies operations that finished,
+// and page images are recorded so a failed operation can be undone in memory
+func (pager *Pager) beginFrame() {
 	pager.mu.Lock()
 	defer pager.mu.Unlock()
 
-	for id, cp := range pager.cache {
-		if !cp.dirty {
+	pager.inFrame = true
+	pager.frameLSN = 0
+	pager.frameImages = make(map[uint32]frameImage)
+	pager.frameNumPages = pager.numPages
+
+	// The meta page is modified through the BTree's reference without a ReadPage
+	if cp, ok := pager.cache.pages[0]; ok {
+		pager.captureFrame(cp)
+	}
+}
+
+// Log a page under the running frame, the begin record is only written once
+// the frame logs its first page so operations that change nothing leave no trace
+func (pager *Pager) logPage(page *Page) error {
+	if !pager.inFrame {
+		// Lone page writes get a frame of their own
+		lsn, err := pager.wal.LogBegin()
+		if err != nil {
+			return err
+		}
+		if err := pager.wal.LogPage(page, lsn); err != nil {
+			return err
+		}
+		if err := pager.wal.LogEnd(lsn); err != nil {
+			return err
+		}
+
+		pager.mu.Lock()
+		pager.versions.lsn = lsn
+		pager.mu.Unlock()
+		return nil
+	}
+
+	if pager.frameLSN == 0 {
+		lsn, err := pager.wal.LogBegin()
+		if err != nil {
+			return err
+		}
+		pager.frameLSN = lsn
+	}
+
+	return pager.wal.LogPage(page, pager.frameLSN)
+}
+
+// root is where the frame left the tree, snapshots taken from now on start there
+func (pager *Pager) commitFrame(root uint32) error {
+	lsn := pager.frameLSN
+	pager.endFrame(root)
+
+	if lsn == 0 {
+		return nil
+	}
+	return pager.wal.LogEnd(lsn)
+}
+
+// Put every page touched by the frame back the way it was. Its WAL records
+// stay in the log but are never ended so replay skips them
+func (pager *Pager) abortFrame() {
+	pager.mu.Lock()
+	defer pager.mu.Unlock()
+
+	for id, img := range pager.frameImages {
+		cp, ok := pager.cache.pages[id]
+		if !ok {
 			continue
 		}
-		offset := int64(id) * PageSize
-		if _, sErr := pager.file.Seek(offset, io.SeekStart); sErr != nil {
-			return fmt.Errorf("Failed to seek page %d: %s", id, sErr)
+
+		// Pages the frame latched and let go of unchanged may be back in use by readers
+		if cp.page.Type == img.typ && bytes.Equal(cp.page.Data, img.data) {
+			cp.dirty = img.dirty
+			continue
+		}
+		copy(cp.page.Data, img.data)
+		cp.page.Type = img.typ
+		cp.dirty = img.dirty
+	}
+	pager.abortVersions()
+
+	// Drop pages that were allocated past the end of the file
+	for id, cp := range pager.cache.pages {
+		if id >= pager.frameNumPages {
+			pager.cache.remove(cp)
+		}
+	}
+	pager.numPages = pager.frameNumPages
+
+	pager.inFrame = false
+	pager.frameLSN = 0
+	pager.frameImages = nil
+}
+
+func (pager *Pager) endFrame(root uint32) {
+	pager.mu.Lock()
+	defer pager.mu.Unlock()
+
+	pager.commitVersions(root, pager.frameLSN)
+
+	pager.inFrame = false
+	pager.frameLSN = 0
+	pager.frameImages = nil
+}
+
+// Save the first image of a page seen during a frame, must hold pager.mu
+func (pager *Pager) captureFrame(cp *cachedPage) {
+	if pager.frameImages == nil {
+		return
+	}
+
+	if _, ok := pager.frameImages[cp.page.ID]; ok {
+		return
+	}
+
+	img := frameImage{
+		data:  append([]byte(nil), cp.page.Data...),
+		typ:   cp.page.Type,
+		dirty: cp.dirty,
+	}
+	pager.frameImages[cp.page.ID] = img
+	pager.versions.keep(cp.page.ID, img)
+}
+
+// Evict pages until the cache is back under capacity, must hold pager.mu
+func (pager *Pager) evict() {
+	for pager.cache.overCapacity() {
+		cp := pager.cache.victim(pager.epoch)
+		if cp == nil {
+			// Everything left is pinned, let the cache grow until the operation ends
+			return
+		}
+
+		if cp.dirty {
+			if err := pager.writeBack(cp); err != nil {
+				pager.log.Errorf("evict: failed to write back page %d: %v", cp.page.ID, err)
+				return
+			}
 		}
 
-		wrote, wErr := pager.file.Write(cp.page.Data)
+		pager.cache.remove(cp)
+		pager.cache.evictions++
+	}
+}
+
+// Write a dirty page to the database file ahead of a checkpoint. The WAL must
+// be durable first or a crash could leave the page newer than its log record
+func (pager *Pager) writeBack(cp *cachedPage) error {
+	if !pager.replaying {
+		if err := pager.wal.Sync(); err != nil {
+			return err
+		}
+	}
+
+	stampChecksum(cp.page.Data)
+	wrote, err := pager.file.WriteAt(cp.page.Data, int64(cp.page.ID)*int64(pager.pageSize))
+	if err != nil {
+		return err
+	}
+
+	if wrote != pager.pageSize {
+		return fmt.Errorf("writeBack: %w", ErrWriteSizeMismatch)
+	}
+
+	cp.dirty = false
+	return nil
+}
+
+// Readers ask for the page count while a writer may be allocating
+func (pager *Pager) pageCount() uint32 {
+	pager.mu.Lock()
+	defer pager.mu.Unlock()
+	return pager.numPages
+}
+
+func (pager *Pager) CacheStats() CacheStats {
+	pager.mu.Lock()
+	defer pager.mu.Unlock()
+	return pager.cache.stats()
+}
+
+func (pager *Pager) WALStats() WALStats {
+	return pager.wal.stats()
+}
+
+func (pager *Pager) flushDirty() error {
+	pager.mu.Lock()
+	defer pager.mu.Unlock()
+
+	for id, cp := range pager.cache.pages {
+		if !cp.dirty {
+			continue
+		}
+		stampChecksum(cp.page.Data)
+		wrote, wErr := pager.file.WriteAt(cp.page.Data, int64(id)*int64(pager.pageSize))
 		if wErr != nil {
 			return fmt.Errorf("Failed to write page %d: %s", id, wErr)
 		}
 
-		if wrote != PageSize {
+		if wrote != pager.pageSize {
 			return fmt.Errorf("flushDirty: %w", ErrWriteSizeMismatch)
 		}
 
 		cp.dirty = false
 	}
+
+	// The cache may have grown past capacity while pages were pinned
+	pager.evict()
 	return nil
 }
 
+func (pager *Pager) meta() (*MetaPage, error) {
+	p, err := pager.ReadPage(0)
+	if err != nil {
+		return nil, err
+	}
+	return WrapMetaPage(p), nil
+}
+
+// Write the meta page straight to the file and fsync, bypassing the WAL
+func (pager *Pager) writeMeta(meta *MetaPage) error {
+	stampChecksum(meta.Page.Data)
+	if _, err := pager.file.WriteAt(meta.Page.Data, 0); err != nil {
+		return fmt.Errorf("Failed to write meta page: %s", err)
+	}
+	return pager.file.Sync()
+}
+
+// Start a new checkpoint sequence once every logged page up to lsn has reached
+// the file. Must be called with the cache flushed so the meta page is not dirty
+func (pager *Pager) nextCheckpoint(lsn uint64) (uint64, error) {
+	meta, err := pager.meta()
+	if err != nil {
+		return 0, err
+	}
+
+	seq := meta.GetCheckpointSeq() + 1
+	meta.SetCheckpointSeq(seq)
+	meta.SetLSN(lsn)
+
+	// The fsync also makes the pages written by flushDirty durable
+	return seq, pager.writeMeta(meta)
+}
+
 func (pager *Pager) AllocatePage() *Page {
 	metaP, _ := pager.ReadPage(0)
 	meta := WrapMetaPage(metaP)
@@ -229,7 +678,7 @@ func (pager *Pager) AllocatePage() *Page {
 			goto newPage
 		}
 
-		nextPage := binary.LittleEndian.Uint32(freePage.Data[1:5])
+		nextPage := binary.LittleEndian.Uint32(freePage.Data[freeNextOffset : freeNextOffset+4])
 		if nextPage != InvalidPage && nextPage >= pager.numPages {
 			pager.log.Warnf("AllocatePage: %v (next:%d)", ErrCorruptFreeList, nextPage)
 			nextPage = InvalidPage
@@ -238,7 +687,7 @@ func (pager *Pager) AllocatePage() *Page {
 		meta.SetFreeHead(nextPage)
 		pager.WritePage(meta.Page)
 
-		freePage.Data = make([]byte, PageSize)
+		freePage.Data = make([]byte, pager.pageSize)
 		freePage.Type = PageTypeFree
 		freePage.Data[0] = byte(PageTypeFree)
 		freePage.ID = head
@@ -252,17 +701,87 @@ newPage:
 	pager.numPages++
 	pager.mu.Unlock()
 
-	p := NewPage()
+	p := NewPage(pager.pageSize)
 	p.ID = id
 
 	return p
 }
 
+// Shrink the file to numPages. Nothing may reference the pages being dropped
+// and the WAL must be empty so replay can never bring them back
+func (pager *Pager) truncate(numPages uint32) error {
+	pager.mu.Lock()
+	for id, cp := range pager.cache.pages {
+		if id >= numPages {
+			pager.cache.remove(cp)
+		}
+	}
+	pager.numPages = numPages
+	pager.mu.Unlock()
+
+	if err := pager.file.Truncate(int64(numPages) * int64(pager.pageSize)); err != nil {
+		return fmt.Errorf("Failed to truncate DB file: %s", err)
+	}
+	return pager.file.Sync()
+}
+
+// Give the file a new ID once everything replayed into it is flushed. Only for
+// private copies of a database with nothing else using the pager
+func (pager *Pager) newDatabaseID() error {
+	id, err := NewDatabaseID()
+	if err != nil {
+		return err
+	}
+	if err := pager.flushDirty(); err != nil {
+		return err
+	}
+
+	meta, err := pager.meta()
+	if err != nil {
+		return err
+	}
+	meta.SetDatabaseID(id)
+	pager.wal.dbID = id
+	return pager.writeMeta(meta)
+}
+
+// Log that the file is about to shrink to numPages, replay finishes the job if we crash first
+func (pager *Pager) logTruncate(numPages uint32) error {
+	lsn, err := pager.wal.LogTruncate(numPages)
+	if err != nil {
+		return err
+	}
+
+	pager.mu.Lock()
+	pager.versions.lsn = lsn
+	pager.mu.Unlock()
+	return pager.wal.Sync()
+}
+
+// Redo a truncate read back from a log the way vacuum did it, must be replaying
+func (pager *Pager) replayTruncate(numPages uint32) error {
+	meta, err := pager.meta()
+	if err != nil {
+		return err
+	}
+
+	// Vacuum empties the free list along with the file, only pages past the end were left on it
+	meta.SetFreeHead(InvalidPage)
+	if err := pager.WritePage(meta.Page); err != nil {
+		return err
+	}
+	return pager.truncate(numPages)
+}
+
 func (pager *Pager) Sync() error {
 	return pager.file.Sync()
 }
 
 func (pager *Pager) Close() error {
+	if pager.readOnly {
+		return pager.file.Close()
+	}
+
 	if err := pager.wal.Checkpoint(); err != nil {
 		return err
 	}
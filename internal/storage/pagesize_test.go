@@ -0,0 +1,150 @@
+package storage_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.store/internal/engine"
+	"go.store/internal/storage"
+)
+
+func TestPageSizes(t *testing.T) {
+	for _, size := range []int{4096, 16384, 65536} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			cfg := createTestDBWithPageSize(t, "test_page_size", size)
+			cfg.Durability = "none"
+			path := testDBPath(cfg, "test_page_size")
+
+			db, err := engine.Open("test_page_size", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Enough keys for a few levels, with some values past the inline limit of the page size
+			want := make(map[string]string)
+			for i := 0; i < 6000; i++ {
+				k := fmt.Sprintf("key%05d", i)
+				v := crashValue(i, 100)
+				if i%400 == 0 {
+					v = crashValue(i, size/4+i)
+				}
+				if err := db.Set(k, []byte(v)); err != nil {
+					t.Fatal(err)
+				}
+				want[k] = v
+			}
+			for i := 1000; i < 5000; i++ {
+				k := fmt.Sprintf("key%05d", i)
+				if err := db.Delete(k); err != nil {
+					t.Fatal(err)
+				}
+				delete(want, k)
+			}
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// A short workload on the checkpointed file keeps the live WAL well
+			// under the size that starts a background checkpoint
+			db, err = engine.Open("test_page_size", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 5000; i < 5100; i++ {
+				k := fmt.Sprintf("key%05d", i)
+				if err := db.Delete(k); err != nil {
+					t.Fatal(err)
+				}
+				delete(want, k)
+			}
+			for i := 0; i < 100; i++ {
+				k := fmt.Sprintf("new%05d", i)
+				if err := db.Set(k, []byte(crashValue(i, 300))); err != nil {
+					t.Fatal(err)
+				}
+				want[k] = crashValue(i, 300)
+			}
+
+			verifyContents(t, db, want, "before close")
+
+			// Replay a copy of the live WAL, its records are whole pages of this size
+			crashCfg := createTestDBWithPageSize(t, "test_page_size", size)
+			crashCfg.Durability = "none"
+			copyFile(t, path, testDBPath(crashCfg, "test_page_size"))
+			copyFile(t, path+".wal", testDBPath(crashCfg, "test_page_size")+".wal")
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r := verifyFile(t, path)
+			if !r.OK() {
+				t.Fatalf("Expected no problems, got %v", r.Problems)
+			}
+			if r.PageSize != size {
+				t.Fatalf("Expected page size %d, file has %d", size, r.PageSize)
+			}
+			if fileSize(t, path) != int64(r.Pages)*int64(size) {
+				t.Fatalf("File is not a whole number of %d byte pages", size)
+			}
+
+			crashed, err := engine.Open("test_page_size", crashCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer crashed.Close()
+
+			verifyContents(t, crashed, want, "after replay")
+		})
+	}
+}
+
+func TestInvalidPageSizeIsRejected(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, size := range []int{0, 1024, 5000, 131072} {
+		_, err := storage.CreateDatabaseWithPageSize(filepath.Join(dir, fmt.Sprintf("%d.db", size)), size)
+		if !errors.Is(err, storage.ErrInvalidPageSize) {
+			t.Fatalf("Expected page size %d to be rejected, got %v", size, err)
+		}
+	}
+}
+
+func TestWALWithOtherPageSizeIsRefused(t *testing.T) {
+	cfg := createTestDBWithPageSize(t, "test_wal_page_size", 16384)
+	cfg.Durability = "none"
+	path := testDBPath(cfg, "test_wal_page_size")
+
+	db, err := engine.Open("test_wal_page_size", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("key", []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err := os.ReadFile(path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Claim the log was written with the default page size
+	binary.LittleEndian.PutUint32(wal[10:14], storage.DefaultPageSize)
+	binary.LittleEndian.PutUint32(wal[storage.WALHeaderSize-4:storage.WALHeaderSize], crc32.ChecksumIEEE(wal[:storage.WALHeaderSize-4]))
+	if err := os.WriteFile(path+".wal", wal, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := engine.Open("test_wal_page_size", cfg); !errors.Is(err, storage.ErrWALMismatch) {
+		t.Fatalf("Expected ErrWALMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package storage_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"go.store/internal/engine"
+	"go.store/internal/storage"
+)
+
+// Offset of the feature flags in the meta page
+const featuresOffset = 50
+
+func openPrefixedDB(t *testing.T, dbname string) (*engine.Database, string) {
+	t.Helper()
+
+	cfg := createTestDBWithOptions(t, dbname, storage.CreateOptions{PrefixCompression: true})
+	cfg.Durability = "none"
+
+	db, err := engine.Open(dbname, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, testDBPath(cfg, dbname)
+}
+
+func TestPrefixCompressionSavesSpace(t *testing.T) {
+	leafPages := func(dbname string, opts storage.CreateOptions) int {
+		cfg := createTestDBWithOptions(t, dbname, opts)
+		cfg.Durability = "none"
+
+		db, err := engine.Open(dbname, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := make(map[string]string)
+		for i := 0; i < 5000; i++ {
+			k := fmt.Sprintf("tenant-0042/users/profile/settings/%06d", i)
+			if err := db.Set(k, []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+			want[k] = "v"
+		}
+		verifyContents(t, db, want, dbname)
+
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := verifyFile(t, testDBPath(cfg, dbname))
+		if !r.OK() {
+			t.Fatalf("%s has problems: %v", dbname, r.Problems)
+		}
+		return r.LeafPages
+	}
+
+	plain := leafPages("test_prefix_plain", storage.CreateOptions{})
+	prefixed := leafPages("test_prefix_compressed", storage.CreateOptions{PrefixCompression: true})
+
+	if prefixed*2 > plain {
+		t.Fatalf("Expected compressed leaves to take less than half the pages, got %d vs %d", prefixed, plain)
+	}
+}
+
+func TestPrefixCompressionRebalance(t *testing.T) {
+	db, path := openPrefixedDB(t, "test_prefix_rebalance")
+
+	rng := rand.New(rand.NewSource(1))
+	want := make(map[string]string)
+
+	// Groups of keys with long shared prefixes, and one group with none, so
+	// pages keep gaining and losing their prefix as keys move around
+	groups := []string{
+		strings.Repeat("a", 300),
+		strings.Repeat("a", 150) + strings.Repeat("b", 150),
+		"users/" + strings.Repeat("c", 100),
+		"",
+	}
+	keyFor := make(map[int]string)
+
+	for op := 0; op < 10000; op++ {
+		id := rng.Intn(2000)
+		if k, ok := keyFor[id]; ok {
+			if err := db.Delete(k); err != nil {
+				t.Fatalf("Delete %.10s failed at op %d: %v", k, op, err)
+			}
+			delete(want, k)
+			delete(keyFor, id)
+		}
+
+		if rng.Intn(3) == 0 {
+			continue
+		}
+
+		k := groups[id%len(groups)] + fmt.Sprintf("%05d", id) + strings.Repeat("k", rng.Intn(100))
+		v := strings.Repeat("v", rng.Intn(200))
+		if rng.Intn(50) == 0 {
+			v = strings.Repeat("o", 5000)
+		}
+		if err := db.Set(k, []byte(v)); err != nil {
+			t.Fatalf("Set %.10s failed at op %d: %v", k, op, err)
+		}
+		want[k] = v
+		keyFor[id] = k
+	}
+
+	verifyContents(t, db, want, "after rebalancing")
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r := verifyFile(t, path); !r.OK() {
+		t.Fatalf("Expected no problems, got %v", r.Problems)
+	}
+}
+
+// Keys that don't share the prefix of a full page are split off on their own
+func TestPrefixCompressionEdgeSplits(t *testing.T) {
+	db, path := openPrefixedDB(t, "test_prefix_edges")
+
+	want := make(map[string]string)
+	set := func(k string) {
+		t.Helper()
+		if err := db.Set(k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = k
+	}
+
+	prefix := strings.Repeat("m", 400)
+	for i := 0; i < 300; i++ {
+		set(prefix + fmt.Sprintf("%04d", i))
+	}
+	// Sorts before and after every key above
+	for i := 0; i < 50; i++ {
+		set(fmt.Sprintf("a%04d", i))
+		set(fmt.Sprintf("z%04d", i))
+	}
+	verifyContents(t, db, want, "after edge splits")
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if r := verifyFile(t, path); !r.OK() {
+		t.Fatalf("Expected no problems, got %v", r.Problems)
+	}
+}
+
+func TestUnknownFeatureIsRefused(t *testing.T) {
+	cfg := createTestDB(t, "test_unknown_feature")
+
+	editPage(t, testDBPath(cfg, "test_unknown_feature"), 0, func(page []byte) {
+		binary.LittleEndian.PutUint32(page[featuresOffset:], 1<<31)
+	})
+
+	if _, err := engine.Open("test_unknown_feature", cfg); !errors.Is(err, storage.ErrFormatTooNew) {
+		t.Fatalf("Expected ErrFormatTooNew, got %v", err)
+	}
+}
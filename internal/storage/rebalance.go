@@ -12,7 +12,7 @@ func (bt *BTree) rebalanceLeaf(leaf *LeafPage, parent *InternalPage, idx int) (b
 	}
 
 	if leftID != InvalidPage {
-		lp, _ := bt.pager.ReadPage(leftID)
+		lp, _ := bt.modify(leftID)
 		left = WrapLeafPage(lp)
 	}
 
@@ -25,16 +25,16 @@ func (bt *BTree) rebalanceLeaf(leaf *LeafPage, parent *InternalPage, idx int) (b
 	}
 
 	if rightID != InvalidPage {
-		rp, _ := bt.pager.ReadPage(rightID)
+		rp, _ := bt.modify(rightID)
 		right = WrapLeafPage(rp)
 	}
 
-	if leftID != InvalidPage && bt.canBorrowLeaf(left, leaf, false) {
+	if leftID != InvalidPage && bt.canBorrowLeaf(left, leaf, parent, idx-1, false) {
 		err := bt.borrowLeaf(left, leaf, parent, idx-1, false)
 		return false, err
 	}
 
-	if rightID != InvalidPage && bt.canBorrowLeaf(right, leaf, true) {
+	if rightID != InvalidPage && bt.canBorrowLeaf(right, leaf, parent, idx, true) {
 		err := bt.borrowLeaf(right, leaf, parent, idx, true)
 		return false, err
 	}
@@ -52,12 +52,12 @@ func (bt *BTree) rebalanceLeaf(leaf *LeafPage, parent *InternalPage, idx int) (b
 }
 
 func (bt *BTree) rebalanceInternal(page, parent *InternalPage, idx int, pageID uint32) (bool, error) {
-	if pageID == bt.root {
+	if pageID == bt.root.Load() {
 		if page.GetNumKeys() == 0 {
-			onlyChild := page.GetChild(0)
-			bt.root = onlyChild
+			onlyChild := page.GetRightChild()
+			bt.root.Store(onlyChild)
 
-			bt.meta.SetRootID(bt.root)
+			bt.meta.SetRootID(onlyChild)
 			bt.FreePage(pageID)
 			return false, nil
 		}
@@ -75,7 +75,7 @@ func (bt *BTree) rebalanceInternal(page, parent *InternalPage, idx int, pageID u
 	}
 
 	if leftID != InvalidPage {
-		lp, _ := bt.pager.ReadPage(leftID)
+		lp, _ := bt.modify(leftID)
 		left = WrapInternalPage(lp)
 	}
 
@@ -88,26 +88,26 @@ func (bt *BTree) rebalanceInternal(page, parent *InternalPage, idx int, pageID u
 	}
 
 	if rightID != InvalidPage {
-		rp, _ := bt.pager.ReadPage(rightID)
+		rp, _ := bt.modify(rightID)
 		right = WrapInternalPage(rp)
 	}
 
-	if leftID != InvalidPage && bt.canBorrowInternal(left, page, false) {
+	if leftID != InvalidPage && bt.canBorrowInternal(left, page, parent, idx-1, false) {
 		err := bt.borrowInternal(left, page, parent, idx-1, false)
 		return false, err
 	}
 
-	if rightID != InvalidPage && bt.canBorrowInternal(right, page, true) {
+	if rightID != InvalidPage && bt.canBorrowInternal(right, page, parent, idx, true) {
 		err := bt.borrowInternal(right, page, parent, idx, true)
 		return false, err
 	}
 
-	if leftID != InvalidPage && bt.canMergeInternal(left, page) {
+	if leftID != InvalidPage && bt.canMergeInternal(left, page, parent, idx-1) {
 		err := bt.mergeInternal(left, page, parent, idx-1, false)
 		return true, err
 	}
 
-	if rightID != InvalidPage && bt.canMergeInternal(right, page) {
+	if rightID != InvalidPage && bt.canMergeInternal(right, page, parent, idx) {
 		err := bt.mergeInternal(right, page, parent, idx, true)
 		return true, err
 	}
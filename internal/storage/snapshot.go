@@ -0,0 +1,448 @@
+package storage
+
+import "bytes"
+
+// A snapshot reads the tree as it was when it was taken while writers carry on,
+// without the tree lock or any latch. Snapshots are numbered by the frames that
+// had committed when they were taken.
+//
+// Pages only change inside a frame once the frame has captured their image for
+// rollback. While a snapshot is open that image is also kept as a version of the
+// page for every snapshot taken before the frame commits. A snapshot reads a page
+// from its versions when it has one, otherwise the page can't have changed since
+// the snapshot was taken and the cached page is copied. Both are looked at under
+// pager.mu, the same lock the image is captured under, so a snapshot never sees
+// a page part way through a write.
+//
+// Versions are dropped once no open snapshot falls inside the frames they cover
+
+// The image of a page read by snapshots from up to until
+type pageVersion struct {
+	data        []byte
+	typ         PageType
+	from, until uint64
+}
+
+type versionStore struct {
+	// Frames committed so far, the root they left behind and the LSN of the last one logged
+	seq  uint64
+	root uint32
+	lsn  uint64
+
+	// Open snapshots by the frames they see, counted
+	open   map[uint64]int
+	newest uint64
+	// Open snapshots taken by backups, which read free pages too
+	backups int
+
+	// Versions of each page, oldest first
+	pages map[uint32][]pageVersion
+	count int
+	bytes int
+}
+
+type SnapshotStats struct {
+	Open     int
+	Versions int
+	Bytes    int
+}
+
+func newVersionStore() versionStore {
+	return versionStore{
+		open:  make(map[uint64]int),
+		pages: make(map[uint32][]pageVersion),
+	}
+}
+
+// Keep the image a frame captured if an open snapshot reads it, must hold pager.mu
+func (vs *versionStore) keep(id uint32, img frameImage) {
+	// Snapshots start from the root they were taken at and never read the meta page
+	if id == 0 || len(vs.open) == 0 {
+		return
+	}
+
+	var from uint64
+	if versions := vs.pages[id]; len(versions) > 0 {
+		from = versions[len(versions)-1].until
+	}
+	if vs.newest < from {
+		return
+	}
+
+	vs.pages[id] = append(vs.pages[id], pageVersion{data: img.data, typ: img.typ, from: from, until: vs.seq + 1})
+	vs.count++
+	vs.bytes += len(img.data)
+}
+
+// The version of a page snapshot seq reads, nil when it reads the page itself
+func (vs *versionStore) find(id uint32, seq uint64) *Page {
+	for _, v := range vs.pages[id] {
+		if v.until > seq {
+			return &Page{ID: id, Type: v.typ, Data: v.data}
+		}
+	}
+	return nil
+}
+
+// Drop versions matching fn
+func (vs *versionStore) drop(fn func(v pageVersion) bool) {
+	for id := range vs.pages {
+		vs.dropFrom(id, fn)
+	}
+}
+
+func (vs *versionStore) dropFrom(id uint32, fn func(v pageVersion) bool) {
+	versions := vs.pages[id]
+	kept := versions[:0]
+	for _, v := range versions {
+		if fn(v) {
+			vs.count--
+			vs.bytes -= len(v.data)
+			continue
+		}
+		kept = append(kept, v)
+	}
+
+	if len(kept) == 0 {
+		delete(vs.pages, id)
+	} else {
+		vs.pages[id] = kept
+	}
+}
+
+func (vs *versionStore) stats() SnapshotStats {
+	open := 0
+	for _, n := range vs.open {
+		open += n
+	}
+	return SnapshotStats{Open: open, Versions: vs.count, Bytes: vs.bytes}
+}
+
+// Publish the running frame to snapshots taken from now on, must hold pager.mu.
+// Pages the frame only looked at are the same as their versions, which nobody needs then
+func (pager *Pager) commitVersions(root uint32, lsn uint64) {
+	vs := &pager.versions
+	if vs.count > 0 {
+		for id := range pager.frameImages {
+			cp, ok := pager.cache.pages[id]
+			if !ok {
+				continue
+			}
+			vs.dropFrom(id, func(v pageVersion) bool {
+				return v.until == vs.seq+1 && cp.page.Type == v.typ && bytes.Equal(cp.page.Data, v.data)
+			})
+		}
+	}
+
+	vs.seq++
+	vs.root = root
+	// Frames that changed nothing weren't logged
+	if lsn != 0 {
+		vs.lsn = lsn
+	}
+}
+
+// The running frame is undone so its pages are back to their versions, must hold pager.mu
+func (pager *Pager) abortVersions() {
+	vs := &pager.versions
+	if vs.count > 0 {
+		for id := range pager.frameImages {
+			vs.dropFrom(id, func(v pageVersion) bool { return v.until == vs.seq+1 })
+		}
+	}
+}
+
+// Snapshot is a read only view of the tree as of the last committed write. It
+// must be released once it is no longer needed so the versions it reads go
+type Snapshot struct {
+	bt       *BTree
+	seq      uint64
+	root     uint32
+	numPages uint32
+	// LSN of the last logged frame it sees
+	lsn uint64
+	// Taken by a backup, see backup.go
+	backup bool
+	// Guarded by pager.mu
+	released bool
+}
+
+func (bt *BTree) Snapshot() *Snapshot {
+	bt.pager.mu.Lock()
+	defer bt.pager.mu.Unlock()
+	return bt.snapshotLocked()
+}
+
+// Must hold pager.mu
+func (bt *BTree) snapshotLocked() *Snapshot {
+	pager := bt.pager
+	vs := &pager.versions
+	s := &Snapshot{bt: bt, seq: vs.seq, root: vs.root, numPages: pager.numPages, lsn: vs.lsn}
+	vs.open[s.seq]++
+	vs.newest = max(vs.newest, s.seq)
+
+	// A running frame has already changed the pages it captured
+	if pager.frameImages != nil {
+		s.numPages = pager.frameNumPages
+		for id, img := range pager.frameImages {
+			vs.keep(id, img)
+		}
+	}
+	return s
+}
+
+// Release lets go of the snapshot's versions, reads from it fail afterwards
+func (s *Snapshot) Release() {
+	pager := s.bt.pager
+	pager.mu.Lock()
+	defer pager.mu.Unlock()
+
+	if s.released {
+		return
+	}
+	s.released = true
+
+	vs := &pager.versions
+	if s.backup {
+		vs.backups--
+	}
+	if vs.open[s.seq]--; vs.open[s.seq] == 0 {
+		delete(vs.open, s.seq)
+	}
+
+	vs.newest = 0
+	for seq := range vs.open {
+		vs.newest = max(vs.newest, seq)
+	}
+
+	vs.drop(func(v pageVersion) bool {
+		for seq := range vs.open {
+			if seq >= v.from && seq < v.until {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (bt *BTree) SnapshotStats() SnapshotStats {
+	bt.pager.mu.Lock()
+	defer bt.pager.mu.Unlock()
+	return bt.pager.versions.stats()
+}
+
+// Read a page as the snapshot sees it. Version pages are shared and the rest
+// are copies, neither is ever written to
+func (s *Snapshot) page(id uint32) (*Page, error) {
+	pager := s.bt.pager
+
+	pager.mu.Lock()
+	p, err := s.version(id)
+	pager.mu.Unlock()
+	if p != nil || err != nil {
+		return p, err
+	}
+
+	cp, err := pager.fetch(id, false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	pager.mu.Lock()
+	defer pager.mu.Unlock()
+
+	// A writer may have captured the page since we looked
+	if p, err := s.version(id); p != nil || err != nil {
+		return p, err
+	}
+	return &Page{ID: id, Type: cp.page.Type, Data: append([]byte(nil), cp.page.Data...)}, nil
+}
+
+// Must hold pager.mu
+func (s *Snapshot) version(id uint32) (*Page, error) {
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+	return s.bt.pager.versions.find(id, s.seq), nil
+}
+
+// Descend to the leaf choose leads to
+func (s *Snapshot) leaf(choose chooseChild) (*LeafPage, error) {
+	id := s.root
+	for {
+		p, err := s.page(id)
+		if err != nil {
+			return nil, err
+		}
+
+		switch p.Type {
+		case PageTypeLeaf:
+			return WrapLeafPage(p), nil
+		case PageTypeInternal:
+			id = choose(WrapInternalPage(p))
+		default:
+			return nil, ErrCorruptTree
+		}
+	}
+}
+
+func (s *Snapshot) Search(key []byte) ([]byte, bool, error) {
+	leaf, err := s.leaf(childFor(key))
+	if err != nil {
+		return nil, false, err
+	}
+
+	idx := leaf.FindInsertIndex(key)
+	if idx >= leaf.GetNumCells() {
+		return nil, false, nil
+	}
+
+	ptr := leaf.GetCellPointer(idx)
+	if !bytes.Equal(leaf.ReadKey(ptr), key) {
+		return nil, false, nil
+	}
+
+	val, err := s.value(leaf, ptr)
+	if err != nil {
+		return nil, false, err
+	}
+	return val, true, nil
+}
+
+func (s *Snapshot) value(leaf *LeafPage, off uint16) ([]byte, error) {
+	if !leaf.IsOverflow(off) {
+		_, val := leaf.ReadRecord(off)
+		return append([]byte(nil), val...), nil
+	}
+
+	total, first := leaf.ReadOverflowPointer(off)
+	return readChain(s.page, s.numPages, total, first)
+}
+
+// SnapshotCursor walks the leaves of a snapshot like Cursor walks the tree.
+// Nothing it reads can change so it simply follows the sibling links
+type SnapshotCursor struct {
+	snap  *Snapshot
+	leaf  *LeafPage
+	idx   int
+	key   []byte
+	valid bool
+	err   error
+}
+
+func (s *Snapshot) Cursor() *SnapshotCursor {
+	return &SnapshotCursor{snap: s}
+}
+
+func (c *SnapshotCursor) Valid() bool {
+	return c.valid
+}
+
+func (c *SnapshotCursor) Err() error {
+	return c.err
+}
+
+// Key at the current position, only valid until the next movement
+func (c *SnapshotCursor) Key() []byte {
+	return c.key
+}
+
+func (c *SnapshotCursor) Value() ([]byte, error) {
+	if !c.valid {
+		return nil, ErrKeyNotFound
+	}
+	return c.snap.value(c.leaf, c.leaf.GetCellPointer(c.idx))
+}
+
+// Position the cursor on the first key >= key
+func (c *SnapshotCursor) Seek(key []byte) bool {
+	leaf, err := c.snap.leaf(childFor(key))
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.forward(leaf, leaf.FindInsertIndex(key))
+}
+
+func (c *SnapshotCursor) First() bool {
+	leaf, err := c.snap.leaf(edgeChild(false))
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.forward(leaf, 0)
+}
+
+func (c *SnapshotCursor) Last() bool {
+	leaf, err := c.snap.leaf(edgeChild(true))
+	if err != nil {
+		return c.fail(err)
+	}
+	return c.backward(leaf, leaf.GetNumCells()-1)
+}
+
+func (c *SnapshotCursor) Next() bool {
+	if !c.valid {
+		return false
+	}
+	return c.forward(c.leaf, c.idx+1)
+}
+
+func (c *SnapshotCursor) Prev() bool {
+	if !c.valid {
+		return false
+	}
+	return c.backward(c.leaf, c.idx-1)
+}
+
+// Settle on the first key at or after idx, following next links past the end of a leaf
+func (c *SnapshotCursor) forward(leaf *LeafPage, idx int) bool {
+	for idx >= leaf.GetNumCells() {
+		next := leaf.GetNext()
+		if next == InvalidPage {
+			return c.invalidate()
+		}
+
+		p, err := c.snap.page(next)
+		if err != nil {
+			return c.fail(err)
+		}
+		leaf, idx = WrapLeafPage(p), 0
+	}
+	return c.settle(leaf, idx)
+}
+
+// Settle on the last key at or before idx, following prev links past the start of a leaf
+func (c *SnapshotCursor) backward(leaf *LeafPage, idx int) bool {
+	for idx < 0 {
+		prev := leaf.GetPrev()
+		if prev == InvalidPage {
+			return c.invalidate()
+		}
+
+		p, err := c.snap.page(prev)
+		if err != nil {
+			return c.fail(err)
+		}
+		leaf = WrapLeafPage(p)
+		idx = leaf.GetNumCells() - 1
+	}
+	return c.settle(leaf, idx)
+}
+
+func (c *SnapshotCursor) settle(leaf *LeafPage, idx int) bool {
+	c.leaf = leaf
+	c.idx = idx
+	c.key = append(c.key[:0], leaf.ReadKey(leaf.GetCellPointer(idx))...)
+	c.valid = true
+	return true
+}
+
+func (c *SnapshotCursor) invalidate() bool {
+	c.leaf = nil
+	c.valid = false
+	return false
+}
+
+func (c *SnapshotCursor) fail(err error) bool {
+	c.err = err
+	return c.invalidate()
+}
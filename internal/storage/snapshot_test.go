@@ -0,0 +1,361 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+
+	"go.store/internal/engine"
+	"go.store/internal/storage"
+)
+
+// Check a snapshot holds exactly want through Get, Scan and ReverseScan
+func verifySnapshot(t *testing.T, snap *engine.Snapshot, want map[string]string, label string) {
+	t.Helper()
+
+	keys := make([]string, 0, len(want))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	kvs, err := snap.Scan("", "", 0)
+	if err != nil {
+		t.Fatalf("%s: Scan failed: %v", label, err)
+	}
+	if len(kvs) != len(keys) {
+		t.Fatalf("%s: expected %d keys, got %d", label, len(keys), len(kvs))
+	}
+	for i, kv := range kvs {
+		if kv.Key != keys[i] || string(kv.Value) != want[kv.Key] {
+			t.Fatalf("%s: Scan returned %s at %d, expected %s", label, kv.Key, i, keys[i])
+		}
+	}
+
+	rev, err := snap.ReverseScan("", "", 0)
+	if err != nil {
+		t.Fatalf("%s: ReverseScan failed: %v", label, err)
+	}
+	if len(rev) != len(keys) {
+		t.Fatalf("%s: expected %d keys in reverse, got %d", label, len(keys), len(rev))
+	}
+	for i, kv := range rev {
+		if kv.Key != keys[len(keys)-1-i] {
+			t.Fatalf("%s: ReverseScan returned %s at %d", label, kv.Key, i)
+		}
+	}
+
+	for i := 0; i < len(keys); i += 7 {
+		v, err := snap.Get(keys[i])
+		if err != nil || string(v) != want[keys[i]] {
+			t.Fatalf("%s: Get %s returned %v", label, keys[i], err)
+		}
+	}
+}
+
+func TestSnapshotIgnoresLaterWrites(t *testing.T) {
+	db := openTestDB(t, "test_snapshot")
+
+	want := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("key%05d", i)
+		v := crashValue(i, 100)
+		if i%200 == 0 {
+			v = crashValue(i, 3*storage.DefaultPageSize)
+		}
+		if err := db.Set(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = v
+	}
+
+	first := db.Snapshot()
+	defer first.Release()
+	before := make(map[string]string)
+	for k, v := range want {
+		before[k] = v
+	}
+
+	// Single key writes split and merge pages and rewrite overflow chains
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("key%05d", i)
+		switch i % 3 {
+		case 0:
+			if err := db.Delete(k); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, k)
+		case 1:
+			v := crashValue(i+1, 250)
+			if i%100 == 1 {
+				v = crashValue(i+1, 2*storage.DefaultPageSize)
+			}
+			if err := db.Set(k, []byte(v)); err != nil {
+				t.Fatal(err)
+			}
+			want[k] = v
+		}
+	}
+
+	second := db.Snapshot()
+	middle := make(map[string]string)
+	for k, v := range want {
+		middle[k] = v
+	}
+
+	// Transactions and batches take the whole tree
+	tx := db.Begin()
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("new%05d", i)
+		if err := tx.Set(k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = k
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := db.NewWriteBatch()
+	for i := 1; i < 3000; i += 3 {
+		k := fmt.Sprintf("key%05d", i)
+		b.Delete(k)
+		delete(want, k)
+	}
+	if _, err := b.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A commit that fails part way is undone along with the versions it kept
+	tx = db.Begin()
+	if err := tx.Set("key00002", []byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.SetNX("late", []byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("late", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, storage.ErrKeyExists) {
+		t.Fatalf("Expected the commit to fail, got %v", err)
+	}
+	want["late"] = "first"
+
+	verifySnapshot(t, first, before, "first snapshot")
+	verifySnapshot(t, second, middle, "second snapshot")
+	verifyContents(t, db, want, "database")
+
+	stats := db.SnapshotStats()
+	if stats.Open != 2 || stats.Versions == 0 {
+		t.Fatalf("Expected two snapshots holding versions, got %+v", stats)
+	}
+
+	// The second snapshot still needs the versions written after it
+	first.Release()
+	verifySnapshot(t, second, middle, "second snapshot after the first is released")
+	if after := db.SnapshotStats(); after.Open != 1 || after.Versions == 0 || after.Versions >= stats.Versions {
+		t.Fatalf("Expected the first snapshot's versions to go, got %+v after %+v", after, stats)
+	}
+
+	second.Release()
+	if stats := db.SnapshotStats(); stats.Open != 0 || stats.Versions != 0 || stats.Bytes != 0 {
+		t.Fatalf("Expected every version to go with the last snapshot, got %+v", stats)
+	}
+
+	if _, err := second.Get("key00001"); !errors.Is(err, storage.ErrSnapshotReleased) {
+		t.Fatalf("Expected a released snapshot to fail, got %v", err)
+	}
+
+	// Writes with no snapshot open keep nothing
+	if err := db.Set("key00001", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if stats := db.SnapshotStats(); stats.Versions != 0 {
+		t.Fatalf("Expected no versions without a snapshot, got %+v", stats)
+	}
+}
+
+// Vacuum moves pages and truncates the file under a snapshot
+func TestSnapshotSurvivesVacuum(t *testing.T) {
+	db := openTestDB(t, "test_snapshot_vacuum")
+
+	want := make(map[string]string)
+	for i := 0; i < 4000; i++ {
+		k := fmt.Sprintf("key%05d", i)
+		v := crashValue(i, 150)
+		if i%500 == 0 {
+			v = crashValue(i, 2*storage.DefaultPageSize)
+		}
+		if err := db.Set(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = v
+	}
+
+	snap := db.Snapshot()
+	defer snap.Release()
+
+	for i := 0; i < 4000; i++ {
+		if i%10 != 0 {
+			if err := db.Delete(fmt.Sprintf("key%05d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	stats, err := db.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.PagesAfter >= stats.PagesBefore || stats.Moved == 0 {
+		t.Fatalf("Expected vacuum to move pages and shrink the file, got %+v", stats)
+	}
+
+	verifySnapshot(t, snap, want, "after vacuum")
+}
+
+// Run with -race. One writer keeps two keys in step with single key writes and
+// another moves amounts between accounts in transactions. Whatever else is
+// going on a snapshot must see the pair at most one write apart and the
+// accounts adding up to the same total
+func TestConcurrentSnapshots(t *testing.T) {
+	cfg := createTestDBWithPageSize(t, "test_snapshots", storage.MinPageSize)
+	cfg.CachePages = 32
+	cfg.Durability = "none"
+
+	db, err := engine.Open("test_snapshots", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const accounts = 400
+	const balance = 1000
+	account := func(i int) string { return fmt.Sprintf("account%04d", i) }
+	// Padding keeps pages splitting as balances change length
+	amount := func(n int) []byte { return []byte(fmt.Sprintf("%d:%0*d", n, 20+n%200, 0)) }
+	parse := func(v []byte) int {
+		n, _ := strconv.Atoi(string(v[:slices.Index(v, ':')]))
+		return n
+	}
+
+	for i := 0; i < accounts; i++ {
+		if err := db.Set(account(i), amount(balance)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []string{"a", "b"} {
+		if err := db.Set(k, amount(0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	var readers, writers sync.WaitGroup
+
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				snap := db.Snapshot()
+				err := func() error {
+					defer snap.Release()
+
+					a, err := snap.Get("a")
+					if err != nil {
+						return err
+					}
+					kvs, err := snap.Scan("account", "account~", 0)
+					if err != nil {
+						return err
+					}
+					b, err := snap.Get("b")
+					if err != nil {
+						return err
+					}
+
+					if d := parse(a) - parse(b); d != 0 && d != 1 {
+						return fmt.Errorf("a is %d and b is %d", parse(a), parse(b))
+					}
+
+					total := 0
+					for _, kv := range kvs {
+						total += parse(kv.Value)
+					}
+					if len(kvs) != accounts || total != accounts*balance {
+						return fmt.Errorf("%d accounts add up to %d", len(kvs), total)
+					}
+					return nil
+				}()
+
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	writers.Add(2)
+	go func() {
+		defer writers.Done()
+		for i := 1; i <= 1500; i++ {
+			for _, k := range []string{"a", "b"} {
+				if err := db.Set(k, amount(i)); err != nil {
+					t.Errorf("Set %s failed: %v", k, err)
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		defer writers.Done()
+		rng := rand.New(rand.NewSource(1))
+		for op := 0; op < 1500; op++ {
+			from, to := account(rng.Intn(accounts)), account(rng.Intn(accounts))
+			if from == to {
+				continue
+			}
+
+			tx := db.Begin()
+			fv, err := tx.Get(from)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			tv, err := tx.Get(to)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			n := rng.Intn(parse(fv) + 1)
+			tx.Set(from, amount(parse(fv)-n))
+			tx.Set(to, amount(parse(tv)+n))
+			if err := tx.Commit(); err != nil {
+				t.Errorf("Commit failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	if stats := db.SnapshotStats(); stats.Open != 0 || stats.Versions != 0 {
+		t.Fatalf("Expected every version to go with the snapshots, got %+v", stats)
+	}
+}
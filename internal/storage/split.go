@@ -1,50 +1,87 @@
 package storage
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+)
 
-func (bt *BTree) splitLeaf(left *LeafPage) ([]byte, uint32) {
+func (bt *BTree) splitLeaf(left *LeafPage, key []byte) ([]byte, uint32) {
 	p := bt.pager.AllocatePage()
 	right := NewLeafPage(p)
+	if left.IsPrefixed() {
+		right.SetPrefixed()
+	}
 
-	// First we need to find the split point
-	numCells := left.GetNumCells()
-	mid := numCells / 2
+	recs := left.records()
+	numCells := len(recs)
 
-	var recs []rec
+	// Both halves keep at least the prefix of the page, so records are sized
+	// by what they take up here
+	shared := len(left.GetPrefix())
+	total := 0
+	for _, r := range recs {
+		total += recSize(r) - shared
+	}
 
-	for i := 0; i < numCells; i++ {
-		ptr := left.GetCellPointer(i)
-		k, v := left.ReadRecord(ptr)
+	// Split on bytes rather than cell count so records of mixed sizes
+	// still leave room on both sides for the pending insert
+	mid, used := 0, 0
+	for mid < numCells-1 && used+recSize(recs[mid])-shared <= total/2 {
+		used += recSize(recs[mid]) - shared
+		mid++
+	}
+	if mid == 0 {
+		mid = 1
+	}
 
-		// Deep copy to ensure our data is consistent
-		recs = append(recs, rec{key: k, val: v})
+	// A key without the prefix sorts before or after every key in the page and
+	// would shorten the prefix of whichever half it joined, so it gets a page
+	// of its own
+	if !bytes.HasPrefix(key, left.GetPrefix()) {
+		if bytes.Compare(key, recs[0].key) < 0 {
+			mid = 0
+		} else {
+			mid = numCells
+		}
 	}
 
-	left.SetNumCells(0)
-	left.SetFreeStart(dataStart)
-	left.SetFreeEnd(PageSize)
+	if err := left.rebuild(recs[:mid]); err != nil {
+		bt.log.Errorf("splitLeaf: unexpected left page split")
+		panic(fmt.Errorf("splitLeaf: %w", ErrPageOverflow))
+	}
 
-	for i := 0; i < mid; i++ {
-		off, err := left.WriteRecord(recs[i].key, recs[i].val)
-		if err != nil {
-			panic(err)
-		}
-		left.SetCellPointer(i, off)
-		left.SetNumCells(left.GetNumCells() + 1)
+	if err := right.rebuild(recs[mid:]); err != nil {
+		bt.log.Errorf("splitLeaf: unexpected right page split")
+		panic(fmt.Errorf("splitLeaf: %w", ErrPageOverflow))
 	}
-	rightIdx := 0
-	for i := mid; i < numCells; i++ {
-		off, err := right.WriteRecord(recs[i].key, recs[i].val)
+
+	// Link the new leaf in between left and its old neighbour
+	oldNext := left.GetNext()
+	right.SetNext(oldNext)
+	right.SetPrev(left.Page.ID)
+	left.SetNext(right.Page.ID)
+
+	if oldNext != InvalidPage {
+		np, err := bt.modify(oldNext)
 		if err != nil {
-			panic(err)
+			bt.log.Errorf("splitLeaf: failed to read next leaf %d: %v", oldNext, err)
+		} else {
+			WrapLeafPage(np).SetPrev(right.Page.ID)
+			bt.writePage(np)
 		}
-		right.SetCellPointer(rightIdx, off)
-		right.SetNumCells(right.GetNumCells() + 1)
-		rightIdx++
 	}
 
-	sepPtr := right.GetCellPointer(0)
-	sepKey := right.ReadKey(sepPtr)
+	// The pending key is the last one on the left or the first on the right
+	// when it is the only one there
+	var sepKey []byte
+	switch mid {
+	case 0:
+		sepKey = shortestSeparator(key, recs[0].key)
+	case numCells:
+		sepKey = shortestSeparator(recs[numCells-1].key, key)
+	default:
+		sepKey = shortestSeparator(recs[mid-1].key, recs[mid].key)
+	}
 
 	bt.writePage(left.Page)
 	bt.writePage(right.Page)
@@ -52,53 +89,56 @@ func (bt *BTree) splitLeaf(left *LeafPage) ([]byte, uint32) {
 	return sepKey, right.Page.ID
 }
 
+// Shortest key above leftMax and no greater than rightMin. A separator only has
+// to tell the two pages apart, so the parent doesn't need the whole right key
+func shortestSeparator(leftMax, rightMin []byte) []byte {
+	n := 0
+	for n < len(leftMax) && n < len(rightMin) && leftMax[n] == rightMin[n] {
+		n++
+	}
+	return append([]byte(nil), rightMin[:n+1]...)
+}
+
+// Bytes a record takes up in a leaf including its cell pointer
+func recSize(r rec) int {
+	return 4 + len(r.key) + len(r.val) + 2
+}
+
 func (bt *BTree) splitInternal(left *InternalPage) ([]byte, uint32) {
 	p := bt.pager.AllocatePage()
 	right := NewInternalPage(p)
 
-	// Find the split point
-	numKeys := left.GetNumKeys()
-	mid := numKeys / 2
+	keys, children := left.entries()
+	numKeys := len(keys)
 
-	keys := make([][]byte, numKeys)
-	for i := 0; i < numKeys; i++ {
-		ptr := left.GetKeyPointer(i)
-		k := left.ReadKey(ptr)
-
-		keys[i] = append([]byte(nil), k...)
+	// Split on bytes like leaves, the key at mid moves up to the parent.
+	// Both sides keep at least one key
+	total := internalSpaceFor(keys) - internalDataStart
+	mid, used := 1, internalCellSize(keys[0])
+	for mid < numKeys-2 && used+internalCellSize(keys[mid]) <= total/2 {
+		used += internalCellSize(keys[mid])
+		mid++
 	}
 
-	children := make([]uint32, numKeys+1)
-	for i := 0; i < numKeys; i++ {
-		children[i] = left.GetChild(i)
-	}
-	children[numKeys] = left.GetRightChild()
-
-	left.SetNumKeys(0)
-	left.SetFreeStart(keyPointerOffset)
-	left.SetFreeEnd(PageSize)
-
-	// Initially we set the right child to the first key
-	// value as insert separator will shift keys
-	left.SetRightChild(children[0])
-
-	for i := 0; i < mid; i++ {
-		if left.InsertSeparator(keys[i], children[i+1]) {
-			bt.log.Errorf("splitInternal: unexpected left page split")
-			panic(fmt.Errorf("splitInternal: %w", ErrPageOverflow))
+	// Nothing is known about the keys below a separator other than which side
+	// of it they fall, so it can't be shortened. Promote the shortest key from
+	// the middle half of the page instead
+	used = 0
+	for i := 1; i < numKeys-1; i++ {
+		used += internalCellSize(keys[i-1])
+		if used >= total/4 && used+internalCellSize(keys[i]) <= total*3/4 && len(keys[i]) < len(keys[mid]) {
+			mid = i
 		}
 	}
 
-	right.SetNumKeys(0)
-	right.SetFreeStart(keyPointerOffset)
-	right.SetFreeEnd(PageSize)
+	if err := left.rebuild(keys[:mid], children[:mid+1]); err != nil {
+		bt.log.Errorf("splitInternal: unexpected left page split")
+		panic(fmt.Errorf("splitInternal: %w", ErrPageOverflow))
+	}
 
-	right.SetRightChild(children[mid+1])
-	for i := mid + 1; i < numKeys; i++ {
-		if right.InsertSeparator(keys[i], children[i+1]) {
-			bt.log.Errorf("splitInternal: unexpected right page split")
-			panic(fmt.Errorf("splitInternal: %w", ErrPageOverflow))
-		}
+	if err := right.rebuild(keys[mid+1:], children[mid+1:]); err != nil {
+		bt.log.Errorf("splitInternal: unexpected right page split")
+		panic(fmt.Errorf("splitInternal: %w", ErrPageOverflow))
 	}
 
 	sepKey := keys[mid]
@@ -110,6 +150,11 @@ func (bt *BTree) splitInternal(left *InternalPage) ([]byte, uint32) {
 }
 
 func (bt *BTree) growRoot(sepKey []byte, leftID, rightID uint32) (bool, error) {
+	// Running out of parents anywhere else means a page above was let go too early
+	if leftID != bt.root.Load() {
+		return false, fmt.Errorf("growRoot: split page %d is not the root: %w", leftID, ErrCorruptTree)
+	}
+
 	p := bt.pager.AllocatePage()
 	root := NewInternalPage(p)
 
@@ -124,9 +169,13 @@ func (bt *BTree) growRoot(sepKey []byte, leftID, rightID uint32) (bool, error) {
 		return false, err
 	}
 
-	bt.root = root.Page.ID
+	// Readers can't get past the new root until the frame is over
+	if _, err := bt.modify(root.Page.ID); err != nil {
+		return false, err
+	}
+	bt.root.Store(root.Page.ID)
 
-	bt.meta.SetRootID(bt.root)
+	bt.meta.SetRootID(root.Page.ID)
 	bt.writePage(bt.meta.Page)
 	return true, nil
 }
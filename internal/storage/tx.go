@@ -0,0 +1,73 @@
+package storage
+
+import "errors"
+
+// Writes applied through Apply either all reach the tree or none of them do.
+// The whole batch runs as one WAL frame, so replay applies every page it
+// changed or none of them and a failure undoes the pages in the cache
+
+type OpKind int
+
+const (
+	OpPut OpKind = iota
+	OpDelete
+)
+
+type Op struct {
+	Kind OpKind
+	Key  []byte
+	Val  []byte
+	Mode PutMode
+}
+
+func (bt *BTree) Apply(ops []Op) error {
+	return bt.update(func() error {
+		for _, op := range ops {
+			var err error
+			switch op.Kind {
+			case OpPut:
+				_, err = bt.putLocked(op.Key, op.Val, op.Mode)
+			case OpDelete:
+				err = bt.deleteLocked(op.Key)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ApplyEach runs ops as one WAL frame like Apply, but an op that fails because
+// of its key (too large, already there or missing) is skipped and reported in
+// its slot of the result instead of undoing the others. Those failures are
+// found before any page is touched, anything else still undoes the whole frame
+func (bt *BTree) ApplyEach(ops []Op) ([]error, error) {
+	results := make([]error, len(ops))
+
+	err := bt.update(func() error {
+		for i, op := range ops {
+			var err error
+			switch op.Kind {
+			case OpPut:
+				_, err = bt.putLocked(op.Key, op.Val, op.Mode)
+			case OpDelete:
+				err = bt.deleteLocked(op.Key)
+			}
+
+			switch {
+			case err == nil:
+			case errors.Is(err, ErrKeyTooLarge), errors.Is(err, ErrKeyExists), errors.Is(err, ErrKeyNotFound):
+				results[i] = err
+			default:
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
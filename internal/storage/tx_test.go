@@ -0,0 +1,207 @@
+package storage_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.store/internal/engine"
+	"go.store/internal/storage"
+)
+
+func TestTxCommitAndRollback(t *testing.T) {
+	db := openTestDB(t, "test_tx")
+
+	if err := db.Set("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := db.Begin()
+	if err := tx.Set("b", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction sees its own writes, everyone else does not
+	if _, err := tx.Get("a"); err == nil {
+		t.Fatalf("Expected a to be deleted inside the transaction")
+	}
+	if v, err := tx.Get("b"); err != nil || !bytes.Equal(v, []byte("2")) {
+		t.Fatalf("Expected b=2 inside the transaction, got %s %v", v, err)
+	}
+	if _, err := db.Get("b"); err == nil {
+		t.Fatalf("Uncommitted write is visible outside the transaction")
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+
+	if _, err := db.Get("a"); err == nil {
+		t.Fatalf("Expected a to be deleted after commit")
+	}
+	if v, err := db.Get("b"); err != nil || !bytes.Equal(v, []byte("2")) {
+		t.Fatalf("Expected b=2 after commit, got %s %v", v, err)
+	}
+
+	tx = db.Begin()
+	if err := tx.Set("c", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("c"); err == nil {
+		t.Fatalf("Rolled back write is visible")
+	}
+	if err := tx.Commit(); !errors.Is(err, engine.ErrTxDone) {
+		t.Fatalf("Expected ErrTxDone, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func TestTxFailedCommitIsUndone(t *testing.T) {
+	db := openTestDB(t, "test_tx_abort")
+
+	const N = 3000
+
+	tx := db.Begin()
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		if err := tx.Set(k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.SetNX("conflict", []byte("tx")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else takes the key before we commit
+	if err := db.Set("conflict", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Commit(); !errors.Is(err, storage.ErrKeyExists) {
+		t.Fatalf("Expected commit to fail with ErrKeyExists, got %v", err)
+	}
+
+	// None of the splits from the failed commit may be left behind
+	kvs, err := db.Scan("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 1 || kvs[0].Key != "conflict" || string(kvs[0].Value) != "other" {
+		t.Fatalf("Expected only the conflicting key to remain, got %d keys", len(kvs))
+	}
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("%08d", i)
+		if err := db.Set(k, []byte(k)); err != nil {
+			t.Fatalf("Set %s after failed commit failed: %v", k, err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func TestReplaySkipsUncommittedTx(t *testing.T) {
+	cfg := createTestDB(t, "test_tx_replay")
+
+	db, err := engine.Open("test_tx_replay", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	committed := db.Begin()
+	for i := 0; i < 500; i++ {
+		committed.Set(fmt.Sprintf("ok%05d", i), []byte("x"))
+	}
+	if err := committed.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// This commit fails part way through so its pages are logged without a commit record
+	if err := db.Set("missing", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := db.Begin()
+	for i := 0; i < 500; i++ {
+		failed.Set(fmt.Sprintf("no%05d", i), []byte("x"))
+	}
+	if err := failed.SetXX("missing", []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := failed.Commit(); err == nil {
+		t.Fatalf("Expected commit to fail")
+	}
+
+	// Simulate a crash by copying the files while the database is still open
+	crashCfg := createTestDB(t, "test_tx_replay")
+	copyFile(t, testDBPath(cfg, "test_tx_replay"), testDBPath(crashCfg, "test_tx_replay"))
+	copyFile(t, testDBPath(cfg, "test_tx_replay")+".wal", testDBPath(crashCfg, "test_tx_replay")+".wal")
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	crashed, err := engine.Open("test_tx_replay", crashCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kvs, err := crashed.Scan("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 500 {
+		t.Fatalf("Expected 500 committed keys after replay, got %d", len(kvs))
+	}
+	for _, kv := range kvs {
+		if kv.Key[:2] != "ok" {
+			t.Fatalf("Uncommitted key %s was replayed", kv.Key)
+		}
+	}
+
+	if err := crashed.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		t.Fatal(err)
+	}
+}
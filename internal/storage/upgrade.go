@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.store/internal/logger"
+)
+
+// Every change to the layout of the DB file bumps FormatVersion and registers
+// a migration that rewrites files from the version before it. Open refuses any
+// other version, Upgrade brings older files up to date.
+//
+// Migrations run on a copy of the file that only replaces the original once
+// every step has finished and been synced, a crash part way through leaves the
+// original untouched and the next upgrade starts over
+
+const FormatVersion = 7
+
+const (
+	// Pages without a checksum in their header, the signature follows the page type
+	formatLegacy = 1
+	// Checksummed pages, the meta page did not record a version yet
+	formatUnversioned = 2
+	// Internal pages with room for exactly 128 children
+	formatFixedFanout = 3
+	// The meta page had no feature flags
+	formatNoFeatures = 4
+	// Leaves were compacted on every delete
+	formatEagerCompaction = 5
+	// The meta page did not record the LSN the WAL had reached
+	formatNoLSN = 6
+)
+
+type migration struct {
+	from int
+	desc string
+	// Rewrite the file at path, it is a private copy of the database without a WAL
+	apply func(path string, log *logger.Logger) error
+}
+
+// A step may leave the file past from+1, the next one is picked by the version it leaves behind
+var migrations []migration
+
+// Registered in init, the steps open pagers and Open describes the steps
+func init() {
+	migrations = []migration{
+		{from: formatLegacy, desc: "rebuild pages without checksums in the checksummed layout", apply: migrateLegacy},
+		{from: formatUnversioned, desc: "record the format version in the meta page", apply: stampFormatVersion(formatUnversioned + 1)},
+		{from: formatFixedFanout, desc: "lay out internal pages with variable fanout", apply: migrateFanout},
+		// The flags sit in bytes that were always zero, no features is already right
+		{from: formatNoFeatures, desc: "add feature flags to the meta page", apply: stampFormatVersion(formatNoFeatures + 1)},
+		{from: formatEagerCompaction, desc: "track fragmented space in leaf pages", apply: migrateFragmented},
+		// LSNs started over with every log, the first checkpoint records where they are up to
+		{from: formatNoLSN, desc: "record the last LSN in the meta page", apply: stampFormatVersion(formatNoLSN + 1)},
+	}
+}
+
+func findMigration(version int) (migration, bool) {
+	for _, m := range migrations {
+		if m.from == version {
+			return m, true
+		}
+	}
+	return migration{}, false
+}
+
+// Describe the steps between version and FormatVersion
+func pendingMigrations(version int) []string {
+	var steps []string
+	for _, m := range migrations {
+		if m.from >= version {
+			steps = append(steps, m.desc)
+		}
+	}
+	return steps
+}
+
+// Explain why a file of the given version can't be opened by this release
+func checkFormat(path string, version int) error {
+	switch {
+	case version > FormatVersion:
+		return fmt.Errorf("Open %w: %s is format version %d, this release reads up to %d", ErrFormatTooNew, path, version, FormatVersion)
+	case version < FormatVersion:
+		return fmt.Errorf("Open %w: %s is format version %d, this release uses %d (%s)",
+			ErrUpgradeRequired, path, version, FormatVersion, strings.Join(pendingMigrations(version), ", "))
+	}
+	return nil
+}
+
+type UpgradeStats struct {
+	From int
+	To   int
+	// Descriptions of the migrations that ran
+	Steps []string
+	// Where the original file was kept, empty when nothing changed
+	Backup string
+}
+
+// Upgrade rewrites the DB file at path to the current format. The original is
+// kept next to it as <path>.v<version>
+func Upgrade(path string, log *logger.Logger) (UpgradeStats, error) {
+	version, err := readFormatVersion(path)
+	if err != nil {
+		return UpgradeStats{}, err
+	}
+
+	stats := UpgradeStats{From: version, To: version}
+	if version > FormatVersion {
+		return stats, checkFormat(path, version)
+	}
+	if version == FormatVersion {
+		return stats, nil
+	}
+
+	if err := settleWAL(path, version, log); err != nil {
+		return stats, err
+	}
+
+	// Replaying the log can write a meta page that is already up to date
+	if version, err = readFormatVersion(path); err != nil {
+		return stats, err
+	}
+	stats.From, stats.To = version, version
+	if version == FormatVersion {
+		return stats, nil
+	}
+
+	work := path + ".upgrade"
+	os.Remove(work)
+	os.Remove(work + ".wal")
+
+	if err := copyDBFile(path, work); err != nil {
+		return stats, fmt.Errorf("upgrade: %w", err)
+	}
+
+	for version < FormatVersion {
+		m, ok := findMigration(version)
+		if !ok {
+			os.Remove(work)
+			return stats, fmt.Errorf("upgrade: no migration from format version %d", version)
+		}
+
+		log.Infof("upgrade: %s: %s", path, m.desc)
+		if err := m.apply(work, log); err != nil {
+			os.Remove(work)
+			os.Remove(work + ".wal")
+			return stats, err
+		}
+		stats.Steps = append(stats.Steps, m.desc)
+
+		next, err := readFormatVersion(work)
+		if err != nil {
+			os.Remove(work)
+			return stats, err
+		}
+		if next <= version {
+			os.Remove(work)
+			return stats, fmt.Errorf("upgrade: migration from format version %d left the file at %d", version, next)
+		}
+		version = next
+	}
+
+	if err := syncFile(work); err != nil {
+		return stats, fmt.Errorf("upgrade: %w", err)
+	}
+
+	backup := fmt.Sprintf("%s.v%d", path, stats.From)
+	os.Remove(backup)
+	if err := os.Link(path, backup); err != nil {
+		if err := copyDBFile(path, backup); err != nil {
+			return stats, fmt.Errorf("upgrade: %w", err)
+		}
+	}
+
+	// The log has been replayed and removed, nothing in it belongs to the new file
+	os.Remove(path + ".wal")
+	if err := os.Rename(work, path); err != nil {
+		return stats, fmt.Errorf("upgrade: %s", err)
+	}
+	os.Remove(work + ".wal")
+
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return stats, fmt.Errorf("upgrade: %w", err)
+	}
+
+	stats.To = version
+	stats.Backup = backup
+	log.Infof("upgrade: %s: format version %d -> %d, the original file was kept as %s", path, stats.From, stats.To, backup)
+	return stats, nil
+}
+
+func readFormatVersion(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("Database does not exist")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Error opening DB file: %s", err)
+	}
+	defer f.Close()
+
+	_, version, err := checkSignature(f)
+	return version, err
+}
+
+// Apply anything left in the log so the steps only have to deal with the DB file
+func settleWAL(path string, version int, log *logger.Logger) error {
+	info, err := os.Stat(path + ".wal")
+	if err != nil || info.Size() <= walHeaderSize {
+		return nil
+	}
+
+	// Log records hold page images in the old layout, they can't be applied to a rebuilt file
+	if version == formatLegacy {
+		return fmt.Errorf("upgrade: %s has a WAL that was never replayed, open it with the previous release first", path)
+	}
+
+	pager, err := OpenWithOptions(path, log, Options{Durability: DurabilityNone, anyFormat: true})
+	if err != nil {
+		return err
+	}
+	return pager.Close()
+}
+
+// Steps whose pages are already right only need the new version written down
+func stampFormatVersion(version int) func(path string, log *logger.Logger) error {
+	return func(path string, log *logger.Logger) error {
+		pager, err := OpenWithOptions(path, log, Options{Durability: DurabilityNone, anyFormat: true})
+		if err != nil {
+			return err
+		}
+
+		meta, err := pager.meta()
+		if err != nil {
+			pager.Close()
+			return err
+		}
+
+		meta.SetFormatVersion(version)
+		if err := pager.writeMeta(meta); err != nil {
+			pager.Close()
+			return err
+		}
+		return pager.Close()
+	}
+}
+
+func copyDBFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return fmt.Errorf("copying %s: %s", src, err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Make the renames in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return err
+	}
+	return nil
+}
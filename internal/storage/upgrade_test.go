@@ -0,0 +1,164 @@
+package storage_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"go.store/internal/engine"
+	"go.store/internal/logger"
+	"go.store/internal/storage"
+)
+
+// Offset of the format version in the meta page
+const formatOffset = 48
+
+func setFormatVersion(t *testing.T, path string, version int) {
+	t.Helper()
+
+	editPage(t, path, 0, func(page []byte) {
+		binary.LittleEndian.PutUint16(page[formatOffset:], uint16(version))
+	})
+}
+
+func upgradeFile(path string) (storage.UpgradeStats, error) {
+	return storage.Upgrade(path, logger.New(io.Discard, logger.ERROR))
+}
+
+// The fixture was written by format 3, with internal pages that reserved room
+// for 128 children. Long keys give it a few levels of internal pages
+func fixedFanoutContents() map[string]string {
+	want := make(map[string]string)
+	for i := 0; i < 150; i++ {
+		want[fmt.Sprintf("key%04d", i)+strings.Repeat("k", 393)] = fmt.Sprintf("value-%04d", i)
+	}
+	return want
+}
+
+func TestOlderFormatsAreUpgraded(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		steps   int
+	}{
+		// Files written before the version was recorded have 0 in its place
+		{name: "unversioned", version: 0, steps: 5},
+		{name: "fixed-fanout", version: 3, steps: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := createTestDB(t, "test_upgrade")
+			path := testDBPath(cfg, "test_upgrade")
+			copyFile(t, "testdata/format-v3.db", path)
+			if tt.version != 3 {
+				setFormatVersion(t, path, tt.version)
+			}
+
+			_, err := engine.Open("test_upgrade", cfg)
+			if !errors.Is(err, storage.ErrUpgradeRequired) {
+				t.Fatalf("Expected ErrUpgradeRequired, got %v", err)
+			}
+			if !strings.Contains(err.Error(), "gostore upgrade test_upgrade") {
+				t.Fatalf("Expected the error to say how to upgrade, got %v", err)
+			}
+
+			original, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Left behind by an upgrade that crashed part way through
+			if err := os.WriteFile(path+".upgrade", []byte("partial"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			stats, err := upgradeFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.To != storage.FormatVersion || len(stats.Steps) != tt.steps {
+				t.Fatalf("Expected %d steps up to version %d, got %+v", tt.steps, storage.FormatVersion, stats)
+			}
+
+			kept, err := os.ReadFile(stats.Backup)
+			if err != nil {
+				t.Fatalf("Original file was not kept: %v", err)
+			}
+			if !bytes.Equal(kept, original) {
+				t.Fatal("Kept file differs from the original")
+			}
+			if _, err := os.Stat(path + ".upgrade"); !os.IsNotExist(err) {
+				t.Fatalf("Expected the work file to be gone, got %v", err)
+			}
+
+			r := verifyFile(t, path)
+			if !r.OK() {
+				t.Fatalf("Upgraded file has problems: %v", r.Problems)
+			}
+			if r.Depth < 3 {
+				t.Fatalf("Expected the fixture to have several levels, got depth %d", r.Depth)
+			}
+
+			db, err := engine.Open("test_upgrade", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := fixedFanoutContents()
+			verifyContents(t, db, want, "after upgrade")
+
+			// Splits, merges and borrows all work on the rewritten pages
+			for i := 150; i < 300; i++ {
+				k := fmt.Sprintf("key%04d", i) + strings.Repeat("k", 393)
+				if err := db.Set(k, []byte("new")); err != nil {
+					t.Fatal(err)
+				}
+				want[k] = "new"
+			}
+			for i := 0; i < 200; i += 2 {
+				k := fmt.Sprintf("key%04d", i) + strings.Repeat("k", 393)
+				if err := db.Delete(k); err != nil {
+					t.Fatal(err)
+				}
+				delete(want, k)
+			}
+			verifyContents(t, db, want, "after writes")
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if r := verifyFile(t, path); !r.OK() {
+				t.Fatalf("File has problems after writes: %v", r.Problems)
+			}
+
+			// Nothing is left to do the second time
+			stats, err = upgradeFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(stats.Steps) != 0 || stats.Backup != "" {
+				t.Fatalf("Expected nothing to change, got %+v", stats)
+			}
+		})
+	}
+}
+
+func TestNewerFormatIsRefused(t *testing.T) {
+	cfg := createTestDB(t, "test_upgrade_newer")
+	path := testDBPath(cfg, "test_upgrade_newer")
+
+	setFormatVersion(t, path, storage.FormatVersion+1)
+
+	if _, err := engine.Open("test_upgrade_newer", cfg); !errors.Is(err, storage.ErrFormatTooNew) {
+		t.Fatalf("Expected ErrFormatTooNew, got %v", err)
+	}
+	if _, err := upgradeFile(path); !errors.Is(err, storage.ErrFormatTooNew) {
+		t.Fatalf("Expected upgrade to refuse the file, got %v", err)
+	}
+}
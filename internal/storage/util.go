@@ -7,6 +7,60 @@ func (bt *BTree) writePage(page *Page) error {
 	return bt.pager.WritePage(page)
 }
 
+// Run a write operation under the tree lock as a single WAL frame. Once the lock
+// is released we wait for the frame to be durable, so concurrent writers can share an fsync
+func (bt *BTree) update(fn func() error) error {
+	offset, err := bt.updateLocked(fn)
+	if err != nil {
+		return err
+	}
+	return bt.pager.wal.Commit(offset)
+}
+
+func (bt *BTree) updateLocked(fn func() error) (offset uint64, err error) {
+	bt.pager.write.Lock()
+	defer bt.pager.write.Unlock()
+	return bt.frame(fn)
+}
+
+// Run fn as a single WAL frame, must hold the tree lock exclusively or be the latching writer
+func (bt *BTree) frame(fn func() error) (offset uint64, err error) {
+	bt.pager.beginOp()
+	bt.pager.beginFrame()
+
+	// Before any latch is let go, so a cursor that sees a page the frame
+	// changed also sees the new version
+	defer bt.version.Add(1)
+
+	// Splits panic on unexpected overflow, make sure the cache is restored first
+	defer func() {
+		if r := recover(); r != nil {
+			bt.rollback()
+			panic(r)
+		}
+	}()
+
+	if err := fn(); err != nil {
+		bt.rollback()
+		return 0, err
+	}
+
+	bt.checkMeta()
+	if err := bt.pager.commitFrame(bt.root.Load()); err != nil {
+		return 0, err
+	}
+	return bt.pager.wal.Offset(), nil
+}
+
+// Undo the running frame in memory
+func (bt *BTree) rollback() {
+	bt.pager.abortFrame()
+
+	// The meta page has been restored so pick the root back up from it
+	bt.root.Store(bt.meta.GetRootID())
+	bt.metaDirty = false
+}
+
 // Helper to check if we need to write the meta page in memory to disk
 func (bt *BTree) checkMeta() {
 	if bt.metaDirty {
@@ -17,18 +71,18 @@ func (bt *BTree) checkMeta() {
 
 // Free any orphaned pages
 func (bt *BTree) FreePage(id uint32) {
-	if id == bt.root || id == 0 {
+	if id == bt.root.Load() || id == 0 {
 		return
 	}
 
 	p, _ := bt.pager.ReadPage(id)
 
 	p.Type = PageTypeFree
-	p.Data = make([]byte, PageSize)
+	p.Data = make([]byte, bt.pager.pageSize)
 	p.Data[0] = byte(PageTypeFree)
 
 	prevHead := bt.meta.GetFreeHead()
-	binary.LittleEndian.PutUint32(p.Data[1:5], prevHead)
+	binary.LittleEndian.PutUint32(p.Data[freeNextOffset:freeNextOffset+4], prevHead)
 
 	bt.meta.SetFreeHead(id)
 	bt.metaDirty = true
@@ -39,6 +93,14 @@ func (bt *BTree) FreePage(id uint32) {
 	}
 }
 
+func (bt *BTree) CacheStats() CacheStats {
+	return bt.pager.CacheStats()
+}
+
+func (bt *BTree) WALStats() WALStats {
+	return bt.pager.WALStats()
+}
+
 func (bt *BTree) Close() error {
 	return bt.pager.Close()
 }
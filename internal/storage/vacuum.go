@@ -0,0 +1,404 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Vacuum shrinks the DB file down to the pages that are in use. Live pages past
+// the new end of the file are copied into free pages in front of it and every
+// pointer to them is rewritten, then the file is checkpointed and truncated.
+//
+// Pages are moved in small WAL frames, each leaving a valid tree behind, so a
+// crash part way through only loses the moves that had not committed yet. The
+// free pages set aside for those moves stay leaked until the next vacuum
+
+type VacuumStats struct {
+	PageSize    int
+	PagesBefore uint32
+	PagesAfter  uint32
+	Moved       int
+}
+
+// Pages moved per WAL frame. A frame keeps every page it touches pinned in the
+// cache until it commits, so frames are kept small
+const vacuumBatch = 64
+
+// Where the pointer to a page is stored. Tree pages are referenced by child
+// slot of their parent (numKeys for the right child) or by the meta page when
+// they are the root. Overflow pages are referenced by the cell slot of their
+// leaf or, with slot -1, by the previous page of their chain
+type pageRef struct {
+	page uint32
+	slot int
+}
+
+func (bt *BTree) Vacuum() (VacuumStats, error) {
+	bt.pager.write.Lock()
+	defer bt.pager.write.Unlock()
+
+	stats := VacuumStats{PageSize: bt.pager.pageSize, PagesBefore: bt.pager.numPages}
+
+	refs, err := bt.liveRefs()
+	if err != nil {
+		return stats, err
+	}
+
+	// Everything in use fits in front of target
+	target := uint32(len(refs)) + 1
+	if target >= bt.pager.numPages {
+		stats.PagesAfter = bt.pager.numPages
+		return stats, nil
+	}
+
+	var holes, moving []uint32
+	for id := uint32(1); id < bt.pager.numPages; id++ {
+		_, live := refs[id]
+		switch {
+		case id < target && !live:
+			holes = append(holes, id)
+		case id >= target && live:
+			moving = append(moving, id)
+		}
+	}
+
+	// Take the holes off the free list before anything is copied into them
+	if _, err := bt.frame(func() error { return bt.trimFreeList(target, refs) }); err != nil {
+		return stats, err
+	}
+
+	for start := 0; start < len(moving); start += vacuumBatch {
+		end := min(start+vacuumBatch, len(moving))
+
+		_, err := bt.frame(func() error {
+			for i := start; i < end; i++ {
+				if err := bt.movePage(refs, moving[i], holes[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+
+		stats.Moved = end
+	}
+
+	// A backup may still have to read the pages past target, they stay on the
+	// free list until the next vacuum
+	bt.pager.mu.Lock()
+	backup := bt.pager.backupRunning()
+	bt.pager.mu.Unlock()
+	if backup {
+		stats.PagesAfter = stats.PagesBefore
+		bt.log.Warnf("vacuum: moved %d pages but left the file at %d pages while a backup is running", stats.Moved, stats.PagesBefore)
+		return stats, nil
+	}
+
+	// Every page past target is free now. Get them into the DB file and out of the log
+	if err := bt.pager.wal.Sync(); err != nil {
+		return stats, err
+	}
+	if err := bt.pager.wal.checkpointLocked(); err != nil {
+		return stats, err
+	}
+
+	// Archived logs replayed over a backup have to drop the same pages
+	if err := bt.pager.logTruncate(target); err != nil {
+		return stats, err
+	}
+
+	// The free list has to be gone before the pages it holds. If we crash in
+	// between the tail is only leaked and the next vacuum drops it
+	bt.meta.SetFreeHead(InvalidPage)
+	if err := bt.pager.writeMeta(bt.meta); err != nil {
+		return stats, err
+	}
+
+	if err := bt.pager.truncate(target); err != nil {
+		return stats, err
+	}
+
+	stats.PagesAfter = target
+	bt.log.Infof("vacuum: %d -> %d pages, moved %d", stats.PagesBefore, stats.PagesAfter, stats.Moved)
+	return stats, nil
+}
+
+// Find every page in use by the tree and where it is referenced from
+func (bt *BTree) liveRefs() (map[uint32]pageRef, error) {
+	refs := map[uint32]pageRef{bt.root.Load(): {page: 0}}
+
+	var walk func(id uint32) error
+	walk = func(id uint32) error {
+		bt.pager.beginOp()
+
+		p, err := bt.pager.ReadPage(id)
+		if err != nil {
+			return err
+		}
+
+		switch p.Type {
+		case PageTypeInternal:
+			ip := WrapInternalPage(p)
+			n := ip.GetNumKeys()
+
+			children := make([]uint32, n+1)
+			for i := 0; i < n; i++ {
+				children[i] = ip.GetChild(i)
+			}
+			children[n] = ip.GetRightChild()
+
+			for i, child := range children {
+				if err := bt.addRef(refs, child, pageRef{page: id, slot: i}); err != nil {
+					return err
+				}
+				if err := walk(child); err != nil {
+					return err
+				}
+			}
+
+		case PageTypeLeaf:
+			lp := WrapLeafPage(p)
+			for i := 0; i < lp.GetNumCells(); i++ {
+				off := lp.GetCellPointer(i)
+				if !lp.IsOverflow(off) {
+					continue
+				}
+
+				_, first := lp.ReadOverflowPointer(off)
+				if err := bt.overflowRefs(refs, first, pageRef{page: id, slot: i}); err != nil {
+					return err
+				}
+			}
+
+		default:
+			return fmt.Errorf("vacuum: %w (page %d has type %d)", ErrCorruptTree, id, p.Type)
+		}
+		return nil
+	}
+
+	if err := walk(bt.root.Load()); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+func (bt *BTree) overflowRefs(refs map[uint32]pageRef, first uint32, ref pageRef) error {
+	curr := first
+
+	for curr != InvalidPage {
+		if err := bt.addRef(refs, curr, ref); err != nil {
+			return err
+		}
+
+		p, err := bt.pager.ReadPage(curr)
+		if err != nil {
+			return err
+		}
+		if p.Type != PageTypeOverflow {
+			return fmt.Errorf("vacuum: %w (page=%d)", ErrCorruptOverflow, curr)
+		}
+
+		ref = pageRef{page: curr, slot: -1}
+		curr = WrapOverflowPage(p).GetNext()
+	}
+	return nil
+}
+
+func (bt *BTree) addRef(refs map[uint32]pageRef, id uint32, ref pageRef) error {
+	if id == 0 || id >= bt.pager.numPages {
+		return fmt.Errorf("vacuum: %w (page=%d)", ErrInvalidPointer, id)
+	}
+	if _, ok := refs[id]; ok {
+		return fmt.Errorf("vacuum: %w (page %d is referenced twice)", ErrCorruptTree, id)
+	}
+	refs[id] = ref
+	return nil
+}
+
+// Drop every page in front of target from the free list
+func (bt *BTree) trimFreeList(target uint32, refs map[uint32]pageRef) error {
+	var last *Page
+	head := InvalidPage
+	seen := make(map[uint32]bool)
+
+	for curr := bt.meta.GetFreeHead(); curr != InvalidPage; {
+		if curr == 0 || curr >= bt.pager.numPages || seen[curr] {
+			return fmt.Errorf("vacuum: %w (page=%d)", ErrCorruptFreeList, curr)
+		}
+		if _, live := refs[curr]; live {
+			return fmt.Errorf("vacuum: %w (page %d is in use)", ErrCorruptFreeList, curr)
+		}
+		seen[curr] = true
+
+		p, err := bt.pager.ReadPage(curr)
+		if err != nil {
+			return err
+		}
+		next := binary.LittleEndian.Uint32(p.Data[freeNextOffset : freeNextOffset+4])
+
+		if curr >= target {
+			if last == nil {
+				head = curr
+			} else if err := bt.setFreeNext(last, curr); err != nil {
+				return err
+			}
+			last = p
+		}
+		curr = next
+	}
+
+	if last != nil {
+		if err := bt.setFreeNext(last, InvalidPage); err != nil {
+			return err
+		}
+	}
+
+	if head != bt.meta.GetFreeHead() {
+		bt.meta.SetFreeHead(head)
+		bt.metaDirty = true
+	}
+	return nil
+}
+
+func (bt *BTree) setFreeNext(p *Page, next uint32) error {
+	if binary.LittleEndian.Uint32(p.Data[freeNextOffset:freeNextOffset+4]) == next {
+		return nil
+	}
+	binary.LittleEndian.PutUint32(p.Data[freeNextOffset:freeNextOffset+4], next)
+	return bt.writePage(p)
+}
+
+// Copy page from into the unused page to, point everything that referenced
+// from at its new location and free it
+func (bt *BTree) movePage(refs map[uint32]pageRef, from, to uint32) error {
+	src, err := bt.pager.ReadPage(from)
+	if err != nil {
+		return err
+	}
+
+	// Holes that were leaked may not even pass their checksum
+	dst, err := bt.pager.ReadPage(to)
+	if err != nil {
+		dst = NewPage(bt.pager.pageSize)
+		dst.ID = to
+	}
+	copy(dst.Data, src.Data)
+	dst.Type = src.Type
+
+	ref := refs[from]
+
+	switch dst.Type {
+	case PageTypeInternal:
+		if err := bt.repointParent(ref, to); err != nil {
+			return err
+		}
+
+		ip := WrapInternalPage(dst)
+		n := ip.GetNumKeys()
+		for i := 0; i < n; i++ {
+			refs[ip.GetChild(i)] = pageRef{page: to, slot: i}
+		}
+		refs[ip.GetRightChild()] = pageRef{page: to, slot: n}
+
+	case PageTypeLeaf:
+		if err := bt.repointParent(ref, to); err != nil {
+			return err
+		}
+
+		lp := WrapLeafPage(dst)
+		if err := bt.repointSiblings(lp, to); err != nil {
+			return err
+		}
+
+		for i := 0; i < lp.GetNumCells(); i++ {
+			off := lp.GetCellPointer(i)
+			if lp.IsOverflow(off) {
+				_, first := lp.ReadOverflowPointer(off)
+				refs[first] = pageRef{page: to, slot: i}
+			}
+		}
+
+	case PageTypeOverflow:
+		p, err := bt.pager.ReadPage(ref.page)
+		if err != nil {
+			return err
+		}
+
+		if ref.slot < 0 {
+			WrapOverflowPage(p).SetNext(to)
+		} else {
+			lp := WrapLeafPage(p)
+			lp.SetOverflowFirst(lp.GetCellPointer(ref.slot), to)
+		}
+
+		if err := bt.writePage(p); err != nil {
+			return err
+		}
+
+		if next := WrapOverflowPage(dst).GetNext(); next != InvalidPage {
+			refs[next] = pageRef{page: to, slot: -1}
+		}
+
+	default:
+		return fmt.Errorf("vacuum: %w (page %d has type %d)", ErrCorruptTree, from, dst.Type)
+	}
+
+	if err := bt.writePage(dst); err != nil {
+		return err
+	}
+
+	delete(refs, from)
+	refs[to] = ref
+
+	bt.FreePage(from)
+	return nil
+}
+
+func (bt *BTree) repointParent(ref pageRef, to uint32) error {
+	if ref.page == 0 {
+		bt.root.Store(to)
+		bt.meta.SetRootID(to)
+		bt.metaDirty = true
+		return nil
+	}
+
+	p, err := bt.pager.ReadPage(ref.page)
+	if err != nil {
+		return err
+	}
+
+	ip := WrapInternalPage(p)
+	if ref.slot == ip.GetNumKeys() {
+		ip.SetRightChild(to)
+	} else {
+		ip.SetChild(ref.slot, to)
+	}
+	return bt.writePage(p)
+}
+
+func (bt *BTree) repointSiblings(lp *LeafPage, to uint32) error {
+	if prev := lp.GetPrev(); prev != InvalidPage {
+		p, err := bt.pager.ReadPage(prev)
+		if err != nil {
+			return err
+		}
+		WrapLeafPage(p).SetNext(to)
+		if err := bt.writePage(p); err != nil {
+			return err
+		}
+	}
+
+	if next := lp.GetNext(); next != InvalidPage {
+		p, err := bt.pager.ReadPage(next)
+		if err != nil {
+			return err
+		}
+		WrapLeafPage(p).SetPrev(to)
+		if err := bt.writePage(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package storage_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"go.store/internal/engine"
+	"go.store/internal/storage"
+)
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestVacuumShrinksFile(t *testing.T) {
+	cfg := createTestDB(t, "test_vacuum")
+	cfg.Durability = "none"
+	path := testDBPath(cfg, "test_vacuum")
+
+	db, err := engine.Open("test_vacuum", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep every tenth key so live pages end up spread over the whole file
+	want := make(map[string]string)
+	for i := 0; i < 4000; i++ {
+		k := fmt.Sprintf("key%05d", i)
+		v := crashValue(i, 150)
+		if i%500 == 0 {
+			v = crashValue(i, 2*storage.DefaultPageSize)
+		}
+		if err := db.Set(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = v
+	}
+	for i := 0; i < 4000; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		k := fmt.Sprintf("key%05d", i)
+		if err := db.Delete(k); err != nil {
+			t.Fatal(err)
+		}
+		delete(want, k)
+	}
+
+	stats, err := db.Vacuum()
+	if err != nil {
+		t.Fatalf("Vacuum failed: %v", err)
+	}
+	if stats.PagesAfter >= stats.PagesBefore || stats.Moved == 0 {
+		t.Fatalf("Expected vacuum to move pages and shrink the file, got %+v", stats)
+	}
+	if size := fileSize(t, path); size != int64(stats.PagesAfter)*storage.DefaultPageSize {
+		t.Fatalf("Expected the file to hold %d pages, it is %d bytes", stats.PagesAfter, size)
+	}
+
+	verifyContents(t, db, want, "after vacuum")
+
+	// The tree keeps working, new pages come from the end of the shorter file
+	for i := 0; i < 200; i++ {
+		k := fmt.Sprintf("new%05d", i)
+		if err := db.Set(k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = k
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := verifyFile(t, path); !r.OK() {
+		t.Fatalf("Vacuumed file has problems: %v", r.Problems)
+	}
+
+	db, err = engine.Open("test_vacuum", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	verifyContents(t, db, want, "after reopen")
+}
+
+func TestVacuumLeavesFullFileAlone(t *testing.T) {
+	cfg := createTestDB(t, "test_vacuum_full")
+	cfg.Durability = "none"
+
+	db, err := engine.Open("test_vacuum_full", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 500; i++ {
+		k := fmt.Sprintf("key%05d", i)
+		if err := db.Set(k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := db.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Moved != 0 || stats.PagesAfter != stats.PagesBefore {
+		t.Fatalf("Expected nothing to change, got %+v", stats)
+	}
+}
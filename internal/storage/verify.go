@@ -0,0 +1,475 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.store/internal/logger"
+)
+
+// Verify walks every page reachable from the meta page and checks the invariants
+// the tree relies on. Problems are collected rather than returned as errors so a
+// single run reports everything that is wrong with a file
+
+type Problem struct {
+	Page    uint32 `json:"page"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+const (
+	ProblemChecksum  = "checksum"
+	ProblemPage      = "page"
+	ProblemOrder     = "order"
+	ProblemSeparator = "separator"
+	ProblemDepth     = "depth"
+	ProblemSibling   = "sibling"
+	ProblemOverflow  = "overflow"
+	ProblemFreeList  = "free-list"
+	ProblemDuplicate = "duplicate"
+	ProblemLeaked    = "leaked"
+	ProblemWAL       = "wal"
+)
+
+type VerifyReport struct {
+	Path          string    `json:"path"`
+	PageSize      int       `json:"page_size"`
+	Pages         uint32    `json:"pages"`
+	Depth         int       `json:"depth"`
+	Keys          int       `json:"keys"`
+	LeafPages     int       `json:"leaf_pages"`
+	InternalPages int       `json:"internal_pages"`
+	OverflowPages int       `json:"overflow_pages"`
+	FreePages     int       `json:"free_pages"`
+	Problems      []Problem `json:"problems"`
+}
+
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Keep memory bounded when checking large files
+const verifyCachePages = 1024
+
+// Verify the database at path as it is on disk without changing it. A log that
+// still holds frames is reported rather than replayed, opening the database applies it
+func Verify(path string, log *logger.Logger) (*VerifyReport, error) {
+	pager, err := OpenWithOptions(path, log, Options{CachePages: verifyCachePages, readOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	bt, err := NewBTree(pager, log)
+	if err != nil {
+		pager.Close()
+		return nil, err
+	}
+
+	report := bt.Verify()
+	report.Path = path
+	if msg := pendingWAL(path, bt.meta); msg != "" {
+		report.Problems = append(report.Problems, Problem{Page: 0, Kind: ProblemWAL, Message: msg})
+	}
+
+	return report, bt.Close()
+}
+
+// Describe the frames left in the log at path that the DB file doesn't hold yet, empty if there are none
+func pendingWAL(path string, meta *MetaPage) string {
+	walPath := path + ".wal"
+	f, err := os.Open(walPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Sprintf("%s: %s", walPath, err)
+	}
+
+	h, err := readWALHeader(f, walPath)
+	if err != nil {
+		// A crash while the log was being reset can leave a partial header but never any records
+		if info.Size() < walHeaderSize {
+			return ""
+		}
+		return err.Error()
+	}
+	if h.dbID != meta.GetDatabaseID() {
+		return fmt.Sprintf("%s is for database %s, this is %s", walPath, h.dbID, meta.GetDatabaseID())
+	}
+
+	// A log from an earlier checkpoint has been applied already
+	if h.salt != meta.GetCheckpointSeq() || info.Size() <= int64(h.size) {
+		return ""
+	}
+	return fmt.Sprintf("%s holds %d bytes of frames that have not been checkpointed, open the database to replay them",
+		walPath, info.Size()-int64(h.size))
+}
+
+type leafLinks struct {
+	id, next, prev uint32
+}
+
+type verifier struct {
+	bt     *BTree
+	report *VerifyReport
+	// What each page was reached as, a page must only ever be reached once
+	owner  map[uint32]string
+	leaves []leafLinks
+	// Whether the database was created with prefix compression, every leaf must agree
+	prefixed bool
+}
+
+func (bt *BTree) Verify() *VerifyReport {
+	// Readers don't change anything so only writers have to wait
+	bt.pager.write.RLock()
+	defer bt.pager.write.RUnlock()
+	bt.pager.writer.Lock()
+	defer bt.pager.writer.Unlock()
+
+	v := &verifier{
+		bt:     bt,
+		report: &VerifyReport{PageSize: bt.pager.pageSize, Pages: bt.pager.numPages, Problems: []Problem{}},
+		owner:  map[uint32]string{0: "meta"},
+
+		prefixed: bt.meta.GetFeatures()&FeaturePrefixCompression != 0,
+	}
+
+	v.walk(bt.root.Load(), nil, nil, 1)
+	v.checkSiblings()
+	v.checkFreeList()
+	v.checkLeaks()
+
+	return v.report
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+func (v *verifier) problem(id uint32, kind, format string, args ...any) {
+	v.report.Problems = append(v.report.Problems, Problem{
+		Page:    id,
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// Record that id was reached as owner, reports and returns false if it already was
+func (v *verifier) mark(id uint32, owner string) bool {
+	if prev, ok := v.owner[id]; ok {
+		v.problem(id, ProblemDuplicate, "reached as %s page but already reached as %s page", owner, prev)
+		return false
+	}
+	v.owner[id] = owner
+	return true
+}
+
+func (v *verifier) read(id uint32) (*Page, bool) {
+	v.bt.pager.beginOp()
+
+	page, err := v.bt.pager.ReadPage(id)
+	if err != nil {
+		var corrupt *ErrCorruptPage
+		if errors.As(err, &corrupt) {
+			v.problem(id, ProblemChecksum, "%v", err)
+		} else {
+			v.problem(id, ProblemPage, "read failed: %v", err)
+		}
+		return nil, false
+	}
+	return page, true
+}
+
+// Check the subtree at id, every key in it must satisfy lo <= key < hi
+func (v *verifier) walk(id uint32, lo, hi []byte, depth int) {
+	if id == 0 || id >= v.bt.pager.numPages {
+		v.problem(id, ProblemPage, "child pointer out of range (%d pages)", v.bt.pager.numPages)
+		return
+	}
+
+	if !v.mark(id, "tree") {
+		return
+	}
+
+	page, ok := v.read(id)
+	if !ok {
+		return
+	}
+
+	switch page.Type {
+	case PageTypeLeaf:
+		v.walkLeaf(WrapLeafPage(page), lo, hi, depth)
+	case PageTypeInternal:
+		v.walkInternal(WrapInternalPage(page), lo, hi, depth)
+	default:
+		v.problem(id, ProblemPage, "unexpected page type %d in tree", page.Type)
+	}
+}
+
+func (v *verifier) walkInternal(ip *InternalPage, lo, hi []byte, depth int) {
+	id := ip.Page.ID
+	v.report.InternalPages++
+
+	size := len(ip.Page.Data)
+	n := ip.GetNumKeys()
+	start, end := ip.GetFreeStart(), ip.GetFreeEnd()
+	if start != internalDataStart+n*2 || start > end || end > size {
+		v.problem(id, ProblemPage, "header is inconsistent (keys=%d start=%d end=%d)", n, start, end)
+		return
+	}
+
+	keys := make([][]byte, n)
+	for i := range keys {
+		ptr := int(ip.GetKeyPointer(i))
+		if ptr < end || ptr+internalCellHeader > size {
+			v.problem(id, ProblemPage, "cell pointer %d out of range", i)
+			return
+		}
+
+		key, ok := readCheckedKey(ip.Page.Data, ptr+4, 2)
+		if !ok {
+			v.problem(id, ProblemPage, "key %d runs past the end of the page", i)
+			return
+		}
+		keys[i] = append([]byte(nil), key...)
+
+		if i > 0 && bytes.Compare(keys[i-1], key) >= 0 {
+			v.problem(id, ProblemOrder, "separator %q is not greater than %q", key, keys[i-1])
+		}
+		if !inBounds(key, lo, hi) {
+			v.problem(id, ProblemSeparator, "separator %q outside of the parent's range %s", key, describeRange(lo, hi))
+		}
+	}
+
+	children := make([]uint32, n+1)
+	for i := 0; i < n; i++ {
+		children[i] = ip.GetChild(i)
+	}
+	children[n] = ip.GetRightChild()
+
+	for i, child := range children {
+		clo, chi := lo, hi
+		if i > 0 {
+			clo = keys[i-1]
+		}
+		if i < n {
+			chi = keys[i]
+		}
+		v.walk(child, clo, chi, depth+1)
+	}
+}
+
+func (v *verifier) walkLeaf(lp *LeafPage, lo, hi []byte, depth int) {
+	id := lp.Page.ID
+	v.report.LeafPages++
+
+	if v.report.Depth == 0 {
+		v.report.Depth = depth
+	} else if depth != v.report.Depth {
+		v.problem(id, ProblemDepth, "leaf at depth %d, expected %d", depth, v.report.Depth)
+	}
+
+	v.leaves = append(v.leaves, leafLinks{id: id, next: lp.GetNext(), prev: lp.GetPrev()})
+
+	size := len(lp.Page.Data)
+	n := lp.GetNumCells()
+	start, end, frag := lp.GetFreeStart(), lp.GetFreeEnd(), lp.GetFragmented()
+	if start > end || end > size || frag > size-end {
+		v.problem(id, ProblemPage, "header is inconsistent (cells=%d start=%d end=%d fragmented=%d)", n, start, end, frag)
+		return
+	}
+
+	if lp.IsPrefixed() != v.prefixed {
+		v.problem(id, ProblemPage, "prefix compression is %s, the database has it %s", onOff(lp.IsPrefixed()), onOff(v.prefixed))
+	}
+	prefix := lp.GetPrefix()
+
+	var prev []byte
+	live := 0
+	for i := 0; i < n; i++ {
+		ptr := int(lp.GetCellPointer(i))
+		if ptr < end || ptr+4 > size {
+			v.problem(id, ProblemPage, "cell pointer %d out of range", i)
+			return
+		}
+
+		suffix, ok := readCheckedKey(lp.Page.Data, ptr, 4)
+		valLen := int(binary.LittleEndian.Uint16(lp.Page.Data[ptr+2:ptr+4]) &^ overflowFlag)
+		if !ok || ptr+4+len(suffix)+valLen > size {
+			v.problem(id, ProblemPage, "cell %d runs past the end of the page", i)
+			return
+		}
+		key := append(append([]byte(nil), prefix...), suffix...)
+		live += 4 + len(suffix) + valLen
+
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			v.problem(id, ProblemOrder, "key %q is not greater than %q", key, prev)
+		}
+		if !inBounds(key, lo, hi) {
+			v.problem(id, ProblemSeparator, "key %q outside of the parent's range %s", key, describeRange(lo, hi))
+		}
+		prev = append(prev[:0], key...)
+
+		if lp.IsOverflow(uint16(ptr)) {
+			if valLen != overflowPtrSize {
+				v.problem(id, ProblemOverflow, "overflow pointer of key %q is %d bytes", key, valLen)
+				continue
+			}
+			total, first := lp.ReadOverflowPointer(uint16(ptr))
+			v.checkOverflow(id, key, total, first)
+		}
+
+		v.report.Keys++
+	}
+
+	// Everything below the free end is either a live cell or a hole left by a delete
+	if live+frag != size-end {
+		v.problem(id, ProblemPage, "%d bytes of cells and %d fragmented, expected %d in total", live, frag, size-end)
+	}
+}
+
+func (v *verifier) checkOverflow(leaf uint32, key []byte, total, first uint32) {
+	var length uint32
+	curr := first
+
+	for length < total {
+		if curr == 0 || curr >= v.bt.pager.numPages {
+			v.problem(leaf, ProblemOverflow, "chain of key %q points at page %d", key, curr)
+			return
+		}
+
+		if !v.mark(curr, "overflow") {
+			return
+		}
+
+		page, ok := v.read(curr)
+		if !ok {
+			return
+		}
+
+		if page.Type != PageTypeOverflow {
+			v.problem(curr, ProblemOverflow, "chain of key %q reaches a page of type %d", key, page.Type)
+			return
+		}
+
+		v.report.OverflowPages++
+
+		op := WrapOverflowPage(page)
+		if op.GetDataLen() == 0 || op.GetDataLen() > overflowCapacity(len(page.Data)) {
+			v.problem(curr, ProblemOverflow, "holds %d bytes", op.GetDataLen())
+			return
+		}
+
+		length += uint32(op.GetDataLen())
+		curr = op.GetNext()
+	}
+
+	if length != total {
+		v.problem(leaf, ProblemOverflow, "chain of key %q holds %d bytes, expected %d", key, length, total)
+	}
+}
+
+// The sibling links must visit the leaves in the same order as the tree walk
+func (v *verifier) checkSiblings() {
+	for i, leaf := range v.leaves {
+		next, prev := InvalidPage, InvalidPage
+		if i+1 < len(v.leaves) {
+			next = v.leaves[i+1].id
+		}
+		if i > 0 {
+			prev = v.leaves[i-1].id
+		}
+
+		if leaf.next != next {
+			v.problem(leaf.id, ProblemSibling, "next link is %d, expected %d", leaf.next, next)
+		}
+		if leaf.prev != prev {
+			v.problem(leaf.id, ProblemSibling, "prev link is %d, expected %d", leaf.prev, prev)
+		}
+	}
+}
+
+func (v *verifier) checkFreeList() {
+	curr := v.bt.meta.GetFreeHead()
+	from := uint32(0)
+
+	for curr != InvalidPage {
+		if curr == 0 || curr >= v.bt.pager.numPages {
+			v.problem(from, ProblemFreeList, "points at page %d which is out of range", curr)
+			return
+		}
+
+		if owner, ok := v.owner[curr]; ok {
+			if owner == "free" {
+				v.problem(curr, ProblemFreeList, "free list has a cycle")
+			} else {
+				v.problem(curr, ProblemFreeList, "page is on the free list but in use as %s page", owner)
+			}
+			return
+		}
+		v.owner[curr] = "free"
+
+		page, ok := v.read(curr)
+		if !ok {
+			return
+		}
+
+		if page.Type != PageTypeFree {
+			v.problem(curr, ProblemFreeList, "page on the free list has type %d", page.Type)
+		}
+
+		v.report.FreePages++
+		from, curr = curr, binary.LittleEndian.Uint32(page.Data[freeNextOffset:freeNextOffset+4])
+	}
+}
+
+// Every page must be part of the tree, an overflow chain or the free list
+func (v *verifier) checkLeaks() {
+	for id := uint32(1); id < v.bt.pager.numPages; id++ {
+		if _, ok := v.owner[id]; !ok {
+			v.problem(id, ProblemLeaked, "page is not reachable from the tree or the free list")
+		}
+	}
+}
+
+// Read the length prefixed key of a record with a header of hdr bytes at off,
+// returning false if it does not fit in the page
+func readCheckedKey(data []byte, off, hdr int) ([]byte, bool) {
+	if off+2 > len(data) {
+		return nil, false
+	}
+
+	keyLen := int(binary.LittleEndian.Uint16(data[off : off+2]))
+	start := off + hdr
+	if start+keyLen > len(data) {
+		return nil, false
+	}
+	return data[start : start+keyLen], true
+}
+
+func inBounds(key, lo, hi []byte) bool {
+	if lo != nil && bytes.Compare(key, lo) < 0 {
+		return false
+	}
+	return hi == nil || bytes.Compare(key, hi) < 0
+}
+
+func describeRange(lo, hi []byte) string {
+	l, h := "-inf", "+inf"
+	if lo != nil {
+		l = fmt.Sprintf("%q", lo)
+	}
+	if hi != nil {
+		h = fmt.Sprintf("%q", hi)
+	}
+	return "[" + l + ", " + h + ")"
+}
@@ -0,0 +1,288 @@
+package storage_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.store/internal/engine"
+	"go.store/internal/logger"
+	"go.store/internal/storage"
+)
+
+// Build a database with several levels, overflow chains and a free list
+func createVerifyDB(t *testing.T, dbname string) string {
+	t.Helper()
+
+	cfg := createTestDB(t, dbname)
+	cfg.Durability = "none"
+
+	db, err := engine.Open(dbname, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3000; i++ {
+		k := fmt.Sprintf("key%05d", i)
+		if err := db.Set(k, []byte(crashValue(i, 100))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if err := db.Set(fmt.Sprintf("big%d", i), []byte(crashValue(i, 3*storage.DefaultPageSize))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1000; i < 2000; i++ {
+		if err := db.Delete(fmt.Sprintf("key%05d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return testDBPath(cfg, dbname)
+}
+
+func verifyFile(t *testing.T, path string) *storage.VerifyReport {
+	t.Helper()
+
+	report, err := storage.Verify(path, logger.New(io.Discard, logger.ERROR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+// Edit page id of the file at path and fix up its checksum so only the edit is wrong
+func editPage(t *testing.T, path string, id int, edit func(page []byte)) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := data[id*storage.DefaultPageSize : (id+1)*storage.DefaultPageSize]
+	edit(page)
+
+	h := crc32.NewIEEE()
+	h.Write(page[:1])
+	h.Write(page[5:])
+	binary.LittleEndian.PutUint32(page[1:5], h.Sum32())
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func hasProblem(r *storage.VerifyReport, kind string) bool {
+	for _, p := range r.Problems {
+		if p.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVerifyHealthyDatabase(t *testing.T) {
+	path := createVerifyDB(t, "test_verify")
+
+	r := verifyFile(t, path)
+	if !r.OK() {
+		t.Fatalf("Expected no problems, got %v", r.Problems)
+	}
+
+	if r.Keys != 2005 {
+		t.Fatalf("Expected 2005 keys, got %d", r.Keys)
+	}
+	if r.Depth < 2 || r.InternalPages == 0 || r.OverflowPages == 0 || r.FreePages == 0 {
+		t.Fatalf("Expected a multi level tree with overflow and free pages, got %+v", r)
+	}
+
+	counted := 1 + r.LeafPages + r.InternalPages + r.OverflowPages + r.FreePages
+	if uint32(counted) != r.Pages {
+		t.Fatalf("Accounted for %d of %d pages", counted, r.Pages)
+	}
+}
+
+func TestVerifyDetectsLeakedPage(t *testing.T) {
+	path := createVerifyDB(t, "test_verify_leak")
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, storage.DefaultPageSize)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if r := verifyFile(t, path); !hasProblem(r, storage.ProblemLeaked) {
+		t.Fatalf("Expected a leaked page, got %v", r.Problems)
+	}
+}
+
+func TestVerifyDetectsFreeListCycle(t *testing.T) {
+	path := createVerifyDB(t, "test_verify_free")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := binary.LittleEndian.Uint32(data[20:24])
+
+	// Point the head of the free list back at itself
+	editPage(t, path, int(head), func(page []byte) {
+		binary.LittleEndian.PutUint32(page[5:9], head)
+	})
+
+	if r := verifyFile(t, path); !hasProblem(r, storage.ProblemFreeList) {
+		t.Fatalf("Expected a free list problem, got %v", r.Problems)
+	}
+}
+
+func TestVerifyDetectsKeyOutOfOrder(t *testing.T) {
+	path := createVerifyDB(t, "test_verify_order")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rename a key in the first leaf that has more than one so it sorts after its neighbours
+	for id := 1; id < len(data)/storage.DefaultPageSize; id++ {
+		page := data[id*storage.DefaultPageSize : (id+1)*storage.DefaultPageSize]
+		if page[0] != byte(storage.PageTypeLeaf) || binary.LittleEndian.Uint16(page[5:7]) < 2 {
+			continue
+		}
+
+		editPage(t, path, id, func(page []byte) {
+			ptr := binary.LittleEndian.Uint16(page[19:21])
+			page[ptr+4] = 'z'
+		})
+		break
+	}
+
+	r := verifyFile(t, path)
+	if !hasProblem(r, storage.ProblemOrder) || !hasProblem(r, storage.ProblemSeparator) {
+		t.Fatalf("Expected ordering and separator problems, got %v", r.Problems)
+	}
+}
+
+func TestVerifyReportsCorruptPage(t *testing.T) {
+	path := createVerifyDB(t, "test_verify_corrupt")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[storage.DefaultPageSize+storage.DefaultPageSize/2] ^= 0x10
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if r := verifyFile(t, path); !hasProblem(r, storage.ProblemChecksum) {
+		t.Fatalf("Expected a checksum problem, got %v", r.Problems)
+	}
+}
+
+type fileState struct {
+	data    []byte
+	modTime time.Time
+}
+
+func readFileState(t *testing.T, path string) fileState {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileState{data: data, modTime: info.ModTime()}
+}
+
+// Checking a database, even one with frames left in its log, must not write to it
+func TestVerifyLeavesFilesUntouched(t *testing.T) {
+	cfg := createTestDB(t, "test_verify_untouched")
+	cfg.Durability = "none"
+	path := testDBPath(cfg, "test_verify_untouched")
+
+	db, err := engine.Open("test_verify_untouched", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := db.Set(fmt.Sprintf("key%05d", i), []byte(crashValue(i, 100))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Copy the files as a crash would leave them, the frames are only in the log
+	crashed := filepath.Join(t.TempDir(), "crashed.db")
+	copyFile(t, path, crashed)
+	copyFile(t, path+".wal", crashed+".wal")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Backdate both so any write shows up whatever the mtime granularity
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, p := range []string{path, crashed, crashed + ".wal"} {
+		if err := os.Chtimes(p, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		pending bool
+	}{
+		{name: "checkpointed", path: path},
+		{name: "pending log", path: crashed, pending: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := []string{tt.path}
+			if tt.pending {
+				files = append(files, tt.path+".wal")
+			}
+
+			before := make([]fileState, len(files))
+			for i, p := range files {
+				before[i] = readFileState(t, p)
+			}
+
+			r := verifyFile(t, tt.path)
+			if hasProblem(r, storage.ProblemWAL) != tt.pending {
+				t.Fatalf("Expected a pending log to be reported: %v, got %v", tt.pending, r.Problems)
+			}
+			if !tt.pending && !r.OK() {
+				t.Fatalf("Expected no problems, got %v", r.Problems)
+			}
+
+			for i, p := range files {
+				after := readFileState(t, p)
+				if !bytes.Equal(after.data, before[i].data) || !after.modTime.Equal(before[i].modTime) {
+					t.Fatalf("%s was changed by Verify", p)
+				}
+			}
+			if _, err := os.Stat(tt.path + ".wal"); !tt.pending && !os.IsNotExist(err) {
+				t.Fatalf("Expected Verify not to create a log, got %v", err)
+			}
+		})
+	}
+}
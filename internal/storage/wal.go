@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -9,6 +11,7 @@ import (
 	"os"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"go.store/internal/logger"
 )
@@ -23,19 +26,135 @@ type WAL struct {
 	log      *logger.Logger
 	size     int64
 
+	// Sequence number of the last frame begun, LSNs carry on across checkpoints
+	lastLSN uint64
+	// LSN the log picked up from when it was reset
+	startLSN uint64
+	// Layout of the records in the file, older logs are only read by Upgrade
+	version int
+
+	// Identity of the DB file, written to the header whenever the log is reset
+	dbID DatabaseID
+	salt uint64
+	// Set when the header is from an earlier checkpoint and the records must be ignored
+	stale bool
+
+	// Directory logs are copied to before they are reset, empty when not archiving
+	archiveDir string
+
 	mu                sync.Mutex
 	checkpointRunning int32
+
+	// Total bytes ever appended, the offset writers wait on to become durable
+	appended uint64
+
+	durability   Durability
+	commitWindow time.Duration
+
+	// Group commit state, a single leader fsyncs on behalf of everyone waiting
+	syncMu   sync.Mutex
+	syncCond *sync.Cond
+	syncing  bool
+	synced   uint64
+	syncs    uint64
+}
+
+type WALStats struct {
+	Durability Durability
+	// Bytes appended since the WAL was opened
+	Bytes uint64
+	// Number of fsyncs issued on the WAL file
+	Syncs uint64
+	// LSN of the last frame begun
+	LSN uint64
 }
 
 // Replay every 100MB
 const WALCheckpointSize = 100 * 1024 * 1024
 
-// WAL file structure
+// WAL file header, written whenever the log is reset
+// Magic: [8]byte
+// Format Version: uint16
+// Page Size: uint32
+// Database ID: [16]byte (matches the meta page)
+// Salt: uint64 (checkpoint sequence of the meta page when the log was reset)
+// Start LSN: uint64 (LSN of the last frame before the log was reset)
+// Checksum: uint32
+
+var walMagic = []byte{'G', 'o', 'S', 't', 'W', 'A', 'L', 0}
+
+const (
+	walFormatVersion = 3
+	walHeaderSize    = 8 + 2 + 4 + 16 + 8 + 8 + 4
+
+	// Records had no timestamp and the header no start LSN
+	walFormatNoTime     = 2
+	walNoTimeHeaderSize = 8 + 2 + 4 + 16 + 8 + 4
+)
+
+// WAL file structure, a sequence of frames. Each write operation logs a begin
+// record, the pages it changed and an end record all under the same LSN. LSNs
+// only ever grow, the meta page records the last one whenever the log is reset
+//
+// Begin record
+// Kind: uint8 (walRecordBegin)
+// LSN: uint64
+// Time: int64 (unix nanoseconds)
+// Checksum: uint32
+//
+// Page record
+// Kind: uint8 (walRecordPage)
+// LSN: uint64
+// Time: int64
 // Page ID: uint32
-// Page Data: []byte PageSize
+// Page Data: []byte page size of the database
+// Checksum: uint32
+//
+// Truncate record, the file drops every page from Page Count on
+// Kind: uint8 (walRecordTruncate)
+// LSN: uint64
+// Time: int64
+// Page Count: uint32
+// Checksum: uint32
+//
+// End record
+// Kind: uint8 (walRecordEnd)
+// LSN: uint64
+// Time: int64
 // Checksum: uint32
+//
+// Replay only applies the pages of a frame once its end record has been read,
+// frames cut short by a crash or an aborted operation are discarded
+
+const (
+	walRecordPage     byte = 1
+	walRecordEnd      byte = 2
+	walRecordBegin    byte = 3
+	walRecordTruncate byte = 4
+
+	walRecordHeaderSize = 17
+	walMarkerRecordSize = walRecordHeaderSize + 4
+
+	walNoTimeRecordHeaderSize = 9
+)
+
+func walPageRecordSize(pageSize int) int {
+	return walRecordHeaderSize + 4 + pageSize + 4
+}
+
+func walRecordHeaderSizeFor(version int) int {
+	if version == walFormatNoTime {
+		return walNoTimeRecordHeaderSize
+	}
+	return walRecordHeaderSize
+}
 
 func OpenWAL(path string, pager *Pager, log *logger.Logger) (*WAL, error) {
+	meta, err := pager.meta()
+	if err != nil {
+		return nil, err
+	}
+
 	f, err := os.OpenFile(path+".wal", os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, err
@@ -43,29 +162,202 @@ func OpenWAL(path string, pager *Pager, log *logger.Logger) (*WAL, error) {
 
 	info, _ := f.Stat()
 	wal := &WAL{
-		file:     f,
-		filePath: path + ".wal",
-		pager:    pager,
-		log:      log,
-		size:     info.Size(),
+		file:         f,
+		filePath:     path + ".wal",
+		pager:        pager,
+		log:          log,
+		size:         info.Size(),
+		lastLSN:      meta.GetLSN(),
+		version:      walFormatVersion,
+		dbID:         meta.GetDatabaseID(),
+		salt:         meta.GetCheckpointSeq(),
+		durability:   DurabilityAlways,
+		commitWindow: DefaultCommitWindow,
+	}
+	wal.syncCond = sync.NewCond(&wal.syncMu)
+
+	// A crash while the log was being reset can leave a partial header but never any records
+	if wal.size < walHeaderSize {
+		if err := wal.Truncate(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return wal, nil
+	}
+
+	if err := wal.checkHeader(); err != nil {
+		f.Close()
+		return nil, err
 	}
 
 	return wal, nil
 }
 
-func (wal *WAL) LogPage(page *Page) error {
-	buf := make([]byte, 8+PageSize)
+func (wal *WAL) header() []byte {
+	buf := make([]byte, walHeaderSize)
+
+	copy(buf[0:8], walMagic)
+	binary.LittleEndian.PutUint16(buf[8:10], walFormatVersion)
+	binary.LittleEndian.PutUint32(buf[10:14], uint32(wal.pager.pageSize))
+	copy(buf[14:30], wal.dbID[:])
+	binary.LittleEndian.PutUint64(buf[30:38], wal.salt)
+	binary.LittleEndian.PutUint64(buf[38:46], wal.startLSN)
+
+	csum := crc32.ChecksumIEEE(buf[:walHeaderSize-4])
+	binary.LittleEndian.PutUint32(buf[walHeaderSize-4:], csum)
+	return buf
+}
+
+// Header of a log as read from its file
+type walHeader struct {
+	version  int
+	size     int
+	pageSize uint32
+	dbID     DatabaseID
+	salt     uint64
+	startLSN uint64
+}
+
+func readWALHeader(f *os.File, path string) (walHeader, error) {
+	var h walHeader
+
+	buf := make([]byte, walHeaderSize)
+	n, err := f.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return h, fmt.Errorf("Error reading WAL header: %s", err)
+	}
+	buf = buf[:n]
+
+	if len(buf) < 10 || !bytes.Equal(buf[0:8], walMagic) {
+		return h, fmt.Errorf("%w: %s is not a GoStore WAL", ErrWALMismatch, path)
+	}
+
+	h.version = int(binary.LittleEndian.Uint16(buf[8:10]))
+	switch h.version {
+	case walFormatVersion:
+		h.size = walHeaderSize
+	case walFormatNoTime:
+		h.size = walNoTimeHeaderSize
+	default:
+		return h, fmt.Errorf("%w: format version %d, expected %d", ErrWALMismatch, h.version, walFormatVersion)
+	}
+	if len(buf) < h.size {
+		return h, fmt.Errorf("%w: %s is not a GoStore WAL", ErrWALMismatch, path)
+	}
+
+	csum := binary.LittleEndian.Uint32(buf[h.size-4:])
+	if csum != crc32.ChecksumIEEE(buf[:h.size-4]) {
+		return h, fmt.Errorf("%w: header %v", ErrWALMismatch, ErrChecksumMismatch)
+	}
+
+	h.pageSize = binary.LittleEndian.Uint32(buf[10:14])
+	copy(h.dbID[:], buf[14:30])
+	h.salt = binary.LittleEndian.Uint64(buf[30:38])
+	if h.version == walFormatVersion {
+		h.startLSN = binary.LittleEndian.Uint64(buf[38:46])
+	}
+	return h, nil
+}
+
+// Refuse logs that were not written for this DB file, a log from an earlier
+// checkpoint of the same file has already been applied and is only ignored
+func (wal *WAL) checkHeader() error {
+	h, err := readWALHeader(wal.file, wal.filePath)
+	if err != nil {
+		return fmt.Errorf("OpenWAL %w", err)
+	}
+
+	// Replaying pages of the wrong size would tear every page in the file
+	if h.pageSize != uint32(wal.pager.pageSize) {
+		return fmt.Errorf("OpenWAL %w: page size %d, database uses %d", ErrWALMismatch, h.pageSize, wal.pager.pageSize)
+	}
+
+	if h.dbID != wal.dbID {
+		return fmt.Errorf("OpenWAL %w: log is for database %s, this is %s", ErrWALMismatch, h.dbID, wal.dbID)
+	}
+
+	wal.version = h.version
+	wal.startLSN = h.startLSN
+
+	if h.salt != wal.salt {
+		wal.log.Warnf("OpenWAL: log is from checkpoint %d, database is at %d, ignoring it", h.salt, wal.salt)
+		wal.stale = true
+	}
+
+	return nil
+}
+
+// Start a new frame and return its LSN
+func (wal *WAL) LogBegin() (uint64, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	wal.lastLSN++
+	lsn := wal.lastLSN
+	return lsn, wal.appendLocked(markerRecord(walRecordBegin, lsn))
+}
 
-	binary.LittleEndian.PutUint32(buf[0:4], page.ID)
-	copy(buf[4:], page.Data)
+func (wal *WAL) LogPage(page *Page, lsn uint64) error {
+	size := len(page.Data)
+	buf := make([]byte, walPageRecordSize(size))
+
+	putRecordHeader(buf, walRecordPage, lsn)
+	binary.LittleEndian.PutUint32(buf[walRecordHeaderSize:], page.ID)
+	copy(buf[walRecordHeaderSize+4:], page.Data)
 
 	// Add a checksum to verify the integrity of the log
-	csum := crc32.ChecksumIEEE(page.Data)
-	binary.LittleEndian.PutUint32(buf[4+PageSize:], csum)
+	csum := crc32.ChecksumIEEE(buf[:walRecordHeaderSize+4+size])
+	binary.LittleEndian.PutUint32(buf[walRecordHeaderSize+4+size:], csum)
+
+	return wal.append(buf)
+}
+
+// Log a frame of its own that cuts the file down to numPages and return its LSN.
+// Vacuum drops pages without going through a frame, archived logs need to as well
+func (wal *WAL) LogTruncate(numPages uint32) (uint64, error) {
+	lsn, err := wal.LogBegin()
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, walRecordHeaderSize+4+4)
+	putRecordHeader(buf, walRecordTruncate, lsn)
+	binary.LittleEndian.PutUint32(buf[walRecordHeaderSize:], numPages)
+	binary.LittleEndian.PutUint32(buf[walRecordHeaderSize+4:], crc32.ChecksumIEEE(buf[:walRecordHeaderSize+4]))
+
+	if err := wal.append(buf); err != nil {
+		return 0, err
+	}
+	return lsn, wal.LogEnd(lsn)
+}
+
+// Mark every page logged under lsn as part of a finished operation
+func (wal *WAL) LogEnd(lsn uint64) error {
+	return wal.append(markerRecord(walRecordEnd, lsn))
+}
+
+func markerRecord(kind byte, lsn uint64) []byte {
+	buf := make([]byte, walMarkerRecordSize)
+	putRecordHeader(buf, kind, lsn)
+
+	csum := crc32.ChecksumIEEE(buf[:walRecordHeaderSize])
+	binary.LittleEndian.PutUint32(buf[walRecordHeaderSize:], csum)
+	return buf
+}
+
+func putRecordHeader(buf []byte, kind byte, lsn uint64) {
+	buf[0] = kind
+	binary.LittleEndian.PutUint64(buf[1:9], lsn)
+	binary.LittleEndian.PutUint64(buf[9:17], uint64(time.Now().UnixNano()))
+}
 
+func (wal *WAL) append(buf []byte) error {
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
+	return wal.appendLocked(buf)
+}
 
+func (wal *WAL) appendLocked(buf []byte) error {
 	if _, err := wal.file.Seek(0, io.SeekEnd); err != nil {
 		return err
 	}
@@ -76,6 +368,7 @@ func (wal *WAL) LogPage(page *Page) error {
 	}
 
 	wal.size += int64(n)
+	wal.appended += uint64(n)
 
 	if wal.size >= WALCheckpointSize {
 		wal.maybeRequestCheckpoint()
@@ -83,6 +376,86 @@ func (wal *WAL) LogPage(page *Page) error {
 	return nil
 }
 
+// Offset in the log stream just past the last record written, pass it to
+// Commit to wait for everything written so far
+func (wal *WAL) Offset() uint64 {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+	return wal.appended
+}
+
+func (wal *WAL) stats() WALStats {
+	wal.mu.Lock()
+	offset, lsn := wal.appended, wal.lastLSN
+	wal.mu.Unlock()
+
+	wal.syncMu.Lock()
+	defer wal.syncMu.Unlock()
+	return WALStats{
+		Durability: wal.durability,
+		Bytes:      offset,
+		Syncs:      wal.syncs,
+		LSN:        lsn,
+	}
+}
+
+// Sync makes every record written so far durable regardless of the durability mode
+func (wal *WAL) Sync() error {
+	return wal.syncTo(wal.Offset(), 0)
+}
+
+// Commit blocks until the records up to offset are as durable as the mode requires
+func (wal *WAL) Commit(offset uint64) error {
+	switch wal.durability {
+	case DurabilityNone:
+		return nil
+	case DurabilityGroup:
+		return wal.syncTo(offset, wal.commitWindow)
+	default:
+		return wal.syncTo(offset, 0)
+	}
+}
+
+// Wait until everything up to offset has been fsynced. The first writer to arrive
+// becomes the leader, waits window for others to queue up behind it and then
+// issues one fsync that covers every record written by then
+func (wal *WAL) syncTo(offset uint64, window time.Duration) error {
+	wal.syncMu.Lock()
+	defer wal.syncMu.Unlock()
+
+	for wal.synced < offset {
+		if wal.syncing {
+			wal.syncCond.Wait()
+			continue
+		}
+
+		wal.syncing = true
+		wal.syncMu.Unlock()
+
+		if window > 0 {
+			time.Sleep(window)
+		}
+
+		// Anything written before the fsync starts is covered by it
+		target := wal.Offset()
+		err := wal.file.Sync()
+
+		wal.syncMu.Lock()
+		wal.syncing = false
+		wal.syncs++
+		if err == nil && target > wal.synced {
+			wal.synced = target
+		}
+		wal.syncCond.Broadcast()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (wal *WAL) maybeRequestCheckpoint() {
 	if atomic.LoadInt32(&wal.checkpointRunning) == 1 {
 		return
@@ -101,10 +474,40 @@ func (wal *WAL) maybeRequestCheckpoint() {
 func (wal *WAL) Checkpoint() error {
 	wal.pager.write.Lock()
 	defer wal.pager.write.Unlock()
+	return wal.checkpointLocked()
+}
+
+// Must hold pager.write
+func (wal *WAL) checkpointLocked() error {
 	if err := wal.pager.flushDirty(); err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return err
 	}
+	return wal.reset()
+}
+
+// Start a new log once every page it holds has been flushed to the DB file.
+// The new salt is made durable in the meta page before the old records are
+// dropped, so if the truncate is lost in a crash the old log is just ignored.
+// An archived log is copied out first, a stale one was copied before it went stale
+func (wal *WAL) reset() error {
+	if err := wal.archive(); err != nil {
+		return err
+	}
+
+	wal.mu.Lock()
+	lsn := wal.lastLSN
+	wal.mu.Unlock()
+
+	seq, err := wal.pager.nextCheckpoint(lsn)
+	if err != nil {
+		return err
+	}
+
+	wal.mu.Lock()
+	wal.salt = seq
+	wal.mu.Unlock()
+
 	return wal.Truncate()
 }
 
@@ -115,59 +518,179 @@ func (wal *WAL) Replay() error {
 		wal.pager.replaying = false
 	}()
 
-	f, err := os.Open(wal.filePath)
+	if wal.stale {
+		err := wal.reset()
+		wal.stale = false
+		return err
+	}
+
+	// Nothing to replay
+	if wal.size <= walHeaderSize {
+		return nil
+	}
+
+	file, err := os.Open(wal.filePath)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer file.Close()
+
+	last, err := readFrames(file, wal.version, wal.pager.pageSize, wal.log, wal.applyFrame)
+	if err != nil {
+		return err
+	}
+
+	// Frames that never finished still used up their LSNs
+	wal.lastLSN = max(wal.lastLSN, last)
+
+	// Replayed pages only live in the cache so write them out before dropping the log
+	if err := wal.pager.flushDirty(); err != nil {
+		return err
+	}
+
+	return wal.reset()
+}
+
+// A complete frame read back from a log
+type walFrame struct {
+	lsn uint64
+	// When its end record was written, zero in logs from before records had a time
+	time  time.Time
+	pages []*Page
+	// Page count the file was cut down to, 0 when the frame leaves it alone
+	truncate uint32
+}
+
+// Stops readFrames without an error
+var errStopReading = errors.New("stop reading")
+
+// Pass every complete frame in file to fn in order and return the
+// highest LSN of any record read. A torn or unknown record ends the log
+func readFrames(file *os.File, version, pageSize int, log *logger.Logger, fn func(frame *walFrame) error) (uint64, error) {
+	headerSize := walHeaderSize
+	if version == walFormatNoTime {
+		headerSize = walNoTimeHeaderSize
+	}
+	if _, err := file.Seek(int64(headerSize), io.SeekStart); err != nil {
+		return 0, err
+	}
+	f := bufio.NewReaderSize(file, 64*1024)
+
+	// Pages of the frame being read, only passed on once its end record turns up
+	frame := &walFrame{}
+	var last uint64
+	open := false
 
-	header := make([]byte, 4)
-	data := make([]byte, PageSize)
-	csum := make([]byte, 4)
+	header := make([]byte, walRecordHeaderSizeFor(version))
+	body := make([]byte, 4+pageSize+4)
 
+read:
 	for {
-		_, err := io.ReadFull(f, header[:])
+		_, err := io.ReadFull(f, header)
 		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
 			break
 		} else if err != nil {
-			return err
+			return last, err
 		}
 
-		id := binary.LittleEndian.Uint32(header)
-		_, err = io.ReadFull(f, data[:])
+		kind := header[0]
+		recLSN := binary.LittleEndian.Uint64(header[1:9])
+
+		var rec []byte
+		switch kind {
+		case walRecordPage:
+			rec = body[:4+pageSize+4]
+		case walRecordTruncate:
+			rec = body[:4+4]
+		case walRecordBegin, walRecordEnd:
+			rec = body[:4]
+		default:
+			log.Warnf("Replay: unknown record kind %d, ignoring rest of log", kind)
+			break read
+		}
+
+		_, err = io.ReadFull(f, rec)
 		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
 			break
 		} else if err != nil {
-			return err
+			return last, err
 		}
 
-		_, err = io.ReadFull(f, csum[:])
-		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		payload := rec[:len(rec)-4]
+		crc := binary.LittleEndian.Uint32(rec[len(rec)-4:])
+
+		h := crc32.NewIEEE()
+		h.Write(header)
+		h.Write(payload)
+
+		// A bad checksum means the tail of the log was torn by a crash
+		if crc != h.Sum32() {
+			log.Errorf("Replay: %v (lsn=%d), ignoring rest of log", ErrChecksumMismatch, recLSN)
 			break
-		} else if err != nil {
-			return err
+		}
+		last = max(last, recLSN)
+
+		if kind == walRecordBegin {
+			// Frames never overlap, an open frame here was abandoned by a failed operation
+			if open {
+				log.Warnf("Replay: discarding incomplete frame %d", frame.lsn)
+			}
+			frame, open = &walFrame{lsn: recLSN}, true
+			continue
 		}
 
-		crc := binary.LittleEndian.Uint32(csum)
+		if !open || recLSN != frame.lsn {
+			log.Errorf("Replay: record for frame %d outside of its frame, ignoring rest of log", recLSN)
+			break
+		}
 
-		if crc != crc32.ChecksumIEEE(data) {
-			wal.log.Errorf("Replay: checksum does not match on page %d", id)
-			return fmt.Errorf("Replay: %w (page=%d)", ErrChecksumMismatch, id)
+		switch kind {
+		case walRecordEnd:
+			if version != walFormatNoTime {
+				frame.time = time.Unix(0, int64(binary.LittleEndian.Uint64(header[9:17])))
+			}
+			open = false
+			if err := fn(frame); err != nil {
+				return last, err
+			}
+		case walRecordTruncate:
+			frame.truncate = binary.LittleEndian.Uint32(payload)
+		default:
+			page := NewPage(pageSize)
+			page.ID = binary.LittleEndian.Uint32(payload[0:4])
+			copy(page.Data, payload[4:])
+			page.Type = PageType(page.Data[0])
+
+			frame.pages = append(frame.pages, page)
 		}
+	}
 
-		page := NewPage()
-		page.ID = id
-		copy(page.Data, data)
+	if open {
+		log.Warnf("Replay: discarding incomplete frame %d", frame.lsn)
+	}
+	return last, nil
+}
 
-		if err := wal.pager.WritePage(page); err != nil {
+// Apply a frame read back from a log to the cache, must be replaying
+func (wal *WAL) applyFrame(frame *walFrame) error {
+	pager := wal.pager
+	for _, page := range frame.pages {
+		// Pages allocated after the last checkpoint are past the end of the file
+		if page.ID >= pager.numPages {
+			pager.numPages = page.ID + 1
+		}
+		if err := pager.WritePage(page); err != nil {
 			return err
 		}
 	}
 
-	return wal.Truncate()
+	if frame.truncate != 0 {
+		return pager.replayTruncate(frame.truncate)
+	}
+	return nil
 }
 
-// Remove the log entries
+// Remove the log entries, leaving just a header with the current salt
 func (wal *WAL) Truncate() error {
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
@@ -179,5 +702,7 @@ func (wal *WAL) Truncate() error {
 		return err
 	}
 	wal.size = 0
-	return nil
+	wal.version = walFormatVersion
+	wal.startLSN = wal.lastLSN
+	return wal.appendLocked(wal.header())
 }
@@ -0,0 +1,181 @@
+package storage_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"testing"
+
+	"go.store/internal/engine"
+	"go.store/internal/storage"
+)
+
+func TestWALFromOtherDatabaseIsRefused(t *testing.T) {
+	cfg := createTestDB(t, "test_wal_owner")
+	cfg.Durability = "none"
+
+	db, err := engine.Open("test_wal_owner", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("key", []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Put the live log next to a different database with the same name
+	other := createTestDB(t, "test_wal_owner")
+	copyFile(t, testDBPath(cfg, "test_wal_owner")+".wal", testDBPath(other, "test_wal_owner")+".wal")
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := engine.Open("test_wal_owner", other); !errors.Is(err, storage.ErrWALMismatch) {
+		t.Fatalf("Expected ErrWALMismatch, got %v", err)
+	}
+}
+
+func TestWALWithoutHeaderIsRefused(t *testing.T) {
+	cfg := createTestDB(t, "test_wal_garbage")
+
+	// Logs from before the header was added start straight with a record
+	junk := bytes.Repeat([]byte{1, 0, 0, 0}, 2048)
+	if err := os.WriteFile(testDBPath(cfg, "test_wal_garbage")+".wal", junk, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := engine.Open("test_wal_garbage", cfg); !errors.Is(err, storage.ErrWALMismatch) {
+		t.Fatalf("Expected ErrWALMismatch, got %v", err)
+	}
+}
+
+func TestStaleWALIsIgnored(t *testing.T) {
+	cfg := createTestDB(t, "test_wal_stale")
+	cfg.Durability = "none"
+
+	db, err := engine.Open("test_wal_stale", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set("key", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep a copy of the log as it was before the next checkpoint
+	stale := t.TempDir() + "/stale.wal"
+	copyFile(t, testDBPath(cfg, "test_wal_stale")+".wal", stale)
+
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying the old log would bring the deleted key back
+	copyFile(t, stale, testDBPath(cfg, "test_wal_stale")+".wal")
+
+	db, err = engine.Open("test_wal_stale", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key"); err == nil {
+		t.Fatalf("Stale WAL was replayed")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Rewrite a log as the release before format 7 wrote it, without timestamps or a start LSN
+func downgradeWAL(t *testing.T, log []byte) []byte {
+	t.Helper()
+
+	old := append([]byte(nil), log[:38]...)
+	binary.LittleEndian.PutUint16(old[8:10], 2)
+	old = binary.LittleEndian.AppendUint32(old, crc32.ChecksumIEEE(old))
+
+	for off := storage.WALHeaderSize; off < len(log); {
+		size := storage.WALMarkerRecordSize
+		if log[off] == storage.WALRecordPage {
+			size = storage.WALPageRecordSize
+		}
+		rec := log[off : off+size]
+
+		// Meta pages logged by the older release recorded its format version
+		if log[off] == storage.WALRecordPage && binary.LittleEndian.Uint32(rec[storage.WALRecordHeaderSize:]) == 0 {
+			binary.LittleEndian.PutUint16(rec[storage.WALRecordHeaderSize+4+formatOffset:], uint16(storage.FormatVersion-1))
+		}
+
+		start := len(old)
+		old = append(old, rec[:9]...)
+		old = append(old, rec[storage.WALRecordHeaderSize:size-4]...)
+		old = binary.LittleEndian.AppendUint32(old, crc32.ChecksumIEEE(old[start:]))
+		off += size
+	}
+	return old
+}
+
+// A log left unreplayed by the release before LSNs were recorded is replayed by upgrade
+func TestUpgradeReplaysOlderLog(t *testing.T) {
+	cfg := createTestDB(t, "test_wal_v2")
+	cfg.Durability = "none"
+	path := testDBPath(cfg, "test_wal_v2")
+
+	base, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := engine.Open("test_wal_v2", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		k := fmt.Sprintf("key%05d", i)
+		if err := db.Set(k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+		want[k] = k
+	}
+
+	log, err := os.ReadFile(path + ".wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, base, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setFormatVersion(t, path, storage.FormatVersion-1)
+	if err := os.WriteFile(path+".wal", downgradeWAL(t, log), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := upgradeFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Steps) != 1 {
+		t.Fatalf("Expected one step, got %+v", stats)
+	}
+
+	db, err = engine.Open("test_wal_v2", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verifyContents(t, db, want, "upgraded")
+
+	// LSNs carry on from the old log
+	if lsn := db.WALStats().LSN; lsn < 200 {
+		t.Fatalf("Expected LSNs to carry on past 200, got %d", lsn)
+	}
+}